@@ -4,11 +4,13 @@ go 1.19
 
 require (
 	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead
 	github.com/go-git/go-git/v5 v5.5.2
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/spf13/viper v1.15.0
 	gitlab.com/martyros/sqlutil v0.0.0-20221203201350-083dcd5be451
+	golang.org/x/text v0.6.0
 )
 
 require (
@@ -35,7 +37,6 @@ require (
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/text v0.6.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -45,8 +46,6 @@ require (
 	github.com/Microsoft/go-winio v0.6.0 // indirect
 	github.com/ProtonMail/go-crypto v0.0.0-20230117203413-a47887b8f098 // indirect
 	github.com/cloudflare/circl v1.3.1 // indirect
-	github.com/emersion/go-mbox v1.0.3
-	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
 	github.com/sergi/go-diff v1.3.1 // indirect
 	golang.org/x/crypto v0.5.0 // indirect
 	golang.org/x/tools v0.5.0 // indirect
@@ -0,0 +1,123 @@
+package imapsource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// How to log in to the server
+type AuthMethod int
+
+const (
+	// The IMAP LOGIN command, with Username and Password
+	AuthLogin = AuthMethod(0)
+	// SASL PLAIN, with Username and Password
+	AuthPlain = AuthMethod(1)
+	// SASL XOAUTH2 (as used by Gmail and Outlook), with Username
+	// and a token from TokenSource
+	AuthXOAuth2 = AuthMethod(2)
+	// SASL OAUTHBEARER (RFC 7628), with Username and a token from
+	// TokenSource
+	AuthOAuthBearer = AuthMethod(3)
+)
+
+// ParseAuthMethod parses "login", "plain", "xoauth2" or "oauthbearer"
+// (or "" for AuthLogin).
+func ParseAuthMethod(s string) (AuthMethod, error) {
+	switch strings.ToLower(s) {
+	case "", "login":
+		return AuthLogin, nil
+	case "plain":
+		return AuthPlain, nil
+	case "xoauth2":
+		return AuthXOAuth2, nil
+	case "oauthbearer":
+		return AuthOAuthBearer, nil
+	}
+	return 0, fmt.Errorf("Unknown auth method %s (wanted login, plain, xoauth2 or oauthbearer)", s)
+}
+
+// Whether the method logs in with an OAuth 2 token rather than a
+// password
+func (m AuthMethod) UsesToken() bool {
+	return m == AuthXOAuth2 || m == AuthOAuthBearer
+}
+
+// A TokenSource hands out OAuth 2 access tokens.  It's asked for one
+// every time a connection is made, so it should refresh the token if
+// it's expired (or may have).
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenSourceFunc makes a function into a TokenSource.
+type TokenSourceFunc func() (string, error)
+
+func (f TokenSourceFunc) Token() (string, error) {
+	return f()
+}
+
+// XOAUTH2 isn't in go-sasl.  If the token is refused, the server
+// sends a challenge with the details, to which the client replies
+// with nothing; the server then fails the command.
+type xoauth2Client struct {
+	username, token string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Log in with the configured method
+func (src *ImapSource) authenticate(c *client.Client, port int) error {
+	info := &src.mailbox
+
+	if info.Auth == AuthLogin {
+		return c.Login(info.Username, info.Password)
+	}
+
+	var auth sasl.Client
+	switch info.Auth {
+	case AuthPlain:
+		auth = sasl.NewPlainClient("", info.Username, info.Password)
+	case AuthXOAuth2, AuthOAuthBearer:
+		if info.TokenSource == nil {
+			return fmt.Errorf("No token source configured")
+		}
+		token, err := info.TokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("Getting OAuth token: %w", err)
+		}
+		if info.Auth == AuthXOAuth2 {
+			auth = &xoauth2Client{username: info.Username, token: token}
+		} else {
+			auth = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+				Username: info.Username,
+				Token:    token,
+				Host:     info.Hostname,
+				Port:     port,
+			})
+		}
+	default:
+		return fmt.Errorf("Unknown auth method %d", info.Auth)
+	}
+
+	mech, _, err := auth.Start()
+	if err != nil {
+		return err
+	}
+	if ok, err := c.SupportAuth(mech); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Server doesn't support AUTH=%s", mech)
+	}
+
+	return c.Authenticate(auth)
+}
@@ -0,0 +1,44 @@
+package imapsource
+
+import (
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	ts := newTestServer(t)
+
+	token := TokenSourceFunc(func() (string, error) { return "token", nil })
+
+	for _, tc := range []struct {
+		auth     AuthMethod
+		password string
+		ok       bool
+	}{
+		{AuthLogin, "password", true},
+		{AuthLogin, "wrong", false},
+		{AuthPlain, "password", true},
+		{AuthPlain, "wrong", false},
+		// The memory backend only does PLAIN
+		{AuthXOAuth2, "", false},
+		{AuthOAuthBearer, "", false},
+	} {
+		info := ts.info()
+		info.Auth = tc.auth
+		info.Password = tc.password
+		info.TokenSource = token
+		src := setupSource(t, info)
+
+		err := src.ImapConnect()
+		if (err == nil) != tc.ok {
+			t.Errorf("ERROR: auth %d, password %q: got error %v, wanted success %v",
+				tc.auth, tc.password, err, tc.ok)
+		}
+	}
+
+	// STARTTLS isn't optional once asked for
+	info := ts.info()
+	info.Security = SecuritySTARTTLS
+	if err := setupSource(t, info).ImapConnect(); err == nil {
+		t.Errorf("ERROR: connected with STARTTLS to a server without it")
+	}
+}
@@ -0,0 +1,173 @@
+package imapsource
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/emersion/go-imap"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Messages whose bodies are needed are fetched in batches, with one
+// UID FETCH per batch.  Each message is added to the database as soon
+// as its body arrives, rather than waiting for the rest of the batch.
+
+const (
+	DefaultBodyBatchSize  = 50
+	DefaultBodyBatchBytes = 8 << 20
+)
+
+type bodyBatch struct {
+	uids     []uint32
+	messages map[uint32]*imap.Message // From the envelope fetch
+	bytes    int64
+
+	maxSize  int
+	maxBytes int64
+}
+
+func (src *ImapSource) newBodyBatch() *bodyBatch {
+	b := &bodyBatch{
+		messages: map[uint32]*imap.Message{},
+		maxSize:  src.mailbox.BodyBatchSize,
+		maxBytes: src.mailbox.BodyBatchBytes,
+	}
+	if b.maxSize <= 0 {
+		b.maxSize = DefaultBodyBatchSize
+	}
+	if b.maxBytes <= 0 {
+		b.maxBytes = DefaultBodyBatchBytes
+	}
+	return b
+}
+
+func (b *bodyBatch) add(emsg *imap.Message) {
+	b.uids = append(b.uids, emsg.Uid)
+	b.messages[emsg.Uid] = emsg
+	b.bytes += int64(emsg.Size)
+}
+
+// Whether the batch should be fetched now.  A message bigger than
+// maxBytes gets a batch to itself.
+func (b *bodyBatch) full() bool {
+	return len(b.uids) >= b.maxSize || b.bytes >= b.maxBytes
+}
+
+// Fetch the bodies of a batch of messages, sending the outcome for
+// each (nil for success) down a channel which is passed on to
+// FetchContext.
+func (src *ImapSource) goFetchBodies(mdb *lmdb.MailDB, batch *bodyBatch) {
+	bodyStatus := make(chan *MessageError, len(batch.uids))
+
+	src.workers.Add(1)
+	go src.goProcessBodies(mdb, batch, bodyStatus)
+
+	src.bodyStatusChan <- bodyStatus
+}
+
+func (src *ImapSource) goProcessBodies(mdb *lmdb.MailDB, batch *bodyBatch, bodyStatus chan *MessageError) {
+	defer src.workers.Done()
+	defer close(bodyStatus)
+
+	fail := func(emsg *imap.Message, err error) {
+		bodyStatus <- &MessageError{Folder: src.folder, Uid: emsg.Uid, MessageId: emsg.Envelope.MessageId, Err: err}
+	}
+
+	bodyreq := new(fetchReq)
+	bodyreq.seqset = new(imap.SeqSet)
+	bodyreq.seqset.AddNum(batch.uids...)
+	// Buffered so that the fetcher never waits for us
+	bodyreq.messages = make(chan *imap.Message, len(batch.uids))
+	section := &imap.BodySectionName{}
+	section.Peek = true
+	bodyreq.items = []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchUid}
+	bodyreq.done = make(chan error, 1)
+
+	log.Printf("[%p] Fetching %d message bodies (%d bytes)", bodyreq, len(batch.uids), batch.bytes)
+
+	src.sendFetchReq(bodyreq)
+
+	// emsg: Message from envelope
+	// bmsg: Message from body
+	//
+	// NB the messages must be read until the channel is closed even
+	// if we've given up.
+	for bmsg := range bodyreq.messages {
+		emsg, ok := batch.messages[bmsg.Uid]
+		if !ok {
+			log.Printf("Unexpected uid %d in body fetch, ignoring", bmsg.Uid)
+			continue
+		}
+		delete(batch.messages, bmsg.Uid)
+
+		if src.ctx.Err() != nil {
+			// Interrupted; it'll be tried again next time
+			fail(emsg, src.ctx.Err())
+			continue
+		}
+
+		if bmsg.Envelope == nil || bmsg.Envelope.MessageId != emsg.Envelope.MessageId {
+			got := ""
+			if bmsg.Envelope != nil {
+				got = bmsg.Envelope.MessageId
+			}
+			fail(emsg, fmt.Errorf("Unexpected messageid: wanted %s, got %s",
+				emsg.Envelope.MessageId, got))
+			continue
+		}
+		var body imap.Literal
+		for _, body = range bmsg.Body {
+		}
+		if body == nil {
+			fail(emsg, fmt.Errorf("No literals in message body"))
+			continue
+		}
+
+		message, err := io.ReadAll(body)
+		if err != nil {
+			fail(emsg, fmt.Errorf("Error reading body: %w", err))
+			continue
+		}
+		if lmdb.NormalizeMessageId(emsg.Envelope.MessageId) == "" {
+			// Recorded even if the message turns out to be present
+			// already, so that the mailbox entry can be filled in
+			msgid, err := lmdb.RawMessageId(message)
+			if err != nil {
+				fail(emsg, fmt.Errorf("Adding message to database: %w", err))
+				continue
+			}
+			src.resultLock.Lock()
+			src.bodyIds[emsg.Uid] = msgid
+			src.resultLock.Unlock()
+		}
+		if err := mdb.AddMessageContext(src.ctx, message); err != nil {
+			fail(emsg, fmt.Errorf("Adding message to database: %w", err))
+			continue
+		}
+
+		src.resultLock.Lock()
+		src.result.Bytes += int64(len(message))
+		src.resultLock.Unlock()
+
+		bodyStatus <- nil
+	}
+
+	err := <-bodyreq.done
+	if err != nil && src.ctx.Err() == nil {
+		// Most likely the connection has gone
+		src.abort(fmt.Errorf("Fetching message bodies: %w", err))
+	}
+
+	// Anything the server didn't send (e.g., because it's been
+	// expunged since)
+	if err == nil {
+		err = fmt.Errorf("Server returned no message")
+	}
+	for _, uid := range batch.uids {
+		if emsg, ok := batch.messages[uid]; ok {
+			fail(emsg, err)
+		}
+	}
+}
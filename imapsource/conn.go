@@ -0,0 +1,202 @@
+package imapsource
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// How the connection to the server is secured
+type Security int
+
+const (
+	// TLS from the start, normally on port 993
+	SecurityTLS = Security(0)
+	// Plaintext, upgraded with STARTTLS before logging in; normally
+	// on port 143.  If the server doesn't offer STARTTLS, connecting
+	// fails.
+	SecuritySTARTTLS = Security(1)
+	// No encryption at all, password included.  Only for servers on
+	// the local machine (e.g., for testing).
+	SecurityPlain = Security(2)
+)
+
+// ParseSecurity parses "tls", "starttls" or "plain" (or "" for
+// SecurityTLS).
+func ParseSecurity(s string) (Security, error) {
+	switch strings.ToLower(s) {
+	case "", "tls":
+		return SecurityTLS, nil
+	case "starttls":
+		return SecuritySTARTTLS, nil
+	case "plain":
+		return SecurityPlain, nil
+	}
+	return 0, fmt.Errorf("Unknown connection security %s (wanted tls, starttls or plain)", s)
+}
+
+func (s Security) defaultPort() int {
+	if s == SecurityTLS {
+		return 993
+	}
+	return 143
+}
+
+// Defaults for reconnecting when the connection drops during a Fetch
+const (
+	DefaultReconnects     = 5
+	DefaultReconnectDelay = time.Second
+	maxReconnectDelay     = 5 * time.Minute
+)
+
+func (src *ImapSource) tlsConfig() (*tls.Config, error) {
+	info := &src.mailbox
+
+	config := &tls.Config{
+		ServerName:         info.Hostname,
+		InsecureSkipVerify: info.InsecureSkipVerify,
+	}
+
+	if info.CAFile != "" {
+		pem, err := os.ReadFile(info.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Reading CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", info.CAFile)
+		}
+	}
+
+	if info.CertFile != "" || info.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(info.CertFile, info.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Make the connection, securing it as configured
+func (src *ImapSource) connect(tgt string) (*client.Client, error) {
+	security := src.mailbox.Security
+
+	if security == SecurityPlain {
+		return client.Dial(tgt)
+	}
+
+	config, err := src.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if security == SecurityTLS {
+		return client.DialTLS(tgt, config)
+	}
+
+	c, err := client.Dial(tgt)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := c.SupportStartTLS(); err != nil || !ok {
+		c.Terminate()
+		if err == nil {
+			err = fmt.Errorf("Server doesn't support STARTTLS")
+		}
+		return nil, err
+	}
+	if err := c.StartTLS(config); err != nil {
+		c.Terminate()
+		return nil, fmt.Errorf("STARTTLS: %w", err)
+	}
+	return c, nil
+}
+
+// Whether the connection has gone, as opposed to the server refusing
+// something or the database failing.
+func (src *ImapSource) connectionLost() bool {
+	if src.client == nil {
+		return true
+	}
+	select {
+	case <-src.client.LoggedOut():
+		return true
+	default:
+	}
+	return src.client.Noop() != nil
+}
+
+// Tracks reconnection attempts during a Fetch
+type backoff struct {
+	attempts, max int
+	delay         time.Duration
+}
+
+func (src *ImapSource) newBackoff() *backoff {
+	b := &backoff{max: src.mailbox.Reconnects, delay: src.mailbox.ReconnectDelay}
+	if b.max == 0 {
+		b.max = DefaultReconnects
+	}
+	if b.delay <= 0 {
+		b.delay = DefaultReconnectDelay
+	}
+	return b
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
+
+// Reconnect after the connection has dropped, waiting before each
+// attempt, twice as long each time.  Gives up after the configured
+// number of attempts (in total, since the last reset), or if ctx is
+// cancelled.  done and ctx are as for terminateOnCancel.
+func (src *ImapSource) reconnect(ctx context.Context, b *backoff, done chan struct{}) error {
+	for {
+		if b.attempts >= b.max {
+			return fmt.Errorf("Giving up after %d attempts to reconnect", b.attempts)
+		}
+
+		delay := maxReconnectDelay
+		if b.attempts < 16 && b.delay<<b.attempts < maxReconnectDelay {
+			delay = b.delay << b.attempts
+		}
+		b.attempts++
+
+		log.Printf("Reconnecting in %v (attempt %d of %d)", delay, b.attempts, b.max)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := src.ImapConnect()
+		if err == nil {
+			terminateOnCancel(ctx, src.client, done)
+			return nil
+		}
+		log.Printf("Reconnecting: %v", err)
+	}
+}
+
+// IMAP commands can't be cancelled, so if ctx is cancelled before
+// done is closed, drop the connection; anything waiting on it fails.
+func terminateOnCancel(ctx context.Context, c *client.Client, done chan struct{}) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("Fetch cancelled, closing connection")
+			c.Terminate()
+		case <-done:
+		}
+	}()
+}
@@ -0,0 +1,115 @@
+package imapsource
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Flags are stored per folder, and kept up to date on every Fetch.
+// New messages get theirs along with their envelopes.  For messages
+// already in the folder, if the server supports CONDSTORE (RFC 7162)
+// only those changed since the last Fetch are asked for; otherwise
+// the flags of the whole folder are fetched every time.
+
+const statusHighestModSeq = imap.StatusItem("HIGHESTMODSEQ")
+
+// The folder's HIGHESTMODSEQ, or 0 if the server doesn't support
+// CONDSTORE.  This has to be done before selecting it, as go-imap
+// doesn't look for it in the response to SELECT.
+func (src *ImapSource) highestModSeq(folder string) (uint64, error) {
+	if ok, err := src.client.Support("CONDSTORE"); err != nil || !ok {
+		return 0, err
+	}
+
+	status, err := src.client.Status(folder, []imap.StatusItem{statusHighestModSeq})
+	if err != nil {
+		return 0, fmt.Errorf("Getting HIGHESTMODSEQ for %s: %w", folder, err)
+	}
+
+	v, ok := status.Items[statusHighestModSeq]
+	if !ok || v == nil {
+		// e.g., NOMODSEQ
+		return 0, nil
+	}
+	modseq, err := strconv.ParseUint(fmt.Sprint(v), 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("Bad HIGHESTMODSEQ for %s: %v", folder, v)
+	}
+	return modseq, nil
+}
+
+// UID FETCH with the CHANGEDSINCE modifier, if modseq is non-zero
+type fetchChangedSince struct {
+	commands.Fetch
+	modseq uint64
+}
+
+func (cmd *fetchChangedSince) Command() *imap.Command {
+	c := cmd.Fetch.Command()
+	if cmd.modseq > 0 {
+		c.Arguments = append(c.Arguments, []interface{}{
+			imap.RawString("CHANGEDSINCE"),
+			imap.RawString(strconv.FormatUint(cmd.modseq, 10)),
+		})
+	}
+	return c
+}
+
+// Add the flags of the messages in the selected folder which have
+// changed since update.State.HighestModSeq (or all of them, if it's
+// 0) to update.Flags, and record modseq as the new
+// HIGHESTMODSEQ.
+func (src *ImapSource) syncFlags(update *lmdb.MailboxUpdate, modseq uint64) error {
+	since := update.State.HighestModSeq
+	if modseq == 0 {
+		since = 0
+	} else if since == modseq {
+		// Nothing has changed
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+
+	cmd := &commands.Uid{Cmd: &fetchChangedSince{
+		Fetch:  commands.Fetch{SeqSet: seqset, Items: []imap.FetchItem{imap.FetchUid, imap.FetchFlags}},
+		modseq: since,
+	}}
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		status, err := src.client.Execute(cmd, &responses.Fetch{Messages: messages, SeqSet: seqset, Uid: true})
+		if err == nil {
+			err = status.Err()
+		}
+		done <- err
+	}()
+
+	if update.Flags == nil {
+		update.Flags = map[uint32][]string{}
+	}
+	n := 0
+	for msg := range messages {
+		update.Flags[msg.Uid] = msg.Flags
+		n++
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("Fetching flags for %s: %w", src.folder, err)
+	}
+
+	if since > 0 {
+		log.Printf("%s: flags changed for %d messages since modseq %d", src.folder, n, since)
+	}
+	update.State.HighestModSeq = modseq
+
+	return nil
+}
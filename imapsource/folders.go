@@ -0,0 +1,124 @@
+package imapsource
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// An ImapSource can sync several folders of an account over the same
+// connection, one after the other.  Each goes into the mailbox in the
+// database named MailboxPrefix followed by the folder's name.  A
+// message in several folders is only downloaded once, and is a
+// member of each mailbox.
+
+// Whether name matches pattern, as for the IMAP LIST command: `*`
+// matches anything, and `%` anything but the hierarchy delimiter.
+// INBOX is case-insensitive.
+func matchFolder(pattern, name string, delim string) bool {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	if strings.EqualFold(pattern, "INBOX") {
+		pattern = "INBOX"
+	}
+
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*', '%':
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchFolder(rest, name[i:], delim) {
+					return true
+				}
+				if i < len(name) && pattern[0] == '%' && delim != "" &&
+					strings.HasPrefix(name[i:], delim) {
+					return false
+				}
+			}
+			return false
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+// The folders to sync.  The one to watch (see Watch) comes last, so
+// that it's the one left selected after a Fetch: INBOX if it's
+// included, and otherwise the first.
+func (src *ImapSource) listFolders() ([]string, error) {
+	info := &src.mailbox
+
+	if len(info.Folders) == 0 {
+		name := info.MailboxName
+		if name == "" {
+			name = "INBOX"
+		}
+		return []string{name}, nil
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.client.List("", "*", mailboxes)
+	}()
+
+	folders := []string{}
+	for mi := range mailboxes {
+		if selectable(mi) && included(mi, info.Folders) && !included(mi, info.ExcludeFolders) {
+			folders = append(folders, mi.Name)
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("Listing folders: %w", err)
+	}
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("No folders match %v", info.Folders)
+	}
+
+	sort.Strings(folders)
+	watch := 0
+	for i, f := range folders {
+		if strings.EqualFold(f, "INBOX") {
+			watch = i
+		}
+	}
+	ordered := []string{}
+	for i, f := range folders {
+		if i != watch {
+			ordered = append(ordered, f)
+		}
+	}
+
+	return append(ordered, folders[watch]), nil
+}
+
+func selectable(mi *imap.MailboxInfo) bool {
+	for _, attr := range mi.Attributes {
+		// \NonExistent is from RFC 5258, which go-imap doesn't know
+		if attr == imap.NoSelectAttr || strings.EqualFold(attr, `\NonExistent`) {
+			return false
+		}
+	}
+	return true
+}
+
+func included(mi *imap.MailboxInfo, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchFolder(pattern, mi.Name, mi.Delimiter) {
+			return true
+		}
+	}
+	return false
+}
+
+// The mailbox in the database for a folder
+func (src *ImapSource) mailboxName(folder string) string {
+	return src.mailbox.MailboxPrefix + folder
+}
@@ -0,0 +1,79 @@
+package imapsource
+
+import (
+	"testing"
+)
+
+func TestMatchFolder(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "INBOX", true},
+		{"*", "Lists/xen/devel", true},
+		{"%", "Lists", true},
+		{"%", "Lists/xen", false},
+		{"Lists/%", "Lists/xen", true},
+		{"Lists/%", "Lists/xen/devel", false},
+		{"Lists/*", "Lists/xen/devel", true},
+		{"Lists/*", "Lists", false},
+		{"inbox", "INBOX", true},
+		{"INBOX", "Inbox", true},
+		{"Sent", "sent", false},
+		{"S*t", "Sent", true},
+		{"S%t", "Sent", true},
+	} {
+		if got := matchFolder(tc.pattern, tc.name, "/"); got != tc.want {
+			t.Errorf("ERROR: matchFolder(%q, %q): got %v, wanted %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	inbox := ts.add("INBOX", "one.eml")
+	xen := ts.add("Lists/xen", "two.eml")
+	ts.add("Trash", "three.eml")
+	ts.mailbox("Lists") // Empty
+
+	info := ts.info()
+	info.Folders = []string{"*"}
+	info.ExcludeFolders = []string{"Trash"}
+	info.MailboxPrefix = "work/"
+	src := setupSource(t, info)
+
+	checkResult(t, "initial", fetch(t, src, mdb), 2, 0, 0)
+
+	want := []string{"Lists", "Lists/xen", "INBOX"}
+	if len(src.folders) != len(want) {
+		t.Fatalf("Got folders %v, wanted %v", src.folders, want)
+	}
+	for i := range want {
+		if src.folders[i] != want[i] {
+			t.Errorf("ERROR: got folders %v, wanted %v", src.folders, want)
+			break
+		}
+	}
+
+	checkMailbox(t, mdb, "work/INBOX", []uint32{inbox}, "<one@example.com>")
+	checkMailbox(t, mdb, "work/Lists/xen", []uint32{xen}, "<two@example.com>")
+	checkMailbox(t, mdb, "work/Lists", []uint32{})
+	if prs, err := mdb.IsMsgIdPresent("<three@example.com>"); err != nil || prs {
+		t.Errorf("ERROR: message in excluded folder fetched (%v)", err)
+	}
+
+	// New messages in any folder are picked up
+	xen2 := ts.add("Lists/xen", "three.eml")
+	checkResult(t, "incremental", fetch(t, src, mdb), 1, 0, 0)
+	checkMailbox(t, mdb, "work/Lists/xen", []uint32{xen, xen2}, "<two@example.com>", "<three@example.com>")
+
+	// Without Folders, only MailboxName is synced, into the mailbox
+	// of the same name
+	info = ts.info()
+	info.MailboxName = "Lists/xen"
+	src = setupSource(t, info)
+	checkResult(t, "single folder", fetch(t, src, mdb), 0, 2, 0)
+	checkMailbox(t, mdb, "Lists/xen", []uint32{xen, xen2}, "<two@example.com>", "<three@example.com>")
+}
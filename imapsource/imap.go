@@ -1,9 +1,11 @@
 package imapsource
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -15,25 +17,99 @@ import (
 type UpdateStrategy int
 
 const (
-	StrategyAll    = UpdateStrategy(1)
+	// Look at every message in the mailbox on every fetch
+	StrategyAll = UpdateStrategy(1)
+	// Only look at messages which arrived within UpdateWindow;
+	// membership of older messages is left as it was.
 	StrategyRecent = UpdateStrategy(2)
 )
 
+// UpdateWindow used for StrategyRecent if none is specified
+const DefaultUpdateWindow = 30 * 24 * time.Hour
+
 type MailboxInfo struct {
-	MailboxName string // Required
+	MailboxName string // The folder to sync, if Folders isn't set; defaults to INBOX
+
+	// Patterns for the folders to sync, as for the IMAP LIST
+	// command; e.g., `*` for all of them, or `Lists/%` for the
+	// folders directly under Lists.  Folders matching
+	// ExcludeFolders are left out.  See folders.go.
+	Folders, ExcludeFolders []string
+
+	// Prepended to folder names to make mailbox names in the database
+	MailboxPrefix string
+
 	UpdateStrategy
 	Hostname, Username, Password string
-	Port                         int
+	Port                         int // Defaults to 993 for SecurityTLS, 143 otherwise
 	UpdateWindow                 time.Duration
+
+	// How to log in; see auth.go.  Password is used for AuthLogin
+	// and AuthPlain, TokenSource for AuthXOAuth2 and
+	// AuthOAuthBearer.
+	Auth        AuthMethod
+	TokenSource TokenSource
+
+	// How the connection is secured; see conn.go.  For TLS (with
+	// or without STARTTLS), the server's certificate is checked
+	// against the CA certificates in CAFile if set, otherwise the
+	// system's; InsecureSkipVerify doesn't check it at all.
+	// CertFile and KeyFile are a client certificate to present.
+	Security
+	CAFile             string
+	CertFile, KeyFile  string
+	InsecureSkipVerify bool
+
+	// If the connection drops during a Fetch, it's re-established
+	// up to Reconnects times (default DefaultReconnects; negative
+	// for never), waiting ReconnectDelay (default
+	// DefaultReconnectDelay) before the first attempt and twice as
+	// long before each one after.  The folder is then synced again
+	// from where it got to.
+	Reconnects     int
+	ReconnectDelay time.Duration
+
+	// For Watch: how often to poll if the server doesn't support
+	// IDLE, and to check folders other than the one being watched.
+	// Defaults to a minute.
+	PollInterval time.Duration
+
+	// Message bodies are fetched BodyBatchSize at a time (default
+	// DefaultBodyBatchSize), or fewer if their total size would be
+	// more than BodyBatchBytes (default DefaultBodyBatchBytes).
+	BodyBatchSize  int
+	BodyBatchBytes int64
+
+	// The number of connections to use for the initial sync of a
+	// folder (default 1).  The extra ones are only kept open for
+	// that.
+	Connections int
 }
 
 type ImapSource struct {
 	mailbox MailboxInfo
 	client  *client.Client
 
+	folders  []string // As of the last Fetch
+	folder   string   // Currently selected
+	mboxname string   // Mailbox in the database for folder
+
 	// Processing context
 	fetchreq       chan *fetchReq
-	bodyStatusChan chan chan error
+	bodyStatusChan chan chan *MessageError
+	workers        sync.WaitGroup // Everything which may send on fetchreq
+	ctx            context.Context
+	cancel         context.CancelFunc
+	resultLock     sync.Mutex
+	result         *FetchResult
+	fatalErr       error
+	inflight       map[string]bool     // Message-IDs and sizes being fetched, under resultLock
+	envFlags       map[uint32][]string // Flags from envelope fetches, under resultLock
+	bodyIds        map[uint32]string   // Message-IDs of messages without one in their envelope, under resultLock
+
+	// Signalled when the server tells us about new or expunged
+	// messages; see watch.go
+	changed chan struct{}
 }
 
 func (isrc *ImapSource) Close() {
@@ -66,37 +142,82 @@ func (src *ImapSource) ImapConnect() error {
 		// connection
 	}
 
+	// Must be set before any commands are sent
+	updates := make(chan client.Update, 16)
+	c, err := src.dial(updates)
+	if err != nil {
+		return err
+	}
+	src.goWatchUpdates(c, updates)
+
+	src.client = c
+	src.folder = ""
+
+	return nil
+}
+
+// Connect and log in.  updates, if not nil, gets the client's
+// unilateral updates.
+func (src *ImapSource) dial(updates chan client.Update) (*client.Client, error) {
+	imapinfo := &src.mailbox
+
 	Port := imapinfo.Port
-	// Default to 993 if no port is specifieds
 	if Port == 0 {
-		Port = 993
+		Port = imapinfo.Security.defaultPort()
 	}
 
 	tgt := fmt.Sprintf("%s:%d", imapinfo.Hostname, Port)
 	log.Printf("Dialing %s", tgt)
-	c, err := client.DialTLS(tgt, nil)
+	c, err := src.connect(tgt)
 
 	if err != nil {
-		return fmt.Errorf("Attempting to connect to IMAP server: %v", err)
+		return nil, fmt.Errorf("Attempting to connect to IMAP server: %v", err)
 	}
 
-	log.Printf("Logging in...")
-	if err = c.Login(imapinfo.Username, imapinfo.Password); err != nil {
-		return fmt.Errorf("Logging in to IMAP server: %v", err)
+	if updates != nil {
+		c.Updates = updates
 	}
 
-	mbox := imapinfo.MailboxName
-	if mbox == "" {
-		mbox = "INBOX"
+	log.Printf("Logging in...")
+	if err = src.authenticate(c, Port); err != nil {
+		c.Terminate()
+		return nil, fmt.Errorf("Logging in to IMAP server: %v", err)
 	}
 
-	_, err = c.Select(mbox, false)
-	if err != nil {
-		return err
-	}
+	return c, nil
+}
 
-	src.client = c
+// Open up to n more connections with the selected folder selected
+// (read-only), for fetching in parallel.  Failing to isn't fatal;
+// there'll just be fewer of them.
+func (src *ImapSource) extraConnections(n int) []*client.Client {
+	uidValidity := src.client.Mailbox().UidValidity
+
+	clients := []*client.Client{}
+	for i := 0; i < n; i++ {
+		c, err := src.dial(nil)
+		if err != nil {
+			log.Printf("Opening extra connection: %v", err)
+			break
+		}
+		status, err := c.Select(src.folder, true)
+		if err != nil || status.UidValidity != uidValidity {
+			log.Printf("Selecting %s on extra connection: %v", src.folder, err)
+			c.Logout()
+			break
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
 
+// (Re-)select a folder, which also refreshes c.Mailbox()
+func (src *ImapSource) selectFolder(folder string) error {
+	if _, err := src.client.Select(folder, false); err != nil {
+		return fmt.Errorf("Selecting folder %s: %w", folder, err)
+	}
+	src.folder = folder
+	src.mboxname = src.mailboxName(folder)
 	return nil
 }
 
@@ -108,31 +229,75 @@ type fetchReq struct {
 	done     chan error
 }
 
-// Start a go routine for handling fetch requests.  Close the returned channel when done.
-func (src *ImapSource) goFetch() chan *fetchReq {
+// Start a go routine for handling fetch requests.  Call goFetchClose
+// when done.
+//
+// Once the fetch has been aborted, requests are answered with the
+// abort error without going to the server, so that everything
+// waiting on them can finish.
+//
+// Requests are shared between the clients, which must all have the
+// same folder selected.
+func (src *ImapSource) goFetch(clients []*client.Client) chan *fetchReq {
 	src.fetchreq = make(chan *fetchReq, 10)
-	go func() {
-		c := src.client
-		fetchreq := src.fetchreq
-		for req := range fetchreq {
-			log.Printf("fetcher: Making request [%p]", req)
-			req.done <- c.Fetch(req.seqset, req.items, req.messages)
-		}
-	}()
+	for _, c := range clients {
+		go func(c *client.Client, fetchreq chan *fetchReq) {
+			for req := range fetchreq {
+				if err := src.ctx.Err(); err != nil {
+					close(req.messages)
+					req.done <- err
+					continue
+				}
+				log.Printf("fetcher: Making request [%p]", req)
+				req.done <- c.UidFetch(req.seqset, req.items, req.messages)
+			}
+		}(c, src.fetchreq)
+	}
 	return src.fetchreq
 }
 
+// Wait for everything which might still send requests, then stop the
+// fetcher.
 func (src *ImapSource) goFetchClose() {
+	src.workers.Wait()
 	close(src.fetchreq)
 	src.fetchreq = nil
 }
 
-func (src *ImapSource) goFetchEnvelopeBatches(mdb *lmdb.MailDB, Messages uint32) (chan chan error, chan []string) {
-	src.bodyStatusChan = make(chan chan error, 1)
-	messageIds := make(chan []string, 1)
+// Queue a fetch request.  If the fetch has been aborted (and so the
+// queue may never drain), complete the request with the abort error
+// instead.
+func (src *ImapSource) sendFetchReq(req *fetchReq) {
+	select {
+	case src.fetchreq <- req:
+	case <-src.ctx.Done():
+		close(req.messages)
+		req.done <- src.ctx.Err()
+	}
+}
+
+// Record an error which means the fetch can't continue, and tell the
+// rest of the pipeline to stop.  Only the first one is kept.
+func (src *ImapSource) abort(err error) {
+	src.resultLock.Lock()
+	defer src.resultLock.Unlock()
+	if src.fatalErr == nil {
+		log.Printf("Aborting fetch: %v", err)
+		src.fatalErr = err
+		src.cancel()
+	}
+}
+
+func (src *ImapSource) goFetchEnvelopeBatches(mdb *lmdb.MailDB, uids []uint32) (chan chan *MessageError, chan []lmdb.MailboxEntry) {
+	bodyStatusChan := make(chan chan *MessageError, 1)
+	src.bodyStatusChan = bodyStatusChan
+	entriesChan := make(chan []lmdb.MailboxEntry, 1)
 
+	src.workers.Add(1)
 	go func() {
-		envelopeBatchChan := make(chan chan []string, 1)
+		defer src.workers.Done()
+
+		envelopeBatchChan := make(chan chan []lmdb.MailboxEntry, 1)
 
 		// The caller wants to wait until all body fetch operations have
 		// finished; but we don't know how many there are.  We can't close
@@ -140,188 +305,490 @@ func (src *ImapSource) goFetchEnvelopeBatches(mdb *lmdb.MailDB, Messages uint32)
 		// will be sent down it.  So we wait until all envelope batches
 		// have been handled.
 		go func() {
-			allMessages := []string{}
+			allEntries := []lmdb.MailboxEntry{}
 			for envelopeBatch := range envelopeBatchChan {
-				messages := <-envelopeBatch
-				allMessages = append(allMessages, messages...)
+				entries := <-envelopeBatch
+				allEntries = append(allEntries, entries...)
 			}
-			close(src.bodyStatusChan)
-			src.bodyStatusChan = nil
-			messageIds <- allMessages
-			close(messageIds)
+			close(bodyStatusChan)
+			entriesChan <- allEntries
+			close(entriesChan)
 		}()
 
-		STRIDE := uint32(50)
-		from := uint32(1)
+		// Envelopes are small, so there's no harm in asking for
+		// at least a body batch's worth at once
+		STRIDE := 50
+		if n := src.mailbox.BodyBatchSize; n > STRIDE {
+			STRIDE = n
+		}
 
-		for {
-			if from > Messages {
-				break
-			}
+		for from := 0; from < len(uids) && src.ctx.Err() == nil; from += STRIDE {
 			to := from + STRIDE
-			if to > Messages {
-				to = Messages
+			if to > len(uids) {
+				to = len(uids)
 			}
 
 			envreq := &fetchReq{mdb: mdb}
 
 			envreq.seqset = new(imap.SeqSet)
-			envreq.seqset.AddRange(from, to)
+			envreq.seqset.AddNum(uids[from:to]...)
 
-			envreq.items = []imap.FetchItem{imap.FetchEnvelope}
+			envreq.items = []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size}
 
 			envreq.messages = make(chan *imap.Message, STRIDE)
 			envreq.done = make(chan error, 1)
 
-			log.Printf("[%p] Reqesting envelopes (%d, %d)", envreq, from, to)
+			log.Printf("[%p] Reqesting envelopes for %d uids (%d-%d)", envreq, to-from, uids[from], uids[to-1])
 
-			src.fetchreq <- envreq
+			src.sendFetchReq(envreq)
 
-			envelopeBatch := make(chan []string, 1)
+			envelopeBatch := make(chan []lmdb.MailboxEntry, 1)
 
+			src.workers.Add(1)
 			go src.goProcessEnvelopeBatch(envreq, envelopeBatch)
 
 			envelopeBatchChan <- envelopeBatch
-
-			from = to + 1
 		}
 
 		// No more envelope batches will be created.
 		close(envelopeBatchChan)
 	}()
 
-	return src.bodyStatusChan, messageIds
+	return bodyStatusChan, entriesChan
 }
 
 // Go routine to process the outcome of the message
-func (src *ImapSource) goProcessEnvelopeBatch(envreq *fetchReq, envelopeBatch chan []string) {
-	messages := []string{}
+func (src *ImapSource) goProcessEnvelopeBatch(envreq *fetchReq, envelopeBatch chan []lmdb.MailboxEntry) {
+	defer src.workers.Done()
 
-	// cmsg: Message to check
-	// emsg: Message from envelope
-	// bmsg: Message from body
+	entries := []lmdb.MailboxEntry{}
+	batch := src.newBodyBatch()
+
+	// NB the messages must be read until the channel is closed even
+	// if we've given up, or the fetcher will block.
 	for cmsg := range envreq.messages {
-		messages = append(messages, cmsg.Envelope.MessageId)
-		if prs, err := envreq.mdb.IsMsgIdPresent(cmsg.Envelope.MessageId); err != nil {
-			// FIXME: Not clear what the best thing would be to do
-			// here.
-			log.Fatalf("Checking message presence in database: %v", err)
-		} else if prs {
-			//log.Printf(" Message %v present, not fetching", cmsg.Envelope.MessageId)
+		if src.ctx.Err() != nil {
 			continue
 		}
 
-		bodyStatus := make(chan error, 1)
+		// Messages without a Message-ID are recorded under one made
+		// from their content, so the body has to be fetched to know
+		// whether it's present; see fetchFolder.
+		msgid := lmdb.NormalizeMessageId(cmsg.Envelope.MessageId)
+		entries = append(entries, lmdb.MailboxEntry{Uid: cmsg.Uid, MessageId: msgid})
+		src.resultLock.Lock()
+		src.envFlags[cmsg.Uid] = cmsg.Flags
+		src.resultLock.Unlock()
+
+		// A message already present under its Message-ID is only
+		// skipped if it's the same size as the stored one or a
+		// variant; otherwise it may be a variant (see msgid.go in
+		// localmaildb).
+		if msgid != "" {
+			if prs, err := envreq.mdb.IsMessageSizePresentContext(src.ctx, msgid, int(cmsg.Size)); err != nil {
+				src.abort(fmt.Errorf("Checking message presence in database: %w", err))
+				continue
+			} else if prs {
+				//log.Printf(" Message %v present, not fetching", msgid)
+				src.resultLock.Lock()
+				src.result.Skipped++
+				src.resultLock.Unlock()
+				continue
+			}
 
-		go src.goProcessBody(envreq, cmsg, bodyStatus)
+			// Another copy (in this folder or an earlier one) may be
+			// being fetched already
+			src.resultLock.Lock()
+			key := fmt.Sprintf("%s %d", msgid, cmsg.Size)
+			dup := src.inflight[key]
+			src.inflight[key] = true
+			if dup {
+				src.result.Skipped++
+			}
+			src.resultLock.Unlock()
+			if dup {
+				continue
+			}
+		}
 
-		src.bodyStatusChan <- bodyStatus
+		batch.add(cmsg)
+		if batch.full() {
+			src.goFetchBodies(envreq.mdb, batch)
+			batch = src.newBodyBatch()
+		}
+	}
+
+	if len(batch.uids) > 0 && src.ctx.Err() == nil {
+		src.goFetchBodies(envreq.mdb, batch)
 	}
 
 	err := <-envreq.done
+	if err != nil && src.ctx.Err() == nil {
+		src.abort(fmt.Errorf("Fetching envelopes: %w", err))
+	}
+
+	envelopeBatch <- entries
+}
+
+// Work out which messages need to be fetched, and which have gone
+// away, since the last sync.
+//
+// If UIDVALIDITY has changed (or the mailbox has never been synced),
+// all UIDs we know about are meaningless, and everything needs to be
+// looked at again; though the bodies of messages already in the
+// database won't be downloaded again.
+func (src *ImapSource) syncPlan(ctx context.Context, mdb *lmdb.MailDB, status *imap.MailboxStatus) (*lmdb.MailboxUpdate, []uint32, error) {
+	mboxname := src.mboxname
+
+	state, err := mdb.GetSyncStateContext(ctx, mboxname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Getting sync state for mailbox %s: %w", mboxname, err)
+	}
+
+	update := &lmdb.MailboxUpdate{State: state}
+
+	strategy := src.mailbox.UpdateStrategy
+
+	var known []uint32
+	if state.UidValidity != status.UidValidity {
+		// NB that this has to look at the whole mailbox even for
+		// StrategyRecent, as none of the old membership is valid
+		// anymore.
+		log.Printf("UIDVALIDITY for %s changed (%d -> %d), doing a full resync",
+			mboxname, state.UidValidity, status.UidValidity)
+		update.Reset = true
+		update.State = lmdb.MailboxSyncState{UidValidity: status.UidValidity}
+		strategy = StrategyAll
+	} else {
+		known, err = mdb.GetMailboxUidsContext(ctx, mboxname)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Getting known uids for mailbox %s: %w", mboxname, err)
+		}
+
+		// If nothing has arrived, and nothing has been expunged,
+		// there's no need to even ask for the uid list.
+		if strategy != StrategyRecent && status.UidNext != 0 &&
+			status.UidNext <= state.LastUid+1 &&
+			uint32(len(known)) == status.Messages {
+			return update, nil, nil
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	if strategy == StrategyRecent {
+		window := src.mailbox.UpdateWindow
+		if window == 0 {
+			window = DefaultUpdateWindow
+		}
+		criteria.Since = time.Now().Add(-window)
+	}
+
+	current, err := src.client.UidSearch(criteria)
 	if err != nil {
-		log.Printf("Envelope fetch error: %v", err)
+		return nil, nil, fmt.Errorf("Getting uid list for mailbox %s: %w", mboxname, err)
+	}
+
+	// Only consider removing messages within the window, i.e., those
+	// at least as new as the oldest message in it.  UIDs are
+	// assigned in order of arrival, so this is a good approximation.
+	if strategy == StrategyRecent {
+		if len(current) == 0 {
+			known = nil
+		} else {
+			oldest := current[0]
+			for _, uid := range current {
+				if uid < oldest {
+					oldest = uid
+				}
+			}
+			windowed := []uint32{}
+			for _, uid := range known {
+				if uid >= oldest {
+					windowed = append(windowed, uid)
+				}
+			}
+			known = windowed
+		}
+	}
+
+	knownSet := map[uint32]bool{}
+	for _, uid := range known {
+		knownSet[uid] = true
+	}
+
+	// Anything we don't have already needs fetching; this includes
+	// messages which failed last time, as well as new ones.
+	fetch := []uint32{}
+	for _, uid := range current {
+		if !knownSet[uid] {
+			fetch = append(fetch, uid)
+		}
+		delete(knownSet, uid)
+		if uid > update.State.LastUid {
+			update.State.LastUid = uid
+		}
+	}
+
+	for uid := range knownSet {
+		update.Removed = append(update.Removed, uid)
 	}
 
-	envelopeBatch <- messages
+	return update, fetch, nil
 }
 
-func (src *ImapSource) goProcessBody(envreq *fetchReq, emsg *imap.Message, bodyStatus chan error) {
-	// Request a single message
-	bodyreq := new(fetchReq)
-	bodyreq.seqset = new(imap.SeqSet)
-	bodyreq.seqset.AddNum(emsg.SeqNum)
-	bodyreq.messages = make(chan *imap.Message, 1)
-	section := &imap.BodySectionName{}
-	section.Peek = true
-	bodyreq.items = []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope}
-	bodyreq.done = make(chan error, 1)
+// Fetch mail from ImapSource and put it into mdb, one folder after
+// another.  The mailbox for each folder is created if need be.
+//
+// Messages which can't be fetched or added are recorded in the
+// result and skipped; they'll be tried again next time.  Errors which
+// mean the fetch can't continue (e.g., the connection or the database
+// failing) stop it, but membership of the messages handled so far is
+// still recorded.  In either case the returned error is a
+// *FetchError.
+func (src *ImapSource) Fetch(mdb *lmdb.MailDB) (*FetchResult, error) {
+	return src.FetchContext(context.Background(), mdb)
+}
 
-	log.Printf("[%p] Fetching message %s (%s)", bodyreq,
-		emsg.Envelope.MessageId, emsg.Envelope.Subject)
+// FetchContext is like Fetch, but stops as soon as possible if ctx
+// is cancelled, with ctx.Err() as the fatal error.  As IMAP commands
+// can't be cancelled, this means dropping the connection; the next
+// Fetch will reconnect.
+func (src *ImapSource) FetchContext(ctx context.Context, mdb *lmdb.MailDB) (*FetchResult, error) {
+	result := &FetchResult{}
+	start := time.Now()
 
-	src.fetchreq <- bodyreq
+	if err := ctx.Err(); err != nil {
+		return result, &FetchError{Fatal: err}
+	}
 
-	// Wait for the response
-	bmsg := <-bodyreq.messages
+	// Connect or check the connection
+	err := src.ImapConnect()
+	if err != nil {
+		return result, &FetchError{Fatal: err}
+	}
 
-	log.Printf("Processing body %v", emsg.Envelope.MessageId)
+	done := make(chan struct{})
+	defer close(done)
+	terminateOnCancel(ctx, src.client, done)
 
-	// Process
-	if bmsg.SeqNum != emsg.SeqNum {
-		log.Printf("Unexpected sequence number: wanted %d, got %d!",
-			emsg.SeqNum, bmsg.SeqNum)
-		bodyStatus <- fmt.Errorf("Unexpected sequence number")
-		return
+	folders, err := src.listFolders()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return result, &FetchError{Fatal: err}
 	}
-	if bmsg.Envelope.MessageId != emsg.Envelope.MessageId {
-		log.Printf("Unexpected messageid: wanted %s, got %s!",
-			emsg.Envelope.MessageId, bmsg.Envelope.MessageId)
-		bodyStatus <- fmt.Errorf("Unexpected message id")
-		return
+	src.folders = folders
+
+	src.result = result
+	src.fatalErr = nil
+	backoff := src.newBackoff()
+
+	for _, folder := range folders {
+		if err := mdb.CreateMailboxContext(ctx, src.mailboxName(folder)); err != nil {
+			src.fatalErr = fmt.Errorf("Creating mailbox %s: %w", src.mailboxName(folder), err)
+			break
+		}
+		if src.fetchFolderRetrying(ctx, mdb, folder, backoff, done); src.fatalErr != nil {
+			break
+		}
+	}
+
+	if src.fatalErr == nil && ctx.Err() != nil {
+		src.fatalErr = ctx.Err()
+	}
+
+	if len(folders) > 1 {
+		log.Printf("Done with %d folders: %d fetched, %d skipped, %d failed, %d removed",
+			len(folders), result.Fetched, result.Skipped, len(result.Failed), result.Removed)
 	}
-	var body imap.Literal
-	for _, body = range bmsg.Body {
+	result.Elapsed = time.Since(start)
+	if result.Fetched > 0 {
+		log.Printf("Fetched %d messages (%d bytes) in %v: %s",
+			result.Fetched, result.Bytes, result.Elapsed.Round(time.Millisecond), result.Throughput())
 	}
-	if body == nil {
-		bodyStatus <- fmt.Errorf("No literals in message body")
+
+	if src.fatalErr != nil || len(result.Failed) > 0 {
+		return result, &FetchError{Fatal: src.fatalErr, Failed: result.Failed}
+	}
+
+	return result, nil
+}
+
+// Sync a folder, reconnecting and starting again if the connection
+// drops.  What was done before it dropped has been recorded, so only
+// what's left is fetched the next time round.
+func (src *ImapSource) fetchFolderRetrying(ctx context.Context, mdb *lmdb.MailDB, folder string, b *backoff, done chan struct{}) {
+	for {
+		src.fetchFolder(ctx, mdb, folder)
+		if src.fatalErr == nil {
+			b.reset()
+			return
+		}
+		if ctx.Err() != nil || !src.connectionLost() {
+			return
+		}
+
+		log.Printf("Lost connection syncing %s: %v", folder, src.fatalErr)
+		if err := src.reconnect(ctx, b, done); err != nil {
+			src.fatalErr = fmt.Errorf("%w (%v)", src.fatalErr, err)
+			return
+		}
+		src.fatalErr = nil
+	}
+}
+
+// Sync one folder, adding what happened to src.result.  Errors which
+// mean the fetch can't continue are left in src.fatalErr.
+func (src *ImapSource) fetchFolder(ctx context.Context, mdb *lmdb.MailDB, folder string) {
+	result := src.result
+
+	modseq, err := src.highestModSeq(folder)
+	if err != nil {
+		src.fatalErr = err
 		return
 	}
-	if message, err := io.ReadAll(body); err != nil {
-		bodyStatus <- fmt.Errorf("Error reading body: %w", err)
+
+	if err := src.selectFolder(folder); err != nil {
+		src.fatalErr = err
 		return
-	} else if err := envreq.mdb.AddMessage(message); err != nil {
-		bodyStatus <- fmt.Errorf("Adding message to database: %w", err)
+	}
+
+	if err := src.pushJournal(ctx, mdb, modseq); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		src.fatalErr = err
 		return
 	}
 
-	bodyStatus <- nil
-}
+	// Get current status
+	status := src.client.Mailbox()
 
-// Fetch mail from ImapSource and put it into mdb
-func (src *ImapSource) Fetch(mdb *lmdb.MailDB) error {
-	// Connect or check the connection
-	err := src.ImapConnect()
+	update, uids, err := src.syncPlan(ctx, mdb, status)
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		src.fatalErr = err
+		return
 	}
 
-	c := src.client
+	log.Printf("%s: %d new messages, %d removed", folder, len(uids), len(update.Removed))
+
+	src.inflight = map[string]bool{}
+	src.envFlags = map[uint32][]string{}
+	src.bodyIds = map[uint32]string{}
+	src.ctx, src.cancel = context.WithCancel(ctx)
+	defer src.cancel()
+
+	if len(uids) > 0 {
+		// NOTE: imap-client documentation says it's not safe for concurrent access.
+		// Care must therefore be taken to make sure all fetch requests have completed
+		// before using the client again.
+		//
+		// Also note: case must be taken to ensure that this DOES NOT
+		// BLOCK if there are fetches further down the pipeline; otherwise
+		// things may get backed up and deadlock.
+		clients := []*client.Client{src.client}
+		if n := src.mailbox.Connections; update.Reset && n > 1 {
+			extra := src.extraConnections(n - 1)
+			log.Printf("Using %d connections for the initial sync", len(extra)+1)
+			defer func() {
+				for _, c := range extra {
+					c.Logout()
+				}
+			}()
+			go func() {
+				// As for src.client in FetchContext
+				<-src.ctx.Done()
+				if ctx.Err() != nil {
+					for _, c := range extra {
+						c.Terminate()
+					}
+				}
+			}()
+			clients = append(clients, extra...)
+		}
 
-	// Get current status
-	status := c.Mailbox()
-
-	// NOTE: imap-client documentation says it's not safe for concurrent access.
-	// Care must therefore be taken to make sure all fetch requests have completed
-	// before using the client again.
-	//
-	// Also note: case must be taken to ensure that this DOES NOT
-	// BLOCK if there are fetches further down the pipeline; otherwise
-	// things may get backed up and deadlock.
-	src.goFetch()
-	defer src.goFetchClose()
-
-	// Fetch envelopes in batches of 50, closing once they're all gone.
-	bodyStatusChan, messageIdChan := src.goFetchEnvelopeBatches(mdb, status.Messages)
-
-	log.Printf("Waiting for body processing statuses")
-	for bodyStatus := range bodyStatusChan {
-		log.Printf("Waiting for body status %v to complete", bodyStatus)
-		err := <-bodyStatus
-		if err != nil {
-			log.Printf("Error processing body: %v", err)
+		src.goFetch(clients)
+
+		// Fetch envelopes in batches of 50, closing once they're all gone.
+		bodyStatusChan, entriesChan := src.goFetchEnvelopeBatches(mdb, uids)
+
+		log.Printf("Waiting for body processing statuses")
+		for bodyStatus := range bodyStatusChan {
+			for merr := range bodyStatus {
+				switch {
+				case merr == nil:
+					result.Fetched++
+				case errors.Is(merr, lmdb.ErrMsgidPresent):
+					// Another copy of the message got there first
+					result.Skipped++
+				case src.ctx.Err() != nil:
+					// Interrupted; it'll be tried again next time
+				default:
+					log.Printf("Error processing body: %v", merr)
+					result.Failed = append(result.Failed, merr)
+				}
+			}
 		}
+
+		update.Added = src.fillMessageIds(<-entriesChan)
+
+		src.goFetchClose()
 	}
 
-	messageIds := <-messageIdChan
+	if src.fatalErr == nil && ctx.Err() != nil {
+		src.fatalErr = ctx.Err()
+	}
 
-	log.Printf("Inbox contains %d messages", len(messageIds))
+	if src.fatalErr == nil {
+		if err := src.syncFlags(update, modseq); err != nil {
+			src.fatalErr = err
+		}
+	}
 
-	if err := mdb.UpdateMailbox(src.mailbox.MailboxName, messageIds); err != nil {
-		return err
+	// Flags fetched since the envelopes are more up to date
+	if update.Flags == nil {
+		update.Flags = map[uint32][]string{}
+	}
+	for uid, flags := range src.envFlags {
+		if _, ok := update.Flags[uid]; !ok {
+			update.Flags[uid] = flags
+		}
 	}
 
-	log.Printf("Done!")
+	// Whatever happened (including ctx being cancelled), record what
+	// we know so far
+	if err := mdb.ApplyMailboxUpdate(src.mboxname, update); err != nil {
+		if src.fatalErr == nil {
+			src.fatalErr = err
+		}
+	} else {
+		result.Removed += len(update.Removed)
+	}
 
-	return nil
+	log.Printf("%s done: %d fetched, %d skipped, %d failed, %d removed (all folders so far)",
+		folder, result.Fetched, result.Skipped, len(result.Failed), result.Removed)
+}
+
+// Fill in the Message-IDs of entries for messages without one in
+// their envelope from their bodies.  Those whose bodies weren't
+// fetched are dropped, so that they're tried again next time.
+func (src *ImapSource) fillMessageIds(entries []lmdb.MailboxEntry) []lmdb.MailboxEntry {
+	src.resultLock.Lock()
+	defer src.resultLock.Unlock()
+
+	out := entries[:0]
+	for _, entry := range entries {
+		if entry.MessageId == "" {
+			entry.MessageId = src.bodyIds[entry.Uid]
+			if entry.MessageId == "" {
+				continue
+			}
+		}
+		out = append(out, entry)
+	}
+	return out
 }
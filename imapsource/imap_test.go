@@ -0,0 +1,371 @@
+package imapsource
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestInitialSync(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml", imap.SeenFlag)
+	two := ts.add("INBOX", "two.eml")
+	three := ts.add("INBOX", "three.eml", imap.FlaggedFlag, "$Label1")
+
+	src := setupSource(t, ts.info())
+	result := fetch(t, src, mdb)
+	checkResult(t, "initial", result, 3, 0, 0)
+	if result.Bytes == 0 {
+		t.Errorf("ERROR: no bytes counted")
+	}
+
+	checkMailbox(t, mdb, "INBOX", []uint32{one, two, three},
+		"<one@example.com>", "<two@example.com>", "<three@example.com>")
+
+	state, err := mdb.GetSyncState("INBOX")
+	if err != nil {
+		t.Fatalf("Getting sync state: %v", err)
+	}
+	if state.UidValidity == 0 || state.LastUid != three {
+		t.Errorf("ERROR: got sync state %+v, wanted last uid %d", state, three)
+	}
+
+	// The reply should be threaded under the patch
+	tree, err := mdb.GetTreeFromMessageId("<one@example.com>")
+	if err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if err := mdb.GetTree(tree); err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if len(tree.Replies) != 1 || tree.Replies[0].Envelope.MessageId != "<two@example.com>" {
+		t.Errorf("ERROR: reply not threaded under <one@example.com>")
+	}
+
+	for msgid, want := range map[string]string{
+		"<one@example.com>":   `\Seen`,
+		"<two@example.com>":   ``,
+		"<three@example.com>": `$label1 \Flagged`,
+	} {
+		flags, err := mdb.GetFlags("INBOX", msgid)
+		if err != nil {
+			t.Fatalf("Getting flags: %v", err)
+		}
+		if got := strings.Join(flags, " "); got != want {
+			t.Errorf("ERROR: %s: got flags %q, wanted %q", msgid, got, want)
+		}
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	src := setupSource(t, ts.info())
+	checkResult(t, "initial", fetch(t, src, mdb), 1, 0, 0)
+
+	// Nothing new
+	checkResult(t, "unchanged", fetch(t, src, mdb), 0, 0, 0)
+
+	// Only the new messages should be looked at, over the same
+	// connection
+	two := ts.add("INBOX", "two.eml")
+	three := ts.add("INBOX", "three.eml")
+	checkResult(t, "new messages", fetch(t, src, mdb), 2, 0, 0)
+	checkMailbox(t, mdb, "INBOX", []uint32{one, two, three},
+		"<one@example.com>", "<two@example.com>", "<three@example.com>")
+
+	// A new source (e.g., the next run of mailfetch) carries on
+	// from the recorded state
+	four := ts.add("INBOX", "one.eml")
+	src = setupSource(t, ts.info())
+	checkResult(t, "new source", fetch(t, src, mdb), 0, 1, 0)
+	checkMailbox(t, mdb, "INBOX", []uint32{one, two, three, four},
+		"<one@example.com>", "<two@example.com>", "<three@example.com>")
+}
+
+func TestDuplicateMessageIds(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	// The same message twice in one folder, and again in another
+	inbox := []uint32{
+		ts.add("INBOX", "one.eml"),
+		ts.add("INBOX", "one.eml"),
+		ts.add("INBOX", "two.eml"),
+	}
+	lists := []uint32{
+		ts.add("Lists", "one.eml"),
+		ts.add("Lists", "three.eml"),
+	}
+
+	info := ts.info()
+	info.Folders = []string{"*"}
+	src := setupSource(t, info)
+
+	// Each body is only downloaded once
+	checkResult(t, "initial", fetch(t, src, mdb), 3, 2, 0)
+
+	checkMailbox(t, mdb, "INBOX", inbox, "<one@example.com>", "<two@example.com>")
+	checkMailbox(t, mdb, "Lists", lists, "<one@example.com>", "<three@example.com>")
+
+	// Dropping one copy leaves the message in the folder
+	ts.expunge("INBOX", inbox[0])
+	checkResult(t, "expunge one copy", fetch(t, src, mdb), 0, 0, 1)
+	checkMailbox(t, mdb, "INBOX", inbox[1:], "<one@example.com>", "<two@example.com>")
+}
+
+func TestVariants(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	src := setupSource(t, ts.info())
+	checkResult(t, "initial", fetch(t, src, mdb), 1, 0, 0)
+
+	// A different message with the same Message-ID (and a different
+	// size) is fetched and kept as a variant; a copy of it is then
+	// skipped
+	raw, err := os.ReadFile(path.Join("testdata", "one.eml"))
+	if err != nil {
+		t.Fatalf("Reading test message: %v", err)
+	}
+	raw = append(raw, []byte("v2: Frobnicate harder.\n")...)
+	variant := ts.addRaw("INBOX", raw)
+	checkResult(t, "variant", fetch(t, src, mdb), 1, 0, 0)
+	again := ts.addRaw("INBOX", raw)
+	checkResult(t, "variant again", fetch(t, src, mdb), 0, 1, 0)
+
+	checkMailbox(t, mdb, "INBOX", []uint32{one, variant, again}, "<one@example.com>")
+	variants, err := mdb.GetMessageVariants("<one@example.com>")
+	if err != nil {
+		t.Fatalf("Getting variants: %v", err)
+	}
+	if len(variants) != 1 || string(variants[0]) != string(raw) {
+		t.Errorf("ERROR: Got %d variants, wanted the one added", len(variants))
+	}
+}
+
+func TestNoMessageId(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	uids := []uint32{
+		ts.add("INBOX", "no-msgid-a.eml"),
+		ts.add("INBOX", "one.eml"),
+		ts.add("INBOX", "no-msgid-b.eml"),
+		ts.add("INBOX", "two.eml"),
+	}
+
+	src := setupSource(t, ts.info())
+	result, err := src.Fetch(mdb)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if n := result.Fetched + result.Skipped; n != len(uids) {
+		t.Errorf("ERROR: %d messages fetched or skipped, wanted %d", n, len(uids))
+	}
+
+	// They mustn't stop anything else being fetched, or be
+	// fetched again every time
+	uidsGot, err := mdb.GetMailboxUids("INBOX")
+	if err != nil {
+		t.Fatalf("Getting uids: %v", err)
+	}
+	if !equalUids(uidsGot, uids) {
+		t.Errorf("ERROR: got uids %v, wanted %v", uidsGot, uids)
+	}
+	for _, msgid := range []string{"<one@example.com>", "<two@example.com>"} {
+		if prs, err := mdb.IsMsgIdPresent(msgid); err != nil || !prs {
+			t.Errorf("ERROR: %s not present (%v)", msgid, err)
+		}
+	}
+	checkResult(t, "again", fetch(t, src, mdb), 0, 0, 0)
+}
+
+func TestSyntheticMessageIds(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	uids := []uint32{
+		ts.add("INBOX", "no-msgid-a.eml"),
+		ts.add("INBOX", "one.eml"),
+		ts.add("INBOX", "no-msgid-b.eml"),
+		ts.add("INBOX", "two.eml"),
+		ts.add("INBOX", "no-msgid-a.eml"),
+	}
+	a, b := ts.messageId("no-msgid-a.eml"), ts.messageId("no-msgid-b.eml")
+	if a == b {
+		t.Fatalf("Different messages without Message-IDs both recorded as %s", a)
+	}
+
+	// Each gets its own synthetic Message-ID; the body of the copy
+	// has to be fetched to find out it's a copy
+	src := setupSource(t, ts.info())
+	checkResult(t, "initial", fetch(t, src, mdb), 4, 1, 0)
+	checkMailbox(t, mdb, "INBOX", uids, a, "<one@example.com>", b, "<two@example.com>")
+
+	// They aren't fetched again every time
+	checkResult(t, "again", fetch(t, src, mdb), 0, 0, 0)
+}
+
+func TestExpunge(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	two := ts.add("INBOX", "two.eml")
+	three := ts.add("INBOX", "three.eml")
+
+	src := setupSource(t, ts.info())
+	checkResult(t, "initial", fetch(t, src, mdb), 3, 0, 0)
+
+	ts.expunge("INBOX", one)
+	ts.expunge("INBOX", two)
+	checkResult(t, "expunge", fetch(t, src, mdb), 0, 0, 2)
+	checkMailbox(t, mdb, "INBOX", []uint32{three}, "<three@example.com>")
+
+	// The messages themselves stay in the database
+	for _, msgid := range []string{"<one@example.com>", "<two@example.com>"} {
+		if prs, err := mdb.IsMsgIdPresent(msgid); err != nil || !prs {
+			t.Errorf("ERROR: %s not present after expunge (%v)", msgid, err)
+		}
+	}
+
+	// ...and aren't downloaded again if they come back
+	four := ts.add("INBOX", "one.eml")
+	checkResult(t, "re-added", fetch(t, src, mdb), 0, 1, 0)
+	checkMailbox(t, mdb, "INBOX", []uint32{three, four}, "<one@example.com>", "<three@example.com>")
+}
+
+// A message big enough for a few of them to fill a batch
+func bigMessage(i int) []byte {
+	return []byte(fmt.Sprintf("From: list@example.com\r\n"+
+		"Subject: Message %d\r\n"+
+		"Date: Mon, 01 Jan 2024 10:00:00 +0000\r\n"+
+		"Message-ID: <big%d@example.com>\r\n\r\n%s\r\n",
+		i, i, strings.Repeat("All work and no play makes Jack a dull boy.\r\n", 50)))
+}
+
+func TestBodyBatches(t *testing.T) {
+	for _, connections := range []int{1, 3} {
+		t.Run(fmt.Sprintf("connections=%d", connections), func(t *testing.T) {
+			ts := newTestServer(t)
+			mdb := openTestDB(t)
+
+			const n = 60
+			uids := []uint32{}
+			var size int64
+			for i := 0; i < n; i++ {
+				raw := bigMessage(i)
+				uids = append(uids, ts.addRaw("INBOX", raw))
+				size += int64(len(raw))
+			}
+
+			info := ts.info()
+			info.BodyBatchSize = 7
+			info.BodyBatchBytes = 10000
+			info.Connections = connections
+			src := setupSource(t, info)
+
+			result := fetch(t, src, mdb)
+			checkResult(t, "initial", result, n, 0, 0)
+			if result.Bytes != size {
+				t.Errorf("ERROR: got %d bytes, wanted %d", result.Bytes, size)
+			}
+
+			got, err := mdb.GetMailboxUids("INBOX")
+			if err != nil {
+				t.Fatalf("Getting uids: %v", err)
+			}
+			if !equalUids(got, uids) {
+				t.Errorf("ERROR: got uids %v, wanted %v", got, uids)
+			}
+		})
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	const n = 40
+
+	setup := func(t *testing.T) (*testServer, []uint32) {
+		ts := newTestServer(t)
+		uids := []uint32{}
+		for i := 0; i < n; i++ {
+			uids = append(uids, ts.addRaw("INBOX", bigMessage(i)))
+		}
+		return ts, uids
+	}
+
+	t.Run("reconnect", func(t *testing.T) {
+		ts, uids := setup(t)
+		mdb := openTestDB(t)
+
+		// Drop the connection twice, part way through the bodies
+		proxy, port := ts.dropProxy(20000, 20000)
+		info := ts.info()
+		info.Port = port
+		info.BodyBatchSize = 5
+		src := setupSource(t, info)
+
+		result := fetch(t, src, mdb)
+		if result.Fetched != n {
+			t.Errorf("ERROR: got %d fetched, wanted %d", result.Fetched, n)
+		}
+		if c := proxy.count(); c != 3 {
+			t.Errorf("ERROR: %d connections made, wanted 3", c)
+		}
+		got, err := mdb.GetMailboxUids("INBOX")
+		if err != nil {
+			t.Fatalf("Getting uids: %v", err)
+		}
+		if !equalUids(got, uids) {
+			t.Errorf("ERROR: got uids %v, wanted %v", got, uids)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		ts, uids := setup(t)
+		mdb := openTestDB(t)
+
+		// Enough for the envelopes and a few batches of bodies
+		_, port := ts.dropProxy(50000)
+		info := ts.info()
+		info.Port = port
+		info.BodyBatchSize = 5
+		info.Reconnects = -1
+		src := setupSource(t, info)
+
+		first, err := src.Fetch(mdb)
+		var ferr *FetchError
+		if !errors.As(err, &ferr) || ferr.Fatal == nil {
+			t.Fatalf("First fetch: got %v, wanted a fatal FetchError", err)
+		}
+		if first.Fetched == 0 || first.Fetched >= n {
+			t.Errorf("ERROR: first fetch got %d messages, wanted some but not all", first.Fetched)
+		}
+
+		// What was fetched is kept; the next Fetch reconnects and
+		// just gets the rest
+		second := fetch(t, src, mdb)
+		if first.Fetched+second.Fetched != n || second.Skipped != 0 {
+			t.Errorf("ERROR: fetched %d then %d (%d skipped), wanted %d in all",
+				first.Fetched, second.Fetched, second.Skipped, n)
+		}
+		got, err := mdb.GetMailboxUids("INBOX")
+		if err != nil {
+			t.Fatalf("Getting uids: %v", err)
+		}
+		if !equalUids(got, uids) {
+			t.Errorf("ERROR: got uids %v, wanted %v", got, uids)
+		}
+	})
+}
@@ -0,0 +1,270 @@
+package imapsource
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Changes made locally (see lmdb.MailDB.ChangeFlags and MoveMessage)
+// are made on the server at the start of the next Fetch of the
+// folder, before its flags are fetched.
+//
+// Flag changes are made one flag at a time, so they only conflict
+// with changes to the same flag on the server.  With CONDSTORE, the
+// STORE is made conditional on the message being unchanged since the
+// local change was made; if it's been changed, its current flags are
+// fetched, and the local change is dropped if the server has made it
+// already.  Otherwise, the server hasn't touched that flag (or has
+// changed it and changed it back), and the local change is made.
+//
+// Changes the server refuses (e.g., because the folder is read-only)
+// are dropped with a warning; the local flags may then differ from
+// the server's until the message next changes there.
+
+// A NO or BAD response, as opposed to the connection failing
+type refusedError struct {
+	status *imap.StatusResp
+}
+
+func (e *refusedError) Error() string {
+	return fmt.Sprintf("Server said %s: %s", e.status.Type, e.status.Info)
+}
+
+func (src *ImapSource) execute(cmd imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	status, err := src.client.Execute(cmd, h)
+	if err != nil {
+		return nil, err
+	}
+	if status.Err() != nil {
+		return nil, &refusedError{status}
+	}
+	return status, nil
+}
+
+// UID STORE, with the UNCHANGEDSINCE modifier if modseq is non-zero
+type storeUnchangedSince struct {
+	commands.Store
+	modseq uint64
+}
+
+func (cmd *storeUnchangedSince) Command() *imap.Command {
+	c := cmd.Store.Command()
+	if cmd.modseq > 0 {
+		modifier := []interface{}{
+			imap.RawString("UNCHANGEDSINCE"),
+			imap.RawString(strconv.FormatUint(cmd.modseq, 10)),
+		}
+		args := []interface{}{c.Arguments[0], modifier}
+		c.Arguments = append(args, c.Arguments[1:]...)
+	}
+	return c
+}
+
+// Add or remove a flag.  Returns true if the message has changed
+// since modseq (and so nothing was done).
+func (src *ImapSource) storeFlag(uid uint32, op imap.FlagsOp, flag string, modseq uint64) (bool, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	cmd := &commands.Uid{Cmd: &storeUnchangedSince{
+		Store: commands.Store{
+			SeqSet: seqset,
+			Item:   imap.FormatFlagsOp(op, true),
+			Value:  []interface{}{imap.RawString(flag)},
+		},
+		modseq: modseq,
+	}}
+
+	status, err := src.execute(cmd, nil)
+	if err != nil {
+		return false, err
+	}
+	return status.Code == "MODIFIED", nil
+}
+
+// The current flags of a message, and whether it still exists
+func (src *ImapSource) messageFlags(uid uint32) ([]string, bool, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	cmd := &commands.Uid{Cmd: &commands.Fetch{
+		SeqSet: seqset,
+		Items:  []imap.FetchItem{imap.FetchUid, imap.FetchFlags},
+	}}
+
+	messages := make(chan *imap.Message, 1)
+	var flags []string
+	found := false
+	done := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		_, err := src.execute(cmd, &responses.Fetch{Messages: messages, SeqSet: seqset, Uid: true})
+		done <- err
+	}()
+	for msg := range messages {
+		flags, found = msg.Flags, true
+	}
+	return flags, found, <-done
+}
+
+func (src *ImapSource) pushFlag(e *lmdb.JournalEntry, modseq uint64) error {
+	op, want := imap.FlagsOp(imap.AddFlags), true
+	if e.Op == lmdb.JournalRemoveFlag {
+		op, want = imap.RemoveFlags, false
+	}
+
+	// Without CONDSTORE, there's no telling what's changed
+	since := e.ModSeq
+	if modseq == 0 {
+		since = 0
+	}
+
+	modified, err := src.storeFlag(e.Uid, op, e.Flag, since)
+	if err != nil || !modified {
+		return err
+	}
+
+	flags, found, err := src.messageFlags(e.Uid)
+	if err != nil || !found {
+		return err
+	}
+	has := false
+	for _, f := range flags {
+		if f == imap.CanonicalFlag(e.Flag) {
+			has = true
+		}
+	}
+	if has == want {
+		log.Printf("%s: %s changed on the server too, leaving it", src.folder, e.MessageId)
+		return nil
+	}
+
+	_, err = src.storeFlag(e.Uid, op, e.Flag, 0)
+	return err
+}
+
+// UID MOVE if the server supports it; otherwise COPY, and then
+// delete and expunge the original.  Without UIDPLUS (for UID
+// EXPUNGE), that expunges anything else marked deleted too.  Some
+// servers (e.g., go-imap's, with some backends) advertise MOVE but
+// refuse it, so that falls back to COPY too.
+func (src *ImapSource) pushMove(uid uint32, dest string) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	if ok, err := src.client.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		_, err := src.execute(&commands.Uid{Cmd: &commands.Move{SeqSet: seqset, Mailbox: dest}}, nil)
+		if _, refused := err.(*refusedError); !refused {
+			return err
+		}
+		log.Printf("%s: MOVE refused (%v), copying instead", src.folder, err)
+	}
+
+	_, err := src.execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: seqset, Mailbox: dest}}, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := src.storeFlag(uid, imap.AddFlags, imap.DeletedFlag, 0); err != nil {
+		return err
+	}
+
+	var expunge imap.Commander = &commands.Expunge{}
+	if ok, err := src.client.Support("UIDPLUS"); err != nil {
+		return err
+	} else if ok {
+		expunge = &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), seqset}}
+	}
+	_, err = src.execute(expunge, nil)
+	return err
+}
+
+// The folder of this account a mailbox belongs to
+func (src *ImapSource) folderFor(mboxname string) (string, bool) {
+	for _, folder := range src.folders {
+		if src.mailboxName(folder) == mboxname {
+			return folder, true
+		}
+	}
+	return "", false
+}
+
+// Make the changes in the journal for the selected folder.  modseq
+// is its HIGHESTMODSEQ, or 0 if the server doesn't support CONDSTORE.
+func (src *ImapSource) pushJournal(ctx context.Context, mdb *lmdb.MailDB, modseq uint64) error {
+	entries, err := mdb.GetJournalContext(ctx, src.mboxname)
+	if err != nil {
+		return fmt.Errorf("Getting journal for mailbox %s: %w", src.mboxname, err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	uidValidity := src.client.Mailbox().UidValidity
+
+	log.Printf("%s: making %d local changes", src.folder, len(entries))
+
+	done := []int64{}
+	defer func() {
+		if len(done) == 0 {
+			return
+		}
+		// Use a fresh context, so that changes made before being
+		// cancelled aren't made again
+		if err := mdb.DeleteJournalEntries(done); err != nil {
+			log.Printf("Deleting journal entries: %v", err)
+		}
+	}()
+
+	for i := range entries {
+		e := &entries[i]
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if e.UidValidity != uidValidity {
+			log.Printf("%s: UIDVALIDITY changed, dropping %s of %s", src.folder, e.Op, e.MessageId)
+			done = append(done, e.Id)
+			continue
+		}
+		if e.Uid == 0 {
+			// Not synced yet; try again next time
+			continue
+		}
+
+		var err error
+		switch e.Op {
+		case lmdb.JournalAddFlag, lmdb.JournalRemoveFlag:
+			err = src.pushFlag(e, modseq)
+		case lmdb.JournalMove:
+			dest, ok := src.folderFor(e.Dest)
+			if !ok {
+				log.Printf("%s: mailbox %s isn't a folder of this account, can't move %s there",
+					src.folder, e.Dest, e.MessageId)
+				break
+			}
+			err = src.pushMove(e.Uid, dest)
+		default:
+			log.Printf("%s: unknown journal op %s, ignoring", src.folder, e.Op)
+		}
+
+		if _, ok := err.(*refusedError); ok {
+			log.Printf("%s: couldn't make %s of %s: %v", src.folder, e.Op, e.MessageId, err)
+		} else if err != nil {
+			return fmt.Errorf("Making %s of %s: %w", e.Op, e.MessageId, err)
+		}
+		done = append(done, e.Id)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package imapsource
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// The server's flags for a message, sorted
+func (ts *testServer) flags(folder string, uid uint32) string {
+	ts.t.Helper()
+	msg := ts.message(folder, uid)
+	if msg == nil {
+		ts.t.Fatalf("No message with uid %d in %s", uid, folder)
+	}
+	flags := append([]string{}, msg.Flags...)
+	sort.Strings(flags)
+	return strings.Join(flags, " ")
+}
+
+func TestSyncFlags(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	ts.add("INBOX", "two.eml", imap.SeenFlag)
+
+	src := setupSource(t, ts.info())
+	fetch(t, src, mdb)
+
+	checkFlags := func(what, msgid, want string) {
+		t.Helper()
+		flags, err := mdb.GetFlags("INBOX", msgid)
+		if err != nil {
+			t.Fatalf("Getting flags: %v", err)
+		}
+		if got := strings.Join(flags, " "); got != want {
+			t.Errorf("ERROR: %s: %s: got flags %q, wanted %q", what, msgid, got, want)
+		}
+	}
+	checkFlags("initial", "<one@example.com>", "")
+	checkFlags("initial", "<two@example.com>", `\Seen`)
+
+	// Changes made by another client are picked up
+	ts.message("INBOX", one).Flags = []string{imap.SeenFlag, imap.AnsweredFlag}
+	fetch(t, src, mdb)
+	checkFlags("changed on server", "<one@example.com>", `\Answered \Seen`)
+
+	unread, err := mdb.GetMessagesWithoutFlag("INBOX", imap.SeenFlag)
+	if err != nil {
+		t.Fatalf("Getting unread messages: %v", err)
+	}
+	if len(unread) != 0 {
+		t.Errorf("ERROR: got unread messages %v, wanted none", unread)
+	}
+}
+
+func TestPushJournal(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	two := ts.add("INBOX", "two.eml", imap.SeenFlag)
+
+	src := setupSource(t, ts.info())
+	fetch(t, src, mdb)
+
+	// Flag changes, including one which cancels itself out
+	if err := mdb.ChangeFlags("INBOX", "<one@example.com>", []string{imap.SeenFlag, "$Todo"}, nil); err != nil {
+		t.Fatalf("Changing flags: %v", err)
+	}
+	if err := mdb.ChangeFlags("INBOX", "<two@example.com>", nil, []string{imap.SeenFlag}); err != nil {
+		t.Fatalf("Changing flags: %v", err)
+	}
+	if err := mdb.ChangeFlags("INBOX", "<one@example.com>", nil, []string{"$Todo"}); err != nil {
+		t.Fatalf("Changing flags: %v", err)
+	}
+
+	result := fetch(t, src, mdb)
+	checkResult(t, "push", result, 0, 0, 0)
+
+	if got := ts.flags("INBOX", one); got != `\Seen` {
+		t.Errorf("ERROR: server flags of one: got %q, wanted %q", got, `\Seen`)
+	}
+	if got := ts.flags("INBOX", two); got != "" {
+		t.Errorf("ERROR: server flags of two: got %q, wanted none", got)
+	}
+
+	journal, err := mdb.GetJournal("INBOX")
+	if err != nil {
+		t.Fatalf("Getting journal: %v", err)
+	}
+	if len(journal) != 0 {
+		t.Errorf("ERROR: journal not empty after push: %+v", journal)
+	}
+	checkMailbox(t, mdb, "INBOX", []uint32{one, two}, "<one@example.com>", "<two@example.com>")
+}
+
+func TestPushMove(t *testing.T) {
+	ts := newTestServer(t)
+	mdb := openTestDB(t)
+
+	one := ts.add("INBOX", "one.eml")
+	three := ts.add("INBOX", "three.eml")
+	archived := ts.add("Archive", "no-msgid-a.eml")
+
+	info := ts.info()
+	info.Folders = []string{"*"}
+	src := setupSource(t, info)
+	fetch(t, src, mdb)
+
+	if err := mdb.MoveMessage("INBOX", "Archive", "<three@example.com>"); err != nil {
+		t.Fatalf("Moving message: %v", err)
+	}
+	checkResult(t, "push", fetch(t, src, mdb), 0, 0, 0)
+
+	// The test server advertises MOVE but refuses it, so the message
+	// is copied and expunged
+	if ts.message("INBOX", three) != nil {
+		t.Errorf("ERROR: moved message still in INBOX on server")
+	}
+	if n := len(ts.uids("Archive")); n != 2 {
+		t.Errorf("ERROR: %d messages in Archive on server, wanted 2", n)
+	}
+	journal, err := mdb.GetJournal("INBOX")
+	if err != nil {
+		t.Fatalf("Getting journal: %v", err)
+	}
+	if len(journal) != 0 {
+		t.Errorf("ERROR: journal not empty after push: %+v", journal)
+	}
+	checkMailbox(t, mdb, "INBOX", []uint32{one}, "<one@example.com>")
+
+	// Archive comes before INBOX, so the copy's UID is only picked
+	// up by the next Fetch
+	fetch(t, src, mdb)
+	archiveUids := ts.uids("Archive")
+	if len(archiveUids) != 2 || archiveUids[0] != archived {
+		t.Fatalf("Unexpected uids %v in Archive on server", archiveUids)
+	}
+	checkMailbox(t, mdb, "Archive", archiveUids, ts.messageId("no-msgid-a.eml"), "<three@example.com>")
+}
@@ -0,0 +1,102 @@
+package imapsource
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FetchResult summarises what a Fetch did.
+type FetchResult struct {
+	Fetched int // Messages downloaded and added to the database
+	Skipped int // Messages already in the database
+	Removed int // Messages no longer in their folder
+
+	Bytes   int64         // Total size of the messages fetched
+	Elapsed time.Duration // How long the Fetch took, if it got as far as fetching
+
+	// Messages which couldn't be fetched or added.  They aren't
+	// recorded as being in the mailbox, so they'll be tried again
+	// on the next Fetch.
+	Failed []*MessageError
+}
+
+// Throughput describes the rate at which messages were fetched.
+func (r *FetchResult) Throughput() string {
+	secs := r.Elapsed.Seconds()
+	if secs == 0 {
+		return "no time taken"
+	}
+	return fmt.Sprintf("%.1f messages/s, %.1f KiB/s",
+		float64(r.Fetched)/secs, float64(r.Bytes)/1024/secs)
+}
+
+// MessageError is the reason a single message couldn't be fetched.
+type MessageError struct {
+	Folder    string
+	Uid       uint32
+	MessageId string
+	Err       error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("Message %s (%s uid %d): %v", e.MessageId, e.Folder, e.Uid, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// FetchError is returned by Fetch if anything went wrong.  If Fatal
+// is set, the fetch was abandoned part-way through; otherwise it ran
+// to completion, but some messages couldn't be fetched.
+type FetchError struct {
+	Fatal  error
+	Failed []*MessageError
+}
+
+func (e *FetchError) Error() string {
+	msgs := []string{}
+	if e.Fatal != nil {
+		msgs = append(msgs, e.Fatal.Error())
+	}
+	for _, merr := range e.Failed {
+		msgs = append(msgs, merr.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns all the underlying errors.  errors.Is and
+// errors.As only look at these themselves from Go 1.20, so Is and As
+// do the same for older versions.
+func (e *FetchError) Unwrap() []error {
+	errs := []error{}
+	if e.Fatal != nil {
+		errs = append(errs, e.Fatal)
+	}
+	for _, merr := range e.Failed {
+		errs = append(errs, merr)
+	}
+	return errs
+}
+
+// Is reports whether any of the underlying errors matches target.
+func (e *FetchError) Is(target error) bool {
+	for _, err := range e.Unwrap() {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the underlying errors which matches target.
+func (e *FetchError) As(target interface{}) bool {
+	for _, err := range e.Unwrap() {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package imapsource
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Is and As are called directly too, as newer versions of errors.Is
+// and errors.As would manage without them
+func TestFetchErrorUnwrap(t *testing.T) {
+	merr := &MessageError{Folder: "INBOX", Uid: 3, Err: lmdb.ErrMsgidPresent}
+	ferr := &FetchError{Fatal: context.Canceled, Failed: []*MessageError{merr}}
+
+	for _, target := range []error{context.Canceled, lmdb.ErrMsgidPresent} {
+		if !ferr.Is(target) || !errors.Is(ferr, target) {
+			t.Errorf("ERROR: %v not found in %v", target, ferr)
+		}
+	}
+	if ferr.Is(context.DeadlineExceeded) {
+		t.Errorf("ERROR: unexpected error found in %v", ferr)
+	}
+
+	var got *MessageError
+	if !ferr.As(&got) || got != merr {
+		t.Errorf("ERROR: As got %v, wanted %v", got, merr)
+	}
+	got = nil
+	if !errors.As(ferr, &got) || got != merr {
+		t.Errorf("ERROR: errors.As got %v, wanted %v", got, merr)
+	}
+
+	ferr = &FetchError{Fatal: context.Canceled}
+	if ferr.As(&got) {
+		t.Errorf("ERROR: As found a MessageError in %v", ferr)
+	}
+}
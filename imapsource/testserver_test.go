@@ -0,0 +1,304 @@
+package imapsource
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// An IMAP server in the test process, using go-imap's memory
+// backend, reached over plaintext on a loopback port.  Messages are
+// added from the .eml files in testdata.  The backend supports
+// neither CONDSTORE nor MOVE, so the fallbacks get tested.
+//
+// The memory backend doesn't lock anything, so the tests only change
+// it while no Fetch is running.
+type testServer struct {
+	t    *testing.T
+	user *memory.User
+	addr string
+	port int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatalf("Logging in to memory backend: %v", err)
+	}
+
+	ts := &testServer{t: t, user: user.(*memory.User)}
+
+	// Start with an empty INBOX, rather than the backend's sample
+	// message
+	ts.mailbox("INBOX").Messages = nil
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	ts.addr = l.Addr().String()
+	ts.port = l.Addr().(*net.TCPAddr).Port
+
+	return ts
+}
+
+// The folder, created if need be
+func (ts *testServer) mailbox(name string) *memory.Mailbox {
+	ts.t.Helper()
+	mbox, err := ts.user.GetMailbox(name)
+	if err != nil {
+		if err := ts.user.CreateMailbox(name); err != nil {
+			ts.t.Fatalf("Creating folder %s: %v", name, err)
+		}
+		if mbox, err = ts.user.GetMailbox(name); err != nil {
+			ts.t.Fatalf("Getting folder %s: %v", name, err)
+		}
+	}
+	return mbox.(*memory.Mailbox)
+}
+
+// Add a message from testdata to a folder, returning its UID
+func (ts *testServer) add(folder, file string, flags ...string) uint32 {
+	ts.t.Helper()
+	raw, err := os.ReadFile(path.Join("testdata", file))
+	if err != nil {
+		ts.t.Fatalf("Reading test message: %v", err)
+	}
+	return ts.addRaw(folder, raw, flags...)
+}
+
+// The Message-ID a message from testdata is recorded under
+func (ts *testServer) messageId(file string) string {
+	ts.t.Helper()
+	raw, err := os.ReadFile(path.Join("testdata", file))
+	if err != nil {
+		ts.t.Fatalf("Reading test message: %v", err)
+	}
+	msgid, err := lmdb.RawMessageId(raw)
+	if err != nil {
+		ts.t.Fatalf("Getting message id of %s: %v", file, err)
+	}
+	return msgid
+}
+
+func (ts *testServer) addRaw(folder string, raw []byte, flags ...string) uint32 {
+	ts.t.Helper()
+	mbox := ts.mailbox(folder)
+	if err := mbox.CreateMessage(flags, time.Now(), bytes.NewBuffer(raw)); err != nil {
+		ts.t.Fatalf("Adding message to %s: %v", folder, err)
+	}
+	return mbox.Messages[len(mbox.Messages)-1].Uid
+}
+
+// The message with a UID, or nil
+func (ts *testServer) message(folder string, uid uint32) *memory.Message {
+	for _, msg := range ts.mailbox(folder).Messages {
+		if msg.Uid == uid {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (ts *testServer) uids(folder string) []uint32 {
+	uids := []uint32{}
+	for _, msg := range ts.mailbox(folder).Messages {
+		uids = append(uids, msg.Uid)
+	}
+	return uids
+}
+
+// Remove a message, as another client deleting it would.  NB the
+// memory backend reuses the highest UID if it's expunged, so tests
+// shouldn't expunge that.
+func (ts *testServer) expunge(folder string, uid uint32) {
+	ts.t.Helper()
+	mbox := ts.mailbox(folder)
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		ts.t.Fatalf("Deleting message: %v", err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		ts.t.Fatalf("Expunging: %v", err)
+	}
+}
+
+func (ts *testServer) info() *MailboxInfo {
+	return &MailboxInfo{
+		Hostname:       "127.0.0.1",
+		Port:           ts.port,
+		Username:       "username",
+		Password:       "password",
+		Security:       SecurityPlain,
+		ReconnectDelay: time.Millisecond,
+	}
+}
+
+// Passes traffic to the server, but cuts each connection off after
+// the server has sent the number of bytes in limits for it; from the
+// len(limits)th connection on there's no limit.
+type dropProxy struct {
+	lock        sync.Mutex
+	connections int
+}
+
+func (ts *testServer) dropProxy(limits ...int64) (*dropProxy, int) {
+	ts.t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ts.t.Fatalf("Listening: %v", err)
+	}
+	ts.t.Cleanup(func() { l.Close() })
+
+	p := &dropProxy{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sc, err := net.Dial("tcp", ts.addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+
+			p.lock.Lock()
+			n := p.connections
+			p.connections++
+			p.lock.Unlock()
+
+			go func() {
+				io.Copy(sc, c)
+				sc.Close()
+			}()
+			go func(n int) {
+				if n < len(limits) {
+					io.CopyN(c, sc, limits[n])
+				} else {
+					io.Copy(c, sc)
+				}
+				c.Close()
+				sc.Close()
+			}(n)
+		}
+	}()
+
+	return p, l.Addr().(*net.TCPAddr).Port
+}
+
+func (p *dropProxy) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connections
+}
+
+func openTestDB(t *testing.T) *lmdb.MailDB {
+	t.Helper()
+	dbfile := path.Join(t.TempDir(), "imap-test.sqlite")
+	mdb, err := lmdb.OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	t.Cleanup(func() { mdb.Close() })
+	return mdb
+}
+
+func setupSource(t *testing.T, info *MailboxInfo) *ImapSource {
+	t.Helper()
+	src, err := Setup(info)
+	if err != nil {
+		t.Fatalf("Setting up source: %v", err)
+	}
+	t.Cleanup(src.Close)
+	return &src
+}
+
+// Fetch, failing the test if anything goes wrong
+func fetch(t *testing.T, src *ImapSource, mdb *lmdb.MailDB) *FetchResult {
+	t.Helper()
+	result, err := src.Fetch(mdb)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	return result
+}
+
+func checkResult(t *testing.T, what string, result *FetchResult, fetched, skipped, removed int) {
+	t.Helper()
+	if result.Fetched != fetched || result.Skipped != skipped || result.Removed != removed {
+		t.Errorf("ERROR: %s: got %d fetched, %d skipped, %d removed; wanted %d, %d, %d",
+			what, result.Fetched, result.Skipped, result.Removed, fetched, skipped, removed)
+	}
+}
+
+// Check the UIDs and Message-IDs recorded for a mailbox
+func checkMailbox(t *testing.T, mdb *lmdb.MailDB, mboxname string, wantUids []uint32, wantMsgids ...string) {
+	t.Helper()
+
+	uids, err := mdb.GetMailboxUids(mboxname)
+	if err != nil {
+		t.Fatalf("Getting uids for %s: %v", mboxname, err)
+	}
+	if !equalUids(uids, wantUids) {
+		t.Errorf("ERROR: %s: got uids %v, wanted %v", mboxname, uids, wantUids)
+	}
+
+	messages, err := mdb.GetMailboxMessages(mboxname)
+	if err != nil {
+		t.Fatalf("Getting messages for %s: %v", mboxname, err)
+	}
+	msgids := []string{}
+	for _, m := range messages {
+		msgids = append(msgids, m.Envelope.MessageId)
+	}
+	sort.Strings(msgids)
+	sort.Strings(wantMsgids)
+	if len(msgids) != len(wantMsgids) {
+		t.Errorf("ERROR: %s: got messages %v, wanted %v", mboxname, msgids, wantMsgids)
+		return
+	}
+	for i := range msgids {
+		if msgids[i] != wantMsgids[i] {
+			t.Errorf("ERROR: %s: got messages %v, wanted %v", mboxname, msgids, wantMsgids)
+			return
+		}
+	}
+}
+
+func equalUids(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package imapsource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// The client blocks until updates are read, so they must be drained
+// for as long as the connection is up, whether anyone is watching or
+// not.  We only care whether anything has happened since we last
+// looked.
+func (src *ImapSource) goWatchUpdates(c *client.Client, updates chan client.Update) {
+	changed := make(chan struct{}, 1)
+	src.changed = changed
+
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				switch update.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate, *client.MessageUpdate:
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}()
+}
+
+// Watch keeps mdb in sync with the folders until ctx is cancelled
+// (in which case it returns ctx.Err()) or an error occurs.  Failures
+// to fetch individual messages are logged, not returned.
+//
+// It does a Fetch to catch up, and then waits for the server to tell
+// us about new or expunged messages, using IDLE if the server
+// supports it and polling with NOOP every PollInterval (default one
+// minute) if not.  Each time something changes it does another
+// (incremental) Fetch.
+//
+// Only the folder left selected by Fetch (INBOX, if it's being
+// synced) is watched like this; if there are others, they're checked
+// with another Fetch every PollInterval.
+func (src *ImapSource) Watch(ctx context.Context, mdb *lmdb.MailDB) error {
+	if err := src.ImapConnect(); err != nil {
+		return err
+	}
+
+	idleOpts := &client.IdleOptions{PollInterval: src.mailbox.PollInterval}
+
+	rescanInterval := src.mailbox.PollInterval
+	if rescanInterval == 0 {
+		rescanInterval = time.Minute
+	}
+
+	for {
+		// Anything which happened before now will be picked up by
+		// this Fetch
+		select {
+		case <-src.changed:
+		default:
+		}
+
+		// Messages which couldn't be fetched will be tried again next
+		// time round; only give up if the fetch itself failed.
+		if _, err := src.FetchContext(ctx, mdb); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var ferr *FetchError
+			if !errors.As(err, &ferr) || ferr.Fatal != nil {
+				return err
+			}
+			log.Printf("Some messages couldn't be fetched: %v", err)
+		}
+
+		log.Printf("Waiting for changes to %s", src.folder)
+
+		// Fetch may have had to reconnect
+		c := src.client
+
+		var rescan <-chan time.Time
+		if len(src.folders) > 1 {
+			rescan = time.After(rescanInterval)
+		}
+
+		stop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- c.Idle(stop, idleOpts)
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-idleDone
+			return ctx.Err()
+		case <-src.changed:
+			close(stop)
+			if err := <-idleDone; err != nil {
+				return fmt.Errorf("Waiting for mailbox changes: %w", err)
+			}
+		case <-rescan:
+			close(stop)
+			if err := <-idleDone; err != nil {
+				return fmt.Errorf("Waiting for mailbox changes: %w", err)
+			}
+		case err := <-idleDone:
+			if err == nil {
+				err = fmt.Errorf("Connection closed")
+			}
+			return fmt.Errorf("Waiting for mailbox changes: %w", err)
+		}
+
+		// EXISTS and EXPUNGE don't tell us the new UIDNEXT, which
+		// Fetch uses to tell whether anything has changed; but it
+		// re-selects each folder, which gets it.
+	}
+}
@@ -0,0 +1,210 @@
+package localmaildb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Attachment struct {
+	Index       int    // Position among the leaf parts of the message, from 0
+	Filename    string // Decoded; may be empty
+	ContentType string // e.g. "application/pdf"
+	Size        int    // In bytes, after removing the transfer encoding
+}
+
+// MessageBody is a decoded view of a message, so that consumers don't
+// have to deal with MIME themselves.
+type MessageBody struct {
+	Text        string // text/plain parts, converted to UTF-8
+	HTML        string // text/html parts, converted to UTF-8
+	Attachments []Attachment
+}
+
+// A part is an attachment if it says it is, or has a filename, or
+// isn't something a mail reader would show inline.
+func isAttachment(p *mimePart) bool {
+	disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	switch {
+	case disposition == "attachment":
+		return true
+	case partFilename(p) != "":
+		return true
+	default:
+		return p.MediaType != "text/plain" && p.MediaType != "text/html"
+	}
+}
+
+func partFilename(p *mimePart) string {
+	// ParseMediaType takes care of RFC 2231 encoding (filename*=),
+	// but plenty of clients use RFC 2047 instead.
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if name := params["filename"]; name != "" {
+		return decodeHeader(name)
+	}
+	return decodeHeader(p.Params["name"])
+}
+
+func parseMessageBody(header textproto.MIMEHeader, body []byte) (*MessageBody, error) {
+	mb := &MessageBody{}
+	var text, html []string
+
+	index := 0
+	err := walkParts(header, bytes.NewReader(body), func(p *mimePart) error {
+		defer func() { index++ }()
+
+		if isAttachment(p) {
+			mb.Attachments = append(mb.Attachments, Attachment{
+				Index:       index,
+				Filename:    partFilename(p),
+				ContentType: p.MediaType,
+				Size:        len(p.Body),
+			})
+			return nil
+		}
+
+		switch p.MediaType {
+		case "text/plain":
+			text = append(text, p.Text())
+		case "text/html":
+			html = append(html, p.Text())
+		}
+		return nil
+	})
+
+	mb.Text = strings.Join(text, "\n")
+	mb.HTML = strings.Join(html, "\n")
+
+	return mb, err
+}
+
+// ParseMessageBody decodes a raw RFC 5322 message.  If the MIME
+// structure is broken part-way through, whatever could be decoded is
+// returned along with an ErrParseError.
+func ParseMessageBody(message []byte) (*MessageBody, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, ErrParseError.wrap(err)
+	}
+
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, ErrParseError.wrap(err)
+	}
+
+	mb, err := parseMessageBody(textproto.MIMEHeader(m.Header), body)
+	if err != nil {
+		return mb, ErrParseError.wrap(err)
+	}
+
+	return mb, nil
+}
+
+// Body decodes the message; see ParseMessageBody.
+func (mt *MessageTree) Body() (*MessageBody, error) {
+	if mt.Placeholder {
+		return nil, fmt.Errorf("No body for placeholder message %s", mt.Envelope.MessageId)
+	}
+	return ParseMessageBody(mt.RawMessage)
+}
+
+// GetMessageBody decodes the message with the given message id; see
+// ParseMessageBody.
+func (mdb *MailDB) GetMessageBody(msgid string) (*MessageBody, error) {
+	return mdb.GetMessageBodyContext(context.Background(), msgid)
+}
+
+// GetMessageBodyContext is like GetMessageBody, but takes a context.
+func (mdb *MailDB) GetMessageBodyContext(ctx context.Context, msgid string) (*MessageBody, error) {
+	msgid = NormalizeMessageId(msgid)
+	var message string
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		return sqlx.Get(eq, &message, `select message from lmdb_messages where messageid=?`, msgid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Getting message with messageid %s: %w", msgid, err)
+	}
+
+	return ParseMessageBody([]byte(message))
+}
+
+// GetAttachments lists the attachments of a message from the
+// database, without having to decode the message.
+func (mdb *MailDB) GetAttachments(msgid string) ([]Attachment, error) {
+	return mdb.GetAttachmentsContext(context.Background(), msgid)
+}
+
+// GetAttachmentsContext is like GetAttachments, but takes a context.
+func (mdb *MailDB) GetAttachmentsContext(ctx context.Context, msgid string) ([]Attachment, error) {
+	msgid = NormalizeMessageId(msgid)
+	var attachments []Attachment
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		attachments = nil
+		return sqlx.Select(eq, &attachments, `
+        select partindex as "index", filename, contenttype, size
+            from lmdb_attachments
+            where messageid=?
+            order by partindex`, msgid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Getting attachments for messageid %s: %w", msgid, err)
+	}
+	return attachments, nil
+}
+
+func addAttachmentsTx(eq sqlx.Ext, messageId string, attachments []Attachment) error {
+	for _, a := range attachments {
+		_, err := eq.Exec(`
+            insert into lmdb_attachments(messageid, partindex, filename, contenttype, size)
+                values(?, ?, ?, ?, ?)`,
+			messageId, a.Index, a.Filename, a.ContentType, a.Size)
+		if err != nil {
+			return fmt.Errorf("Inserting attachment %d for messageid %s: %w",
+				a.Index, messageId, err)
+		}
+	}
+	return nil
+}
+
+// Migration helper: fill in lmdb_attachments for messages added
+// before it existed.
+func backfillAttachmentsTx(eq sqlx.Ext) error {
+	rows, err := eq.Queryx(`select messageid, message from lmdb_messages`)
+	if err != nil {
+		return fmt.Errorf("Getting message list: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var messageId, message string
+		if err := rows.Scan(&messageId, &message); err != nil {
+			return fmt.Errorf("Scanning message: %w", err)
+		}
+
+		// Record what we can of broken messages
+		mb, _ := ParseMessageBody([]byte(message))
+		if mb == nil {
+			continue
+		}
+
+		if err := addAttachmentsTx(eq, messageId, mb.Attachments); err != nil {
+			return err
+		}
+
+		count++
+		if count%10000 == 0 {
+			log.Printf("...scanned %d messages for attachments", count)
+		}
+	}
+
+	return rows.Err()
+}
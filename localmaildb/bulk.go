@@ -0,0 +1,394 @@
+package localmaildb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Bulk ingestion, for importing large archives.  Adding messages one
+// at a time with AddMessage costs a transaction per message, and
+// several round trips per address; a BulkWriter batches many changes
+// into a single transaction, prepares each statement once per
+// transaction, and remembers address ids between messages.
+
+// Address ids known to be in the database.  Ids added by a
+// transaction are only trusted once it has committed.  A nil
+// *addressCache caches nothing.
+type addressCache struct {
+	committed, pending map[Address]int
+}
+
+func (c *addressCache) get(addr Address) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	if id, ok := c.committed[addr]; ok {
+		return id, true
+	}
+	id, ok := c.pending[addr]
+	return id, ok
+}
+
+func (c *addressCache) put(addr Address, id int) {
+	if c == nil {
+		return
+	}
+	if c.pending == nil {
+		c.pending = map[Address]int{}
+	}
+	c.pending[addr] = id
+}
+
+func (c *addressCache) commit() {
+	if c.committed == nil {
+		c.committed = map[Address]int{}
+	}
+	for addr, id := range c.pending {
+		c.committed[addr] = id
+	}
+	c.pending = nil
+}
+
+func (c *addressCache) rollback() {
+	c.pending = nil
+}
+
+// Implemented by *sqlx.Tx and ctxExt
+type preparer interface {
+	Preparex(query string) (*sqlx.Stmt, error)
+}
+
+// stmtCache prepares each distinct statement the first time it's
+// run, and re-uses it after that, so that the *Tx helpers get
+// prepared statements without having to know about them.  Only valid
+// for the transaction it was made for.
+type stmtCache struct {
+	sqlx.Ext
+	ctx   context.Context
+	prep  preparer // nil if eq can't prepare statements
+	stmts map[string]*sqlx.Stmt
+}
+
+func newStmtCache(ctx context.Context, eq sqlx.Ext) *stmtCache {
+	sc := &stmtCache{Ext: eq, ctx: ctx, stmts: map[string]*sqlx.Stmt{}}
+	sc.prep, _ = eq.(preparer)
+	return sc
+}
+
+func (sc *stmtCache) stmt(query string) (*sqlx.Stmt, error) {
+	if st := sc.stmts[query]; st != nil {
+		return st, nil
+	}
+	st, err := sc.prep.Preparex(query)
+	if err != nil {
+		return nil, err
+	}
+	sc.stmts[query] = st
+	return st, nil
+}
+
+func (sc *stmtCache) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if sc.prep == nil {
+		return sc.Ext.Exec(query, args...)
+	}
+	st, err := sc.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.ExecContext(sc.ctx, args...)
+}
+
+func (sc *stmtCache) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if sc.prep == nil {
+		return sc.Ext.Query(query, args...)
+	}
+	st, err := sc.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.QueryContext(sc.ctx, args...)
+}
+
+func (sc *stmtCache) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	if sc.prep == nil {
+		return sc.Ext.Queryx(query, args...)
+	}
+	st, err := sc.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.QueryxContext(sc.ctx, args...)
+}
+
+func (sc *stmtCache) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	if sc.prep == nil {
+		return sc.Ext.QueryRowx(query, args...)
+	}
+	st, err := sc.stmt(query)
+	if err != nil {
+		// sqlx.Row has no way to construct one carrying an
+		// error; let the unprepared query report it.
+		return sc.Ext.QueryRowx(query, args...)
+	}
+	return st.QueryRowxContext(sc.ctx, args...)
+}
+
+func (sc *stmtCache) Close() {
+	for _, st := range sc.stmts {
+		st.Close()
+	}
+	sc.stmts = nil
+}
+
+type bulkOpKind int
+
+const (
+	bulkAdd = bulkOpKind(iota)
+	bulkDelete
+	bulkDeleteCopy
+	bulkSourceState
+	bulkAddToMailbox
+	bulkRemoveFromMailbox
+	bulkSetFlags
+)
+
+type bulkOp struct {
+	kind               bulkOpKind
+	message            *PreparedMessage
+	messageId          string // bulkDelete and the mailbox ops
+	source, key, value string // bulkSourceState
+	mailboxname        string // The mailbox ops and bulkDeleteCopy
+	flags              []string
+}
+
+// DefaultBulkBatchSize is the BatchSize of a new BulkWriter.
+const DefaultBulkBatchSize = 1000
+
+// BulkWriter queues changes to the database, and writes them in
+// order, BatchSize at a time, in a single transaction.  Nothing is
+// written until the batch is full or Flush is called; so call Flush
+// when done.  If BatchSize is 0, changes are only written by Flush.
+//
+// If a batch fails (including because the context is cancelled),
+// none of it is written, and it stays queued.  Recording how far an
+// import has got with SetSourceState in the same batch as the
+// messages means the two always agree.
+//
+// A BulkWriter isn't safe for concurrent use; but MailDB.PrepareMessage
+// is, so messages can be parsed in parallel.
+type BulkWriter struct {
+	mdb       *MailDB
+	BatchSize int
+
+	// Totals of changes written so far.  Messages which were already
+	// present count as Present, not Added; a different message with
+	// the same Message-ID is Added, as a variant (see msgid.go).
+	Added, Present, Deleted int
+
+	ops   []bulkOp
+	addrs addressCache
+}
+
+func (mdb *MailDB) NewBulkWriter() *BulkWriter {
+	return &BulkWriter{mdb: mdb, BatchSize: DefaultBulkBatchSize}
+}
+
+func (bw *BulkWriter) queue(ctx context.Context, op bulkOp) error {
+	bw.ops = append(bw.ops, op)
+	if bw.BatchSize > 0 && len(bw.ops) >= bw.BatchSize {
+		return bw.FlushContext(ctx)
+	}
+	return nil
+}
+
+// Add queues a message to be added.
+func (bw *BulkWriter) Add(pm *PreparedMessage) error {
+	return bw.AddContext(context.Background(), pm)
+}
+
+// AddContext is like Add, but takes a context.
+func (bw *BulkWriter) AddContext(ctx context.Context, pm *PreparedMessage) error {
+	return bw.queue(ctx, bulkOp{kind: bulkAdd, message: pm})
+}
+
+// Delete queues a message to be removed; see DeleteMessage.
+func (bw *BulkWriter) Delete(messageId string) error {
+	return bw.DeleteContext(context.Background(), messageId)
+}
+
+// DeleteContext is like Delete, but takes a context.
+func (bw *BulkWriter) DeleteContext(ctx context.Context, messageId string) error {
+	return bw.queue(ctx, bulkOp{kind: bulkDelete, messageId: NormalizeMessageId(messageId)})
+}
+
+// DeleteCopy queues recording that the source whose messages are in
+// mailboxname (or "") no longer has a message, leaving any others with
+// the same Message-ID, and the message itself if it's in other
+// mailboxes; see DeleteMessageCopy.
+func (bw *BulkWriter) DeleteCopy(mailboxname string, pm *PreparedMessage) error {
+	return bw.DeleteCopyContext(context.Background(), mailboxname, pm)
+}
+
+// DeleteCopyContext is like DeleteCopy, but takes a context.
+func (bw *BulkWriter) DeleteCopyContext(ctx context.Context, mailboxname string, pm *PreparedMessage) error {
+	return bw.queue(ctx, bulkOp{kind: bulkDeleteCopy, mailboxname: mailboxname, message: pm})
+}
+
+// AddToMailbox queues adding a message to an existing mailbox.  It's
+// ignored if the message isn't in the database (when the batch is
+// written), or already in the mailbox.
+func (bw *BulkWriter) AddToMailbox(mailboxname, messageId string) error {
+	return bw.AddToMailboxContext(context.Background(), mailboxname, messageId)
+}
+
+// AddToMailboxContext is like AddToMailbox, but takes a context.
+func (bw *BulkWriter) AddToMailboxContext(ctx context.Context, mailboxname, messageId string) error {
+	return bw.queue(ctx, bulkOp{kind: bulkAddToMailbox, mailboxname: mailboxname, messageId: NormalizeMessageId(messageId)})
+}
+
+// RemoveFromMailbox queues removing a message from an existing
+// mailbox.
+func (bw *BulkWriter) RemoveFromMailbox(mailboxname, messageId string) error {
+	return bw.RemoveFromMailboxContext(context.Background(), mailboxname, messageId)
+}
+
+// RemoveFromMailboxContext is like RemoveFromMailbox, but takes a context.
+func (bw *BulkWriter) RemoveFromMailboxContext(ctx context.Context, mailboxname, messageId string) error {
+	return bw.queue(ctx, bulkOp{kind: bulkRemoveFromMailbox, mailboxname: mailboxname, messageId: NormalizeMessageId(messageId)})
+}
+
+// SetFlags queues a change to a message's flags; see MailDB.SetFlags.
+func (bw *BulkWriter) SetFlags(mailboxname, messageId string, flags []string) error {
+	return bw.SetFlagsContext(context.Background(), mailboxname, messageId, flags)
+}
+
+// SetFlagsContext is like SetFlags, but takes a context.
+func (bw *BulkWriter) SetFlagsContext(ctx context.Context, mailboxname, messageId string, flags []string) error {
+	return bw.queue(ctx, bulkOp{kind: bulkSetFlags, mailboxname: mailboxname, messageId: NormalizeMessageId(messageId), flags: flags})
+}
+
+// SetSourceState queues a change to the source state; see
+// MailDB.SetSourceState.
+func (bw *BulkWriter) SetSourceState(source, key, value string) error {
+	return bw.SetSourceStateContext(context.Background(), source, key, value)
+}
+
+// SetSourceStateContext is like SetSourceState, but takes a context.
+func (bw *BulkWriter) SetSourceStateContext(ctx context.Context, source, key, value string) error {
+	// Only the last value matters, so don't bother queueing the
+	// same thing over and over
+	if n := len(bw.ops); n > 0 {
+		last := &bw.ops[n-1]
+		if last.kind == bulkSourceState && last.source == source && last.key == key {
+			last.value = value
+			return nil
+		}
+	}
+	return bw.queue(ctx, bulkOp{kind: bulkSourceState, source: source, key: key, value: value})
+}
+
+// Flush writes everything queued.
+func (bw *BulkWriter) Flush() error {
+	return bw.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but takes a context.
+func (bw *BulkWriter) FlushContext(ctx context.Context) error {
+	if len(bw.ops) == 0 {
+		return nil
+	}
+
+	var added, present, deleted int
+
+	err := bw.mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		added, present, deleted = 0, 0, 0
+		bw.addrs.rollback()
+
+		sc := newStmtCache(ctx, eq)
+		defer sc.Close()
+
+		mboxIds := map[string]int{}
+		mailboxId := func(mailboxname string) (int, error) {
+			mboxId, ok := mboxIds[mailboxname]
+			if !ok {
+				var err error
+				mboxId, err = mailboxNameToIdTx(sc, mailboxname)
+				if err != nil {
+					return 0, fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+				}
+				mboxIds[mailboxname] = mboxId
+			}
+			return mboxId, nil
+		}
+
+		for _, op := range bw.ops {
+			switch op.kind {
+			case bulkAdd:
+				err := bw.mdb.addMessageTx(sc, op.message, &bw.addrs)
+				if errors.Is(err, ErrMsgidPresent) {
+					present++
+					continue
+				} else if err != nil {
+					return err
+				}
+				added++
+			case bulkDelete:
+				if err := bw.mdb.deleteMessageTx(sc, op.messageId); err != nil {
+					return err
+				}
+				deleted++
+			case bulkDeleteCopy:
+				mboxId := 0
+				if op.mailboxname != "" {
+					var err error
+					if mboxId, err = mailboxId(op.mailboxname); err != nil {
+						return err
+					}
+				}
+				if err := bw.mdb.deleteCopyTx(sc, mboxId, op.message.messageId, op.message.hash); err != nil {
+					return err
+				}
+				deleted++
+			case bulkSourceState:
+				if err := setSourceStateTx(sc, op.source, op.key, op.value); err != nil {
+					return err
+				}
+			case bulkAddToMailbox, bulkRemoveFromMailbox, bulkSetFlags:
+				mboxId, err := mailboxId(op.mailboxname)
+				if err != nil {
+					return err
+				}
+
+				switch op.kind {
+				case bulkAddToMailbox:
+					err = addToMailboxTx(sc, mboxId, op.messageId)
+				case bulkRemoveFromMailbox:
+					err = removeFromMailboxTx(sc, mboxId, op.messageId)
+				case bulkSetFlags:
+					err = setFlagsTx(sc, mboxId, op.messageId, op.flags)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		bw.addrs.rollback()
+		return fmt.Errorf("Writing batch of %d changes: %w", len(bw.ops), err)
+	}
+
+	bw.addrs.commit()
+	bw.Added += added
+	bw.Present += present
+	bw.Deleted += deleted
+	bw.ops = bw.ops[:0]
+
+	return nil
+}
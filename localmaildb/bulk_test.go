@@ -0,0 +1,146 @@
+package localmaildb
+
+import (
+	"path"
+	"testing"
+)
+
+func TestBulkWriter(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "bulk-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	if err := mdb.AddMessage(testMessage("<a@x>", 1)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	bw := mdb.NewBulkWriter()
+	bw.BatchSize = 2
+
+	for i, msgid := range []string{"<a@x>", "<b@x>", "<c@x>", "<b@x>", "<d@x>"} {
+		pm, err := mdb.PrepareMessage(testMessage(msgid, i+2))
+		if err != nil {
+			t.Fatalf("Preparing message: %v", err)
+		}
+		if pm.MessageId() != msgid {
+			t.Errorf("ERROR: Prepared message has id %s, wanted %s", pm.MessageId(), msgid)
+		}
+		if err := bw.Add(pm); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+		if err := bw.SetSourceState("test", "last", msgid); err != nil {
+			t.Fatalf("Setting source state: %v", err)
+		}
+	}
+	if err := bw.Delete("<c@x>"); err != nil {
+		t.Fatalf("Deleting message: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("Flushing: %v", err)
+	}
+
+	// The second <a@x> and <b@x> differ from the first, so are added
+	// as variants
+	if bw.Added != 5 || bw.Present != 0 || bw.Deleted != 1 {
+		t.Errorf("ERROR: Got %d added, %d present, %d deleted; wanted 5, 0, 1",
+			bw.Added, bw.Present, bw.Deleted)
+	}
+	for _, msgid := range []string{"<a@x>", "<b@x>"} {
+		if variants, err := mdb.GetMessageVariants(msgid); err != nil || len(variants) != 1 {
+			t.Errorf("ERROR: Got %d variants of %s (%v), wanted 1", len(variants), msgid, err)
+		}
+	}
+
+	for msgid, want := range map[string]bool{"<a@x>": true, "<b@x>": true, "<c@x>": false, "<d@x>": true} {
+		prs, err := mdb.IsMsgIdPresent(msgid)
+		if err != nil {
+			t.Fatalf("Checking for %s: %v", msgid, err)
+		}
+		if prs != want {
+			t.Errorf("ERROR: Message %s present %v, wanted %v", msgid, prs, want)
+		}
+	}
+
+	if state, err := mdb.GetSourceState("test", "last"); err != nil || state != "<d@x>" {
+		t.Errorf("ERROR: Got source state %q (%v), wanted <d@x>", state, err)
+	}
+
+	// All the messages are from the same address, which should only
+	// have been added once
+	var n int
+	if err := mdb.db.Get(&n, `select count(*) from lmdb_addresses`); err != nil {
+		t.Fatalf("Counting addresses: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("ERROR: %d addresses, wanted 1", n)
+	}
+
+	tree, err := mdb.GetTreeFromMessageId("<d@x>")
+	if err != nil {
+		t.Fatalf("Getting message: %v", err)
+	}
+	if len(tree.Envelope.From) != 1 || tree.Envelope.From[0].MailboxName != "test" {
+		t.Errorf("ERROR: Unexpected From %v", tree.Envelope.From)
+	}
+}
+
+func TestBulkWriterCopies(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "bulk-copies-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	if err := mdb.AddMessage(testMessage("<a@x>", 1)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	bw := mdb.NewBulkWriter()
+	bw.BatchSize = 2
+
+	// Copies of messages already seen, in the database or earlier in
+	// the batch, are Present rather than variants
+	for _, msgid := range []string{"<a@x>", "<b@x>", "<b@x>"} {
+		pm, err := mdb.PrepareMessage(testMessage(msgid, 1))
+		if err != nil {
+			t.Fatalf("Preparing message: %v", err)
+		}
+		if err := bw.Add(pm); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("Flushing: %v", err)
+	}
+
+	if bw.Added != 1 || bw.Present != 2 || bw.Deleted != 0 {
+		t.Errorf("ERROR: Got %d added, %d present, %d deleted; wanted 1, 2, 0",
+			bw.Added, bw.Present, bw.Deleted)
+	}
+	for _, msgid := range []string{"<a@x>", "<b@x>"} {
+		if variants, err := mdb.GetMessageVariants(msgid); err != nil || len(variants) != 0 {
+			t.Errorf("ERROR: Got %d variants of %s (%v), wanted none", len(variants), msgid, err)
+		}
+	}
+
+	// Deleting a copy which isn't the stored one leaves the message
+	other, err := mdb.PrepareMessage(testMessage("<a@x>", 2))
+	if err != nil {
+		t.Fatalf("Preparing message: %v", err)
+	}
+	if err := bw.DeleteCopy("", other); err != nil {
+		t.Fatalf("Deleting copy: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("Flushing: %v", err)
+	}
+	if prs, err := mdb.IsMsgIdPresent("<a@x>"); err != nil || !prs {
+		t.Errorf("ERROR: <a@x> gone after deleting a different copy (%v)", err)
+	}
+}
@@ -0,0 +1,64 @@
+package localmaildb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/martyros/sqlutil/txutil"
+)
+
+// Every method which touches the database has a ...Context variant
+// taking a context.Context; the plain version uses
+// context.Background().  Cancelling the context interrupts any
+// statement in progress and rolls back the current transaction, so
+// only whole transactions are ever committed.
+
+// ctxExt runs all statements with ctx, so that the *Tx helpers don't
+// need to know about contexts.
+type ctxExt struct {
+	sqlx.ExtContext
+	ctx context.Context
+}
+
+func (e ctxExt) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.ExecContext(e.ctx, query, args...)
+}
+
+func (e ctxExt) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.QueryContext(e.ctx, query, args...)
+}
+
+func (e ctxExt) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return e.QueryxContext(e.ctx, query, args...)
+}
+
+func (e ctxExt) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return e.QueryRowxContext(e.ctx, query, args...)
+}
+
+// For stmtCache
+func (e ctxExt) Preparex(query string) (*sqlx.Stmt, error) {
+	p, ok := e.ExtContext.(interface {
+		PreparexContext(ctx context.Context, query string) (*sqlx.Stmt, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Prepared statements not supported")
+	}
+	return p.PreparexContext(e.ctx, query)
+}
+
+// txLoop is txutil.TxLoopDb, with all statements run with ctx.
+func (mdb *MailDB) txLoop(ctx context.Context, txFunc func(eq sqlx.Ext) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+		if ec, ok := eq.(sqlx.ExtContext); ok {
+			eq = ctxExt{ExtContext: ec, ctx: ctx}
+		}
+		return txFunc(eq)
+	})
+}
@@ -0,0 +1,47 @@
+package localmaildb
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestContextCancel(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "context-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := mdb.AddMessageContext(ctx, testMessage("<a@x>", 1)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	cancel()
+
+	err = mdb.AddMessageContext(ctx, testMessage("<b@x>", 2))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ERROR: Adding message after cancel: got %v, wanted context.Canceled", err)
+	}
+
+	_, err = mdb.GetMessageRootsContext(ctx, "test")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ERROR: Getting roots after cancel: got %v, wanted context.Canceled", err)
+	}
+
+	// What was committed before the cancel is still there
+	for msgid, want := range map[string]bool{"<a@x>": true, "<b@x>": false} {
+		prs, err := mdb.IsMsgIdPresent(msgid)
+		if err != nil {
+			t.Fatalf("Checking for %s: %v", msgid, err)
+		}
+		if prs != want {
+			t.Errorf("ERROR: Message %s present %v, wanted %v", msgid, prs, want)
+		}
+	}
+}
@@ -2,18 +2,21 @@ package localmaildb
 
 import (
 	"bytes"
+	"context"
 	//"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/mail"
+	"net/textproto"
 
 	"regexp"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/mattn/go-sqlite3"
 
 	"gitlab.com/martyros/sqlutil/liteutil"
-	"gitlab.com/martyros/sqlutil/txutil"
 )
 
 // Open maildb
@@ -37,6 +40,7 @@ const (
 
 var headerPartFieldName = [...]string{
 	HeaderPartFrom:    "From",
+	HeaderPartSender:  "Sender",
 	HeaderPartReplyTo: "Reply-to",
 	HeaderPartTo:      "To",
 	HeaderPartCc:      "Cc",
@@ -44,7 +48,8 @@ var headerPartFieldName = [...]string{
 }
 
 type MailDB struct {
-	db *sqlx.DB
+	db  *sqlx.DB
+	fts bool // Full-text index available; see search.go
 }
 
 // Fill in mbd.mailbox.mailboxId from mbd.mailbox.MailboxName, if it
@@ -63,8 +68,17 @@ func mailboxNameToIdTx(eq sqlx.Ext, mailboxname string) (int, error) {
 
 // Create the mailbox as described if it doesn't exist
 func (mdb *MailDB) CreateMailbox(mailboxname string) error {
-	_, err := mdb.db.Exec(`insert into lmdb_mailboxes(mailboxname) values(?)`,
-		mailboxname)
+	return mdb.CreateMailboxContext(context.Background(), mailboxname)
+}
+
+// CreateMailboxContext is like CreateMailbox, but takes a context.
+func (mdb *MailDB) CreateMailboxContext(ctx context.Context, mailboxname string) error {
+	// NB lmdb_mailboxes.mailboxname has no unique constraint
+	_, err := mdb.db.ExecContext(ctx, `
+        insert into lmdb_mailboxes(mailboxname)
+            select ? where not exists
+                (select 1 from lmdb_mailboxes where mailboxname=?)`,
+		mailboxname, mailboxname)
 	if err != nil && !liteutil.IsErrorConstraintUnique(err) {
 		return fmt.Errorf("Inserting mailbox id: %w", err)
 	}
@@ -72,99 +86,38 @@ func (mdb *MailDB) CreateMailbox(mailboxname string) error {
 }
 
 // AttachMailDB takes an existing DB connection and returns a MailDB
-// object.  It will create the lmdb schema tables if they don't exist.
+// object.  It will create the lmdb schema tables if they don't exist,
+// and upgrade older schemas to the current version (see migrate.go).
+// It will refuse (returning ErrDBVersion) to attach to a database
+// with a schema newer than the library understands.
 func AttachMailDB(db *sqlx.DB) (*MailDB, error) {
-	mdb := &MailDB{db: db}
+	return AttachMailDBContext(context.Background(), db)
+}
 
-	log.Println("Creating tables if they don't exist")
-	// Create tables if they don't exist
-	tx, err := db.Beginx()
-	if err != nil {
-		goto out_close
-	}
+// AttachMailDBContext is like AttachMailDB, but takes a context.  If
+// it's cancelled, any upgrade in progress is rolled back.
+func AttachMailDBContext(ctx context.Context, db *sqlx.DB) (*MailDB, error) {
+	mdb := &MailDB{db: db}
 
-	_, err = tx.Exec(`
-        create table if not exists lmdb_params(
-            key       text primary key,
-            value     text not null)`)
-	if err != nil {
-		err = fmt.Errorf("Creating table params: %v", err)
-		goto out_rollback
-	}
-	_, err = tx.Exec(`
-        insert into lmdb_params(key, value)
-            values ("dbversion", "1")
-            on conflict do nothing`)
-	if err != nil {
-		err = fmt.Errorf("Inserting version param: %v", err)
-		goto out_rollback
-	}
-
-	_, err = tx.Exec(`
-        create table if not exists lmdb_messages(
-            messageid text primary key,
-            subject   text not null,
-            date      date  not null,
-            message   text not null,
-            inreplyto text,
-            size      integer  not null)`)
-	if err != nil {
-		err = fmt.Errorf("Creating table messages: %v", err)
-		goto out_rollback
-	}
-	_, err = tx.Exec(`
-        create table if not exists lmdb_addresses(
-            addressid    integer primary key,
-            personalname text,
-            mailboxname  text,
-            hostname     text,
-            unique(personalname, mailboxname, hostname))`)
-	if err != nil {
-		err = fmt.Errorf("Creating table addresses: %v", err)
-		goto out_rollback
+	if err := mdb.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	_, err = tx.Exec(`
-        create table if not exists lmdb_envelopejoin(
-            messageid text not null,
-            addressid integer not null,
-            envelopepart integer not null,
-            foreign key(messageid) references lmdb_messages,
-            foreign key(addressid) references lmdb_addresses)`)
-	if err != nil {
-		err = fmt.Errorf("Creating table envelopejoin: %v", err)
-		goto out_rollback
+	if err := mdb.ensureSearchIndex(ctx); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	_, err = tx.Exec(`
-        create table if not exists lmdb_mailboxes(
-            mailboxid integer primary key,
-            mailboxname text)`)
-
-	// err = mdb.initMailboxIdTx(tx)
-	// if err != nil {
-	// 	goto out_rollback
-	// }
-
-	_, err = tx.Exec(`
-        create table if not exists lmdb_mailbox_join(
-            mailboxid integer,
-            messageid text,
-            foreign key(mailboxid) references lmdb_mailboxes,
-            foreign key(messageid) references lmdb_messages)`)
-
-	tx.Commit()
-
 	return mdb, nil
-
-out_rollback:
-	tx.Rollback()
-out_close:
-	db.Close()
-	return nil, err
 }
 
 func OpenMailDB(filename string) (*MailDB, error) {
+	return OpenMailDBContext(context.Background(), filename)
+}
+
+// OpenMailDBContext is like OpenMailDB, but takes a context.
+func OpenMailDBContext(ctx context.Context, filename string) (*MailDB, error) {
 	log.Printf("Opening database %s", filename)
 	db, err := sqlx.Open("sqlite3", "file:"+filename+"?_fk=true&mode=rwc")
 
@@ -172,7 +125,7 @@ func OpenMailDB(filename string) (*MailDB, error) {
 		return nil, fmt.Errorf("Opening database: %v", err)
 	}
 
-	return AttachMailDB(db)
+	return AttachMailDBContext(ctx, db)
 }
 
 func (mdb *MailDB) Close() {
@@ -208,7 +161,13 @@ func (mdb *MailDB) Close() {
 // when we're done.
 
 func (mdb *MailDB) IsMsgIdPresent(msgid string) (bool, error) {
-	rows, err := mdb.db.Query("select messageid from lmdb_messages where messageid = ?", msgid)
+	return mdb.IsMsgIdPresentContext(context.Background(), msgid)
+}
+
+// IsMsgIdPresentContext is like IsMsgIdPresent, but takes a context.
+func (mdb *MailDB) IsMsgIdPresentContext(ctx context.Context, msgid string) (bool, error) {
+	msgid = NormalizeMessageId(msgid)
+	rows, err := mdb.db.QueryContext(ctx, "select messageid from lmdb_messages where messageid = ?", msgid)
 	if err != nil {
 		return false, fmt.Errorf("Querying for messageid %v: %v", msgid, err)
 	}
@@ -270,6 +229,70 @@ func AddAddressTx(eq sqlx.Ext, addr *Address) (int, error) {
 	return addrid, nil
 }
 
+// Record the addresses in one part of a message's envelope.  addrs
+// may be nil.
+func addEnvelopePartTx(eq sqlx.Ext, messageId string, headerPart HeaderPart, addrlist []Address, addrs *addressCache) error {
+	for i := range addrlist {
+		addrId, ok := addrs.get(addrlist[i])
+		if !ok {
+			var err error
+			addrId, err = AddAddressTx(eq, &addrlist[i])
+			if err != nil {
+				return fmt.Errorf("Adding address: %w", err)
+			}
+			addrs.put(addrlist[i], addrId)
+		}
+		_, err := eq.Exec(`
+            insert into lmdb_envelopejoin(messageid, addressid, envelopepart)
+                values(?, ?, ?)`,
+			messageId, addrId,
+			headerPart)
+		if err != nil {
+			return fmt.Errorf("Inserting envelope join: %w", err)
+		}
+	}
+	return nil
+}
+
+// Migration helper: add the Sender of messages added before it was
+// recorded.  Messages whose Sender can't be parsed are skipped, as
+// AddMessage would have rejected them.
+func backfillSenderTx(eq sqlx.Ext) error {
+	rows, err := eq.Queryx(`select messageid, message from lmdb_messages`)
+	if err != nil {
+		return fmt.Errorf("Getting message list: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId, message string
+		if err := rows.Scan(&messageId, &message); err != nil {
+			return fmt.Errorf("Scanning message: %w", err)
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader([]byte(message)))
+		if err != nil {
+			continue
+		}
+
+		theiraddr, err := addressList(m.Header, headerPartFieldName[HeaderPartSender])
+		if err != nil {
+			continue
+		}
+
+		addrs, err := mailAddressToOurAddress(theiraddr)
+		if err != nil {
+			continue
+		}
+
+		if err := addEnvelopePartTx(eq, messageId, HeaderPartSender, addrs, nil); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 type Address struct {
 	PersonalName string
 	MailboxName  string
@@ -291,6 +314,17 @@ func convertAddress(in *mail.Address, out *Address) error {
 	return nil
 }
 
+// Like mail.Header.AddressList, but understanding encoded-words in
+// charsets other than utf-8 and iso-8859-1
+func addressList(h mail.Header, fieldName string) ([]*mail.Address, error) {
+	hdr := h.Get(fieldName)
+	if hdr == "" {
+		return nil, mail.ErrHeaderNotPresent
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	return parser.ParseList(hdr)
+}
+
 func mailAddressToOurAddress(in []*mail.Address) ([]Address, error) {
 	out := make([]Address, len(in))
 	for i := range in {
@@ -310,11 +344,15 @@ type Errno int
 const (
 	ErrMsgidPresent = Errno(iota)
 	ErrParseError
+	ErrDBVersion
+	ErrNoSearch
 )
 
 var errMessage = []string{
 	ErrMsgidPresent: "Message ID Present",
 	ErrParseError:   "Parsing message",
+	ErrDBVersion:    "Unsupported database version",
+	ErrNoSearch:     "Full-text search not available",
 }
 
 func (e Errno) Error() string {
@@ -353,11 +391,50 @@ func (e Error) Error() string {
 }
 
 func (mdb *MailDB) AddMessage(message []byte) error {
-	db := mdb.db
+	return mdb.AddMessageContext(context.Background(), message)
+}
 
+// AddMessageContext is like AddMessage, but takes a context.
+func (mdb *MailDB) AddMessageContext(ctx context.Context, message []byte) error {
+	pm, err := mdb.PrepareMessage(message)
+	if err != nil {
+		return err
+	}
+
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		return mdb.addMessageTx(eq, pm, nil)
+	})
+}
+
+// PreparedMessage is a message which has been parsed ready to be
+// added to the database; see BulkWriter.
+type PreparedMessage struct {
+	message    []byte
+	messageId  string
+	hash       string
+	subject    string
+	date       time.Time
+	inReplyTo  string
+	listId     string
+	envelope   map[HeaderPart][]Address
+	references []string
+	body       *MessageBody
+	search     *searchEntry
+}
+
+// MessageId returns the Message-ID the message will be recorded
+// under.
+func (pm *PreparedMessage) MessageId() string {
+	return pm.messageId
+}
+
+// PrepareMessage does everything needed to add a message which
+// doesn't involve the database, returning the same parse errors as
+// AddMessage would.  It's safe to call concurrently.
+func (mdb *MailDB) PrepareMessage(message []byte) (*PreparedMessage, error) {
 	m, err := mail.ReadMessage(bytes.NewReader(message))
 	if err != nil {
-		return ErrParseError.wrap(err)
+		return nil, ErrParseError.wrap(err)
 	}
 
 	envelope := map[HeaderPart][]Address{}
@@ -366,81 +443,177 @@ func (mdb *MailDB) AddMessage(message []byte) error {
 			continue
 		}
 
-		theiraddr, err := m.Header.AddressList(fieldName)
+		theiraddr, err := addressList(m.Header, fieldName)
 		if err != nil {
 			if err == mail.ErrHeaderNotPresent {
 				continue
 			}
-			return ErrParseError.wrap(fmt.Errorf("Getting address list for field %s: %w",
+			return nil, ErrParseError.wrap(fmt.Errorf("Getting address list for field %s: %w",
 				fieldName, err))
 		}
 
 		envelope[HeaderPart(part)], err = mailAddressToOurAddress(theiraddr)
 		if err != nil {
-			return fmt.Errorf("Converting addresses: %w", err)
+			return nil, fmt.Errorf("Converting addresses: %w", err)
 		}
 	}
 
-	messageId := m.Header.Get("Message-ID")
-	inReplyTo := m.Header.Get("In-Reply-To")
+	// Broken MIME structure isn't a reason to refuse the message;
+	// just store whatever we could make sense of.
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, ErrParseError.wrap(fmt.Errorf("Reading message body: %w", err))
+	}
+
+	hash := contentHash(m.Header, body)
+	messageId := messageIdFor(m.Header, hash)
+	// Normalised like References; only the first one counts
+	var inReplyTo string
+	if irt := parseMsgIdList(m.Header.Get("In-Reply-To")); len(irt) > 0 {
+		inReplyTo = irt[0]
+	}
+	references := parseReferences(m.Header, messageId)
+	listId := parseListId(m.Header.Get("List-Id"))
+	mb, err := parseMessageBody(textproto.MIMEHeader(m.Header), body)
+	if err != nil {
+		log.Printf("Decoding body of messageid %s: %v", messageId, err)
+	}
+
+	var search *searchEntry
+	if mdb.fts {
+		search = newSearchEntry(m, mb)
+	}
 	subject := m.Header.Get("Subject")
 	date, err := m.Header.Date()
 	if err != nil {
-		return ErrParseError.wrap(fmt.Errorf("Parsing message date: %w", err))
+		return nil, ErrParseError.wrap(fmt.Errorf("Parsing message date: %w", err))
 	}
 
-	err = txutil.TxLoopDb(db, func(eq sqlx.Ext) error {
-		// Uses function-wide tx and envelope variables.
-		// Defined here rather than below to allow the goto.
-		addressListHelper := func(addrlist []Address, headerPart HeaderPart) error {
-			for i := range addrlist {
-				addrId, err := AddAddressTx(eq, &addrlist[i])
-				if err != nil {
-					return fmt.Errorf("Adding address: %w", err)
-				}
-				_, err = eq.Exec(`
-            insert into lmdb_envelopejoin(messageid, addressid, envelopepart)
-                values(?, ?, ?)`,
-					messageId, addrId,
-					headerPart)
-				if err != nil {
-					return fmt.Errorf("Inserting envelope join: %w", err)
-				}
-			}
-			return nil
+	return &PreparedMessage{
+		message:    message,
+		messageId:  messageId,
+		hash:       hash,
+		subject:    subject,
+		date:       date,
+		inReplyTo:  inReplyTo,
+		listId:     listId,
+		envelope:   envelope,
+		references: references,
+		body:       mb,
+		search:     search,
+	}, nil
+}
+
+// Insert a prepared message.  addrs may be nil.
+func (mdb *MailDB) addMessageTx(eq sqlx.Ext, pm *PreparedMessage, addrs *addressCache) error {
+	// Insert message: msgid, body, date, inreplyto, size
+	// NB that automatic date conversion will give you a string instead of an integer
+	_, err := eq.Exec(`
+        insert into lmdb_messages(messageid, subject, date, message, inreplyto, size, listid, hash)
+            values (?, ?, ?, ?, ?, ?, nullif(?, ''), ?)`,
+		pm.messageId, pm.subject, pm.date,
+		pm.message, pm.inReplyTo, len(pm.message), pm.listId, pm.hash)
+	if err != nil {
+		if liteutil.IsErrorConstraintUnique(err) {
+			// A different message with the same Message-ID is kept
+			// as a variant; see msgid.go.
+			return addVariantTx(eq, pm)
+		} else {
+			return fmt.Errorf("Inserting message: %w", err)
 		}
+	}
 
-		// Insert message: msgid, body, date, inreplyto, size
-		// NB that automatic date conversion will give you a string instead of an integer
-		_, err = eq.Exec(`
-        insert into lmdb_messages(messageid, subject, date, message, inreplyto, size)
-            values (?, ?, ?, ?, ?, ?)`,
-			messageId, subject, date,
-			message, inReplyTo, len(message))
+	return mdb.addMessageDataTx(eq, pm, addrs)
+}
+
+// Record everything derived from a message which has just been
+// inserted (or replaced; see replaceMessageTx).  addrs may be nil.
+func (mdb *MailDB) addMessageDataTx(eq sqlx.Ext, pm *PreparedMessage, addrs *addressCache) error {
+	for part, list := range pm.envelope {
+		err := addEnvelopePartTx(eq, pm.messageId, part, list, addrs)
 		if err != nil {
-			if liteutil.IsErrorConstraintUnique(err) {
-				return ErrMsgidPresent.wrap(fmt.Errorf("Inserting messageid %s: %w", messageId, err))
-			} else {
-				return fmt.Errorf("Inserting message: %w", err)
-			}
+			return err
 		}
+	}
 
-		for part, list := range envelope {
-			err := addressListHelper(list, part)
-			if err != nil {
-				return err
-			}
-		}
+	if err := addReferencesTx(eq, pm.messageId, pm.references); err != nil {
+		return err
+	}
+
+	if err := addAttachmentsTx(eq, pm.messageId, pm.body.Attachments); err != nil {
+		return err
+	}
+
+	if err := addToListMailboxesTx(eq, pm.messageId, pm.listId); err != nil {
+		return err
+	}
+
+	return mdb.indexMessageTx(eq, pm.messageId, pm.search)
+}
+
+// RawMessageId returns the Message-ID of a raw RFC 5322 message, as
+// AddMessage would record it (normalised, or synthesised if it
+// hasn't got one).
+func RawMessageId(message []byte) (string, error) {
+	h, hash, err := rawContentHash(message)
+	if err != nil {
+		return "", err
+	}
+	return messageIdFor(h, hash), nil
+}
 
-		return nil
+// DeleteMessage removes a message, and everything recorded about it,
+// from the database (including mailbox membership).  Messages which
+// refer to it keep their references, so it will show up as a
+// placeholder in threads.  Deleting a message which isn't present is
+// not an error.
+func (mdb *MailDB) DeleteMessage(messageId string) error {
+	return mdb.DeleteMessageContext(context.Background(), messageId)
+}
+
+// DeleteMessageContext is like DeleteMessage, but takes a context.
+func (mdb *MailDB) DeleteMessageContext(ctx context.Context, messageId string) error {
+	messageId = NormalizeMessageId(messageId)
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		return mdb.deleteMessageTx(eq, messageId)
 	})
+}
+
+func (mdb *MailDB) deleteMessageTx(eq sqlx.Ext, messageId string) error {
+	for _, table := range []string{
+		"lmdb_envelopejoin",
+		"lmdb_references",
+		"lmdb_attachments",
+		"lmdb_mailbox_flags",
+		"lmdb_mailbox_join",
+		"lmdb_message_variants",
+	} {
+		_, err := eq.Exec(`delete from `+table+` where messageid=?`, messageId)
+		if err != nil {
+			return fmt.Errorf("Deleting messageid %s from %s: %w", messageId, table, err)
+		}
+	}
 
-	return err
+	if err := mdb.unindexMessageTx(eq, messageId); err != nil {
+		return err
+	}
+
+	_, err := eq.Exec(`delete from lmdb_messages where messageid=?`, messageId)
+	if err != nil {
+		return fmt.Errorf("Deleting messageid %s: %w", messageId, err)
+	}
+
+	return nil
 }
 
 // Replace mailbox messageid list with the messageids
 func (mdb *MailDB) UpdateMailbox(mailboxname string, messageIds []string) error {
-	return txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+	return mdb.UpdateMailboxContext(context.Background(), mailboxname, messageIds)
+}
+
+// UpdateMailboxContext is like UpdateMailbox, but takes a context.
+func (mdb *MailDB) UpdateMailboxContext(ctx context.Context, mailboxname string, messageIds []string) error {
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
 		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
 		if err != nil || mboxId == 0 {
 			return fmt.Errorf("Couldn't get mailbox id for mailbox %s!", mailboxname)
@@ -456,6 +629,7 @@ func (mdb *MailDB) UpdateMailbox(mailboxname string, messageIds []string) error
 
 		// Then insert new message IDs one by one, warning on errors
 		for _, messageId := range messageIds {
+			messageId = NormalizeMessageId(messageId)
 			_, err = eq.Exec(`insert into lmdb_mailbox_join(mailboxid, messageid) values(?, ?)`,
 				mboxId, messageId)
 			if err != nil {
@@ -474,6 +648,6 @@ func (mdb *MailDB) UpdateMailbox(mailboxname string, messageIds []string) error
 			}
 		}
 
-		return nil
+		return pruneFlagsTx(eq, mboxId)
 	})
 }
@@ -0,0 +1,210 @@
+package localmaildb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Flags belong to a message's membership of a mailbox, as in IMAP:
+// the same message may be read in one mailbox and not another.  They
+// use IMAP's names; system flags start with a backslash, and anything
+// else is a keyword.  A message's flags go when it leaves the mailbox.
+
+const (
+	FlagSeen     = `\Seen`
+	FlagAnswered = `\Answered`
+	FlagFlagged  = `\Flagged`
+	FlagDeleted  = `\Deleted`
+	FlagDraft    = `\Draft`
+)
+
+// Replace the flags of a message in a mailbox.  Does nothing if the
+// message isn't in the mailbox.
+func setFlagsTx(eq sqlx.Ext, mboxId int, messageId string, flags []string) error {
+	_, err := eq.Exec(`delete from lmdb_mailbox_flags where mailboxid=? and messageid=?`,
+		mboxId, messageId)
+	if err != nil {
+		return fmt.Errorf("Clearing flags of %s: %w", messageId, err)
+	}
+
+	for _, flag := range flags {
+		_, err := eq.Exec(`
+        insert into lmdb_mailbox_flags(mailboxid, messageid, flag)
+            select ?, ?, ? where exists
+                (select 1 from lmdb_mailbox_join where mailboxid=? and messageid=?)
+            on conflict do nothing`,
+			mboxId, messageId, flag, mboxId, messageId)
+		if err != nil {
+			return fmt.Errorf("Setting flag %s on %s: %w", flag, messageId, err)
+		}
+	}
+
+	return nil
+}
+
+// Remove the flags of messages which have left the mailbox
+func pruneFlagsTx(eq sqlx.Ext, mboxId int) error {
+	_, err := eq.Exec(`
+        delete from lmdb_mailbox_flags
+            where mailboxid=?
+              and messageid not in (select messageid from lmdb_mailbox_join where mailboxid=?)`,
+		mboxId, mboxId)
+	if err != nil {
+		return fmt.Errorf("Removing stale flags: %w", err)
+	}
+	return nil
+}
+
+// SetFlags replaces the flags of a message in a mailbox.  It does
+// nothing if the message isn't in the mailbox.
+func (mdb *MailDB) SetFlags(mailboxname, messageId string, flags []string) error {
+	return mdb.SetFlagsContext(context.Background(), mailboxname, messageId, flags)
+}
+
+// SetFlagsContext is like SetFlags, but takes a context.
+func (mdb *MailDB) SetFlagsContext(ctx context.Context, mailboxname, messageId string, flags []string) error {
+	messageId = NormalizeMessageId(messageId)
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+		return setFlagsTx(eq, mboxId, messageId, flags)
+	})
+}
+
+// GetFlags returns the flags of a message in a mailbox, sorted.
+func (mdb *MailDB) GetFlags(mailboxname, messageId string) ([]string, error) {
+	return mdb.GetFlagsContext(context.Background(), mailboxname, messageId)
+}
+
+// GetFlagsContext is like GetFlags, but takes a context.
+func (mdb *MailDB) GetFlagsContext(ctx context.Context, mailboxname, messageId string) ([]string, error) {
+	messageId = NormalizeMessageId(messageId)
+	var flags []string
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		flags = nil
+		return sqlx.Select(eq, &flags, `
+        select flag from lmdb_mailbox_flags where mailboxid=? and messageid=?`,
+			mboxId, messageId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(flags)
+	return flags, nil
+}
+
+func getMessagesByFlagTx(eq sqlx.Ext, mailboxname, flag string, with bool) ([]*MessageTree, error) {
+	mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+	}
+
+	not := "not"
+	if with {
+		not = ""
+	}
+
+	rows, err := eq.Queryx(`
+        select `+messageColumns+`
+            from lmdb_messages as self
+            where self.messageid in
+                (select messageid from lmdb_mailbox_join where mailboxid=?)
+              and self.messageid `+not+` in
+                (select messageid from lmdb_mailbox_flags where mailboxid=? and flag=?)`,
+		mboxId, mboxId, flag)
+	if err != nil {
+		return nil, fmt.Errorf("Getting messages by flag in mailbox %s: %w", mailboxname, err)
+	}
+
+	return scanMessageList(eq, rows)
+}
+
+// GetMessagesWithFlag returns the messages in the mailbox which have
+// the flag there, oldest first, without their replies.
+func (mdb *MailDB) GetMessagesWithFlag(mailboxname, flag string) ([]*MessageTree, error) {
+	return mdb.GetMessagesWithFlagContext(context.Background(), mailboxname, flag)
+}
+
+// GetMessagesWithFlagContext is like GetMessagesWithFlag, but takes a context.
+func (mdb *MailDB) GetMessagesWithFlagContext(ctx context.Context, mailboxname, flag string) ([]*MessageTree, error) {
+	var messages []*MessageTree
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		var err error
+		messages, err = getMessagesByFlagTx(eq, mailboxname, flag, true)
+		return err
+	})
+	return messages, err
+}
+
+// GetMessagesWithoutFlag returns the messages in the mailbox which
+// don't have the flag there; e.g., with FlagSeen, the unread ones.
+func (mdb *MailDB) GetMessagesWithoutFlag(mailboxname, flag string) ([]*MessageTree, error) {
+	return mdb.GetMessagesWithoutFlagContext(context.Background(), mailboxname, flag)
+}
+
+// GetMessagesWithoutFlagContext is like GetMessagesWithoutFlag, but takes a context.
+func (mdb *MailDB) GetMessagesWithoutFlagContext(ctx context.Context, mailboxname, flag string) ([]*MessageTree, error) {
+	var messages []*MessageTree
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		var err error
+		messages, err = getMessagesByFlagTx(eq, mailboxname, flag, false)
+		return err
+	})
+	return messages, err
+}
+
+// GetUnreadThreads returns the message ids of the messages in the
+// mailbox without FlagSeen, and of everything they refer to.  So a
+// thread root returned by GetMessageRoots (placeholder or not) is in
+// the set if and only if its thread has unread messages.
+func (mdb *MailDB) GetUnreadThreads(mailboxname string) (map[string]bool, error) {
+	return mdb.GetUnreadThreadsContext(context.Background(), mailboxname)
+}
+
+// GetUnreadThreadsContext is like GetUnreadThreads, but takes a context.
+func (mdb *MailDB) GetUnreadThreadsContext(ctx context.Context, mailboxname string) (map[string]bool, error) {
+	var ids []string
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		ids = nil
+		return sqlx.Select(eq, &ids, `
+        WITH RECURSIVE
+            ancestor(messageid) AS
+                (select messageid
+                     from lmdb_mailbox_join
+                     where mailboxid=?
+                       and messageid not in
+                         (select messageid from lmdb_mailbox_flags
+                              where mailboxid=? and flag=?)
+                 union
+                 select lmdb_references.refid
+                     from lmdb_references join ancestor using(messageid))
+        select messageid from ancestor`, mboxId, mboxId, FlagSeen)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	unread := map[string]bool{}
+	for _, id := range ids {
+		unread[id] = true
+	}
+	return unread, nil
+}
@@ -0,0 +1,185 @@
+package localmaildb
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "flags-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	for i, msgid := range []string{"<a@x>", "<b@x>"} {
+		if err := mdb.AddMessage(testMessage(msgid, i+1)); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	for _, mbox := range []string{"one", "two"} {
+		if err := mdb.CreateMailbox(mbox); err != nil {
+			t.Fatalf("Creating mailbox: %v", err)
+		}
+	}
+	if err := mdb.UpdateMailbox("one", []string{"<a@x>", "<b@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("two", []string{"<a@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+
+	check := func(what, mbox, msgid string, want []string) {
+		t.Helper()
+		flags, err := mdb.GetFlags(mbox, msgid)
+		if err != nil {
+			t.Fatalf("%s: Getting flags: %v", what, err)
+		}
+		if len(flags) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(flags, want) {
+			t.Errorf("ERROR: %s: %s in %s has flags %v, wanted %v", what, msgid, mbox, flags, want)
+		}
+	}
+
+	set := func(mbox, msgid string, flags ...string) {
+		t.Helper()
+		if err := mdb.SetFlags(mbox, msgid, flags); err != nil {
+			t.Fatalf("Setting flags: %v", err)
+		}
+	}
+
+	set("one", "<a@x>", FlagSeen, FlagFlagged, FlagSeen)
+	set("two", "<a@x>", "$Label1")
+	set("two", "<b@x>", FlagSeen) // Not in the mailbox, so ignored
+
+	check("initial", "one", "<a@x>", []string{FlagFlagged, FlagSeen})
+	check("initial", "one", "<b@x>", nil)
+	check("initial", "two", "<a@x>", []string{"$Label1"})
+	check("initial", "two", "<b@x>", nil)
+
+	set("one", "<a@x>", FlagAnswered)
+	check("replaced", "one", "<a@x>", []string{FlagAnswered})
+
+	// Flags go when the message leaves the mailbox, and don't come
+	// back with it
+	if err := mdb.UpdateMailbox("two", []string{"<b@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("two", []string{"<a@x>", "<b@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	check("after removal", "two", "<a@x>", nil)
+
+	if err := mdb.DeleteMessage("<a@x>"); err != nil {
+		t.Fatalf("Deleting message: %v", err)
+	}
+	check("after delete", "one", "<a@x>", nil)
+}
+
+func TestFlagQueries(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "flags-query-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	// Two threads: a <- b, and c
+	for i, m := range [][]byte{
+		testMessage("<a@x>", 1),
+		testMessage("<b@x>", 2, "In-Reply-To: <a@x>\r\nReferences: <a@x>\r\n"),
+		testMessage("<c@x>", 3),
+	} {
+		if err := mdb.AddMessage(m); err != nil {
+			t.Fatalf("Adding message %d: %v", i, err)
+		}
+	}
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+
+	state := MailboxSyncState{UidValidity: 1, LastUid: 3, HighestModSeq: 17}
+	err = mdb.ApplyMailboxUpdate("test", &MailboxUpdate{
+		State: state,
+		Reset: true,
+		Added: []MailboxEntry{{1, "<a@x>"}, {2, "<b@x>"}, {3, "<c@x>"}},
+		Flags: map[uint32][]string{
+			1: {FlagSeen},
+			2: {FlagSeen, FlagFlagged},
+			3: {},
+			4: {FlagSeen}, // Not in the mailbox
+		},
+	})
+	if err != nil {
+		t.Fatalf("Applying update: %v", err)
+	}
+
+	if got, err := mdb.GetSyncState("test"); err != nil {
+		t.Fatalf("Getting sync state: %v", err)
+	} else if got != state {
+		t.Errorf("ERROR: got state %+v, wanted %+v", got, state)
+	}
+
+	ids := func(messages []*MessageTree, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Getting messages: %v", err)
+		}
+		ids := []string{}
+		for _, m := range messages {
+			ids = append(ids, m.Envelope.MessageId)
+		}
+		return ids
+	}
+	checkUnread := func(what string, want map[string]bool) {
+		t.Helper()
+		unread, err := mdb.GetUnreadThreads("test")
+		if err != nil {
+			t.Fatalf("%s: Getting unread threads: %v", what, err)
+		}
+		if !reflect.DeepEqual(unread, want) {
+			t.Errorf("ERROR: %s: got unread %v, wanted %v", what, unread, want)
+		}
+	}
+
+	if got, want := ids(mdb.GetMessagesWithFlag("test", FlagSeen)), []string{"<a@x>", "<b@x>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: seen: got %v, wanted %v", got, want)
+	}
+	if got, want := ids(mdb.GetMessagesWithFlag("test", FlagFlagged)), []string{"<b@x>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: flagged: got %v, wanted %v", got, want)
+	}
+	if got, want := ids(mdb.GetMessagesWithoutFlag("test", FlagSeen)), []string{"<c@x>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: unseen: got %v, wanted %v", got, want)
+	}
+	checkUnread("initial", map[string]bool{"<c@x>": true})
+
+	// Only the flags mentioned change
+	err = mdb.ApplyMailboxUpdate("test", &MailboxUpdate{
+		State: state,
+		Flags: map[uint32][]string{2: {}},
+	})
+	if err != nil {
+		t.Fatalf("Applying flag update: %v", err)
+	}
+	check := func(msgid string, want []string) {
+		t.Helper()
+		flags, err := mdb.GetFlags("test", msgid)
+		if err != nil {
+			t.Fatalf("Getting flags: %v", err)
+		}
+		if len(flags) != 0 || len(want) != 0 {
+			if !reflect.DeepEqual(flags, want) {
+				t.Errorf("ERROR: %s has flags %v, wanted %v", msgid, flags, want)
+			}
+		}
+	}
+	check("<a@x>", []string{FlagSeen})
+	check("<b@x>", nil)
+	checkUnread("reply unread", map[string]bool{"<a@x>": true, "<b@x>": true, "<c@x>": true})
+}
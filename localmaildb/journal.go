@@ -0,0 +1,315 @@
+package localmaildb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Changes made locally (by ChangeFlags and MoveMessage) to mailboxes
+// synced with UIDs are recorded in a journal, so that the source can
+// make the same changes on the server the next time it syncs.  Once
+// it has, it deletes the entries with DeleteJournalEntries.  Changes
+// to other mailboxes are only made locally.
+
+type JournalOp string
+
+const (
+	JournalAddFlag    = JournalOp("add-flag")
+	JournalRemoveFlag = JournalOp("remove-flag")
+	JournalMove       = JournalOp("move")
+)
+
+// JournalEntry is a change waiting to be made on the server.
+type JournalEntry struct {
+	Id        int64
+	MessageId string
+	Op        JournalOp
+	Flag      string // For JournalAddFlag and JournalRemoveFlag
+	Dest      string // For JournalMove: the mailbox to move to
+
+	// The message's UID, and the UIDVALIDITY it belongs to.  Uid is
+	// 0 if the message hasn't been synced yet.
+	Uid, UidValidity uint32
+
+	// The mailbox's HighestModSeq when the change was made.  If the
+	// message has changed on the server since, there may be a
+	// conflict.
+	ModSeq uint64
+}
+
+// Record a change to a message in a mailbox, if the mailbox is synced
+// with UIDs.  A flag change which undoes one still waiting just
+// cancels it.
+func journalTx(eq sqlx.Ext, mboxId int, messageId string, op JournalOp, arg string) error {
+	var state MailboxSyncState
+	err := sqlx.Get(eq, &state, `
+        select uidvalidity, lastuid, highestmodseq from lmdb_mailbox_sync where mailboxid=?`, mboxId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Getting mailbox sync state: %w", err)
+	}
+
+	if op != JournalMove {
+		undo := JournalAddFlag
+		if op == JournalAddFlag {
+			undo = JournalRemoveFlag
+		}
+		res, err := eq.Exec(`
+        delete from lmdb_journal
+            where mailboxid=? and messageid=? and op=? and arg=?`,
+			mboxId, messageId, undo, arg)
+		if err != nil {
+			return fmt.Errorf("Cancelling journal entry: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			return nil
+		}
+	}
+
+	_, err = eq.Exec(`
+        insert into lmdb_journal(mailboxid, messageid, op, arg, uidvalidity, uid, modseq)
+            values(?, ?, ?, ?, ?,
+                   (select uid from lmdb_mailbox_join
+                        where mailboxid=? and messageid=? and uid is not null),
+                   ?)`,
+		mboxId, messageId, op, arg, state.UidValidity,
+		mboxId, messageId, state.HighestModSeq)
+	if err != nil {
+		return fmt.Errorf("Adding journal entry: %w", err)
+	}
+	return nil
+}
+
+// Make the flag changes to a message still waiting in the journal
+// again, after its local flags have been replaced by the server's
+func reapplyJournalTx(eq sqlx.Ext, mboxId int, messageId string) error {
+	_, err := eq.Exec(`
+        insert into lmdb_mailbox_flags(mailboxid, messageid, flag)
+            select mailboxid, messageid, arg from lmdb_journal
+                where mailboxid=? and messageid=? and op=?
+            on conflict do nothing`,
+		mboxId, messageId, JournalAddFlag)
+	if err != nil {
+		return fmt.Errorf("Reapplying local flag changes: %w", err)
+	}
+
+	_, err = eq.Exec(`
+        delete from lmdb_mailbox_flags
+            where mailboxid=? and messageid=?
+              and flag in (select arg from lmdb_journal
+                               where mailboxid=? and messageid=? and op=?)`,
+		mboxId, messageId, mboxId, messageId, JournalRemoveFlag)
+	if err != nil {
+		return fmt.Errorf("Reapplying local flag changes: %w", err)
+	}
+
+	return nil
+}
+
+// Remove changes to messages which have left the mailbox before
+// they were synced; there's nothing to make them to.
+func pruneJournalTx(eq sqlx.Ext, mboxId int) error {
+	_, err := eq.Exec(`
+        delete from lmdb_journal
+            where mailboxid=? and uid is null
+              and messageid not in (select messageid from lmdb_mailbox_join where mailboxid=?)`,
+		mboxId, mboxId)
+	if err != nil {
+		return fmt.Errorf("Removing stale journal entries: %w", err)
+	}
+	return nil
+}
+
+// ChangeFlags adds and removes flags of a message in a mailbox, and
+// records the changes in the journal to be made on the server.  (As
+// opposed to SetFlags, which is for sources recording the server's
+// flags.)  It does nothing if the message isn't in the mailbox.
+func (mdb *MailDB) ChangeFlags(mailboxname, messageId string, add, remove []string) error {
+	return mdb.ChangeFlagsContext(context.Background(), mailboxname, messageId, add, remove)
+}
+
+// ChangeFlagsContext is like ChangeFlags, but takes a context.
+func (mdb *MailDB) ChangeFlagsContext(ctx context.Context, mailboxname, messageId string, add, remove []string) error {
+	messageId = NormalizeMessageId(messageId)
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		var member bool
+		err = sqlx.Get(eq, &member, `
+        select exists(select 1 from lmdb_mailbox_join where mailboxid=? and messageid=?)`,
+			mboxId, messageId)
+		if err != nil {
+			return fmt.Errorf("Checking mailbox membership: %w", err)
+		}
+		if !member {
+			return nil
+		}
+
+		change := func(op JournalOp, flag, query string) error {
+			res, err := eq.Exec(query, mboxId, messageId, flag)
+			if err != nil {
+				return fmt.Errorf("Changing flag %s on %s: %w", flag, messageId, err)
+			}
+			// Only changes which change something need recording
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				return err
+			}
+			return journalTx(eq, mboxId, messageId, op, flag)
+		}
+
+		for _, flag := range add {
+			err := change(JournalAddFlag, flag, `
+            insert into lmdb_mailbox_flags(mailboxid, messageid, flag) values(?, ?, ?)
+                on conflict do nothing`)
+			if err != nil {
+				return err
+			}
+		}
+		for _, flag := range remove {
+			err := change(JournalRemoveFlag, flag, `
+            delete from lmdb_mailbox_flags where mailboxid=? and messageid=? and flag=?`)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// MoveMessage moves a message from one mailbox to another, keeping
+// its flags, and records the move in the journal of the mailbox it
+// came from.  Moves between mailboxes of different sources can't be
+// made on the server.
+func (mdb *MailDB) MoveMessage(from, to, messageId string) error {
+	return mdb.MoveMessageContext(context.Background(), from, to, messageId)
+}
+
+// MoveMessageContext is like MoveMessage, but takes a context.
+func (mdb *MailDB) MoveMessageContext(ctx context.Context, from, to, messageId string) error {
+	messageId = NormalizeMessageId(messageId)
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		fromId, err := mailboxNameToIdTx(eq, from)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", from, err)
+		}
+		toId, err := mailboxNameToIdTx(eq, to)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", to, err)
+		}
+
+		var member bool
+		err = sqlx.Get(eq, &member, `
+        select exists(select 1 from lmdb_mailbox_join where mailboxid=? and messageid=?)`,
+			fromId, messageId)
+		if err != nil {
+			return fmt.Errorf("Checking mailbox membership: %w", err)
+		}
+		if !member {
+			return fmt.Errorf("Message %s isn't in mailbox %s", messageId, from)
+		}
+
+		if err := addToMailboxTx(eq, toId, messageId); err != nil {
+			return err
+		}
+		_, err = eq.Exec(`
+        insert into lmdb_mailbox_flags(mailboxid, messageid, flag)
+            select ?, messageid, flag from lmdb_mailbox_flags
+                where mailboxid=? and messageid=?
+            on conflict do nothing`,
+			toId, fromId, messageId)
+		if err != nil {
+			return fmt.Errorf("Copying flags of %s: %w", messageId, err)
+		}
+
+		if err := journalTx(eq, fromId, messageId, JournalMove, to); err != nil {
+			return err
+		}
+
+		return removeFromMailboxTx(eq, fromId, messageId)
+	})
+}
+
+// GetJournal returns the changes waiting to be made to the mailbox on
+// the server, oldest first.
+func (mdb *MailDB) GetJournal(mailboxname string) ([]JournalEntry, error) {
+	return mdb.GetJournalContext(context.Background(), mailboxname)
+}
+
+// GetJournalContext is like GetJournal, but takes a context.
+func (mdb *MailDB) GetJournalContext(ctx context.Context, mailboxname string) ([]JournalEntry, error) {
+	var entries []JournalEntry
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		// Messages which weren't synced when the change was made
+		// may have been since
+		rows, err := eq.Queryx(`
+        select j.id, j.messageid, j.op, j.arg, j.modseq,
+               coalesce(j.uid,
+                        (select uid from lmdb_mailbox_join as m
+                             where m.mailboxid = j.mailboxid and m.messageid = j.messageid
+                               and m.uid is not null),
+                        0),
+               case when j.uid is null then s.uidvalidity else j.uidvalidity end
+            from lmdb_journal as j
+                join lmdb_mailbox_sync as s on s.mailboxid = j.mailboxid
+            where j.mailboxid=?
+            order by j.id`, mboxId)
+		if err != nil {
+			return fmt.Errorf("Getting journal: %w", err)
+		}
+		defer rows.Close()
+
+		entries = nil
+		for rows.Next() {
+			var e JournalEntry
+			var arg string
+			err := rows.Scan(&e.Id, &e.MessageId, &e.Op, &arg, &e.ModSeq, &e.Uid, &e.UidValidity)
+			if err != nil {
+				return fmt.Errorf("Scanning journal: %w", err)
+			}
+			if e.Op == JournalMove {
+				e.Dest = arg
+			} else {
+				e.Flag = arg
+			}
+			entries = append(entries, e)
+		}
+		return rows.Err()
+	})
+
+	return entries, err
+}
+
+// DeleteJournalEntries removes entries from the journal, once the
+// changes have been made on the server (or can't be).
+func (mdb *MailDB) DeleteJournalEntries(ids []int64) error {
+	return mdb.DeleteJournalEntriesContext(context.Background(), ids)
+}
+
+// DeleteJournalEntriesContext is like DeleteJournalEntries, but takes a context.
+func (mdb *MailDB) DeleteJournalEntriesContext(ctx context.Context, ids []int64) error {
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		for _, id := range ids {
+			if _, err := eq.Exec(`delete from lmdb_journal where id=?`, id); err != nil {
+				return fmt.Errorf("Deleting journal entry %d: %w", id, err)
+			}
+		}
+		return nil
+	})
+}
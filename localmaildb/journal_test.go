@@ -0,0 +1,164 @@
+package localmaildb
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "journal-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	for i, msgid := range []string{"<a@x>", "<b@x>", "<c@x>"} {
+		if err := mdb.AddMessage(testMessage(msgid, i+1)); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	for _, mbox := range []string{"inbox", "archive", "local"} {
+		if err := mdb.CreateMailbox(mbox); err != nil {
+			t.Fatalf("Creating mailbox: %v", err)
+		}
+	}
+
+	// inbox and archive are synced with UIDs; local isn't
+	for _, mbox := range []string{"inbox", "archive"} {
+		err = mdb.ApplyMailboxUpdate(mbox, &MailboxUpdate{
+			State: MailboxSyncState{UidValidity: 1, LastUid: 2, HighestModSeq: 10},
+			Reset: true,
+		})
+		if err != nil {
+			t.Fatalf("Applying update: %v", err)
+		}
+	}
+	err = mdb.ApplyMailboxUpdate("inbox", &MailboxUpdate{
+		State: MailboxSyncState{UidValidity: 1, LastUid: 2, HighestModSeq: 10},
+		Added: []MailboxEntry{{1, "<a@x>"}, {2, "<b@x>"}},
+		Flags: map[uint32][]string{1: {FlagSeen}},
+	})
+	if err != nil {
+		t.Fatalf("Applying update: %v", err)
+	}
+	if err := mdb.UpdateMailbox("local", []string{"<c@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+
+	checkJournal := func(what, mbox string, want []JournalEntry) {
+		t.Helper()
+		entries, err := mdb.GetJournal(mbox)
+		if err != nil {
+			t.Fatalf("%s: Getting journal: %v", what, err)
+		}
+		for i := range entries {
+			entries[i].Id = 0
+		}
+		if len(entries) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("ERROR: %s: got journal %+v, wanted %+v", what, entries, want)
+		}
+	}
+	checkFlags := func(what, mbox, msgid string, want []string) {
+		t.Helper()
+		flags, err := mdb.GetFlags(mbox, msgid)
+		if err != nil {
+			t.Fatalf("%s: Getting flags: %v", what, err)
+		}
+		if len(flags) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(flags, want) {
+			t.Errorf("ERROR: %s: %s in %s has flags %v, wanted %v", what, msgid, mbox, flags, want)
+		}
+	}
+	change := func(mbox, msgid string, add, remove []string) {
+		t.Helper()
+		if err := mdb.ChangeFlags(mbox, msgid, add, remove); err != nil {
+			t.Fatalf("Changing flags: %v", err)
+		}
+	}
+
+	entry := func(msgid string, op JournalOp, flag string, uid uint32) JournalEntry {
+		return JournalEntry{MessageId: msgid, Op: op, Flag: flag, Uid: uid, UidValidity: 1, ModSeq: 10}
+	}
+
+	// Only actual changes are recorded
+	change("inbox", "<a@x>", []string{FlagSeen, FlagFlagged}, nil)
+	change("inbox", "<b@x>", []string{FlagSeen}, []string{FlagFlagged})
+	change("local", "<c@x>", []string{FlagSeen}, nil)
+	checkFlags("changed", "inbox", "<a@x>", []string{FlagFlagged, FlagSeen})
+	checkFlags("changed", "local", "<c@x>", []string{FlagSeen})
+	checkJournal("changed", "inbox", []JournalEntry{
+		entry("<a@x>", JournalAddFlag, FlagFlagged, 1),
+		entry("<b@x>", JournalAddFlag, FlagSeen, 2),
+	})
+	checkJournal("changed", "local", nil)
+
+	// Undoing a change cancels it
+	change("inbox", "<b@x>", nil, []string{FlagSeen})
+	checkJournal("undone", "inbox", []JournalEntry{
+		entry("<a@x>", JournalAddFlag, FlagFlagged, 1),
+	})
+
+	// The server's flags don't undo local changes not yet made there
+	err = mdb.ApplyMailboxUpdate("inbox", &MailboxUpdate{
+		State: MailboxSyncState{UidValidity: 1, LastUid: 2, HighestModSeq: 11},
+		Flags: map[uint32][]string{1: {FlagSeen, FlagAnswered}},
+	})
+	if err != nil {
+		t.Fatalf("Applying update: %v", err)
+	}
+	checkFlags("server update", "inbox", "<a@x>", []string{FlagAnswered, FlagFlagged, FlagSeen})
+
+	if err := mdb.MoveMessage("inbox", "archive", "<a@x>"); err != nil {
+		t.Fatalf("Moving message: %v", err)
+	}
+	checkFlags("moved", "inbox", "<a@x>", nil)
+	checkFlags("moved", "archive", "<a@x>", []string{FlagAnswered, FlagFlagged, FlagSeen})
+	move := entry("<a@x>", JournalMove, "", 1)
+	move.Dest, move.ModSeq = "archive", 11
+	checkJournal("moved", "inbox", []JournalEntry{
+		entry("<a@x>", JournalAddFlag, FlagFlagged, 1),
+		move,
+	})
+
+	if err := mdb.MoveMessage("inbox", "archive", "<c@x>"); err == nil {
+		t.Errorf("ERROR: moving a message not in the mailbox succeeded")
+	}
+
+	// A change to a message not synced yet gets its UID once it is
+	change("archive", "<a@x>", nil, []string{FlagSeen})
+	checkJournal("unsynced", "archive", []JournalEntry{
+		{MessageId: "<a@x>", Op: JournalRemoveFlag, Flag: FlagSeen, UidValidity: 1, ModSeq: 10},
+	})
+	err = mdb.ApplyMailboxUpdate("archive", &MailboxUpdate{
+		State: MailboxSyncState{UidValidity: 1, LastUid: 7, HighestModSeq: 12},
+		Added: []MailboxEntry{{7, "<a@x>"}},
+	})
+	if err != nil {
+		t.Fatalf("Applying update: %v", err)
+	}
+	checkJournal("synced", "archive", []JournalEntry{
+		{MessageId: "<a@x>", Op: JournalRemoveFlag, Flag: FlagSeen, Uid: 7, UidValidity: 1, ModSeq: 10},
+	})
+	if uids, err := mdb.GetMailboxUids("archive"); err != nil {
+		t.Fatalf("Getting uids: %v", err)
+	} else if !reflect.DeepEqual(uids, []uint32{7}) {
+		t.Errorf("ERROR: archive has uids %v, wanted [7]", uids)
+	}
+
+	entries, err := mdb.GetJournal("inbox")
+	if err != nil {
+		t.Fatalf("Getting journal: %v", err)
+	}
+	if err := mdb.DeleteJournalEntries([]int64{entries[0].Id, entries[1].Id}); err != nil {
+		t.Fatalf("Deleting journal entries: %v", err)
+	}
+	checkJournal("deleted", "inbox", nil)
+}
@@ -0,0 +1,359 @@
+package localmaildb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Incremental synchronisation of mailbox membership, for sources
+// (like IMAP) which give each message in a mailbox a UID, and
+// invalidate all UIDs at once by changing a "UID validity" value.
+
+// MailboxSyncState is what a source needs to remember between syncs
+// of a mailbox.  The zero value means the mailbox has never been
+// synced with UIDs.
+type MailboxSyncState struct {
+	UidValidity uint32
+	LastUid     uint32 // Highest UID seen in the last sync
+
+	// For sources which support it (IMAP CONDSTORE), the highest
+	// modification sequence whose flag changes have been recorded;
+	// 0 if unknown.
+	HighestModSeq uint64
+}
+
+type MailboxEntry struct {
+	Uid       uint32
+	MessageId string
+}
+
+// MailboxUpdate describes a change to the membership of a mailbox.
+type MailboxUpdate struct {
+	State MailboxSyncState // The new sync state
+
+	// Remove all existing membership before applying the rest of the
+	// update; e.g., because UIDVALIDITY changed.
+	Reset bool
+
+	Added   []MailboxEntry
+	Removed []uint32 // UIDs no longer in the mailbox
+
+	// New flags, by UID, for messages added or already in the
+	// mailbox.  Messages not mentioned keep the flags they had.
+	// Local changes still in the journal are made again on top.
+	Flags map[uint32][]string
+}
+
+// GetSyncState returns the sync state recorded by the last call to
+// ApplyMailboxUpdate for the mailbox.
+func (mdb *MailDB) GetSyncState(mailboxname string) (MailboxSyncState, error) {
+	return mdb.GetSyncStateContext(context.Background(), mailboxname)
+}
+
+// GetSyncStateContext is like GetSyncState, but takes a context.
+func (mdb *MailDB) GetSyncStateContext(ctx context.Context, mailboxname string) (MailboxSyncState, error) {
+	var state MailboxSyncState
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		err = sqlx.Get(eq, &state, `
+        select uidvalidity, lastuid, highestmodseq from lmdb_mailbox_sync where mailboxid=?`, mboxId)
+		if errors.Is(err, sql.ErrNoRows) {
+			state = MailboxSyncState{}
+			return nil
+		}
+		return err
+	})
+
+	return state, err
+}
+
+// GetMailboxUids returns the UIDs of all messages recorded as being
+// in the mailbox.
+func (mdb *MailDB) GetMailboxUids(mailboxname string) ([]uint32, error) {
+	return mdb.GetMailboxUidsContext(context.Background(), mailboxname)
+}
+
+// GetMailboxUidsContext is like GetMailboxUids, but takes a context.
+func (mdb *MailDB) GetMailboxUidsContext(ctx context.Context, mailboxname string) ([]uint32, error) {
+	var uids []uint32
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		uids = nil
+		return sqlx.Select(eq, &uids, `
+        select uid from lmdb_mailbox_join
+            where mailboxid=? and uid is not null
+            order by uid`, mboxId)
+	})
+
+	return uids, err
+}
+
+// ApplyMailboxUpdate changes the membership and sync state of a
+// mailbox in a single transaction.  Added messages which aren't in
+// the database (e.g., because fetching the body failed) are skipped
+// with a warning; since they won't be returned by GetMailboxUids,
+// the source can try them again next time.
+func (mdb *MailDB) ApplyMailboxUpdate(mailboxname string, update *MailboxUpdate) error {
+	return mdb.ApplyMailboxUpdateContext(context.Background(), mailboxname, update)
+}
+
+// ApplyMailboxUpdateContext is like ApplyMailboxUpdate, but takes a context.
+func (mdb *MailDB) ApplyMailboxUpdateContext(ctx context.Context, mailboxname string, update *MailboxUpdate) error {
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		if update.Reset {
+			_, err = eq.Exec(`delete from lmdb_mailbox_join where mailboxid = ?`, mboxId)
+			if err != nil {
+				return fmt.Errorf("Deleting old mailbox entries: %w", err)
+			}
+		}
+
+		for _, uid := range update.Removed {
+			_, err = eq.Exec(`delete from lmdb_mailbox_join where mailboxid = ? and uid = ?`,
+				mboxId, uid)
+			if err != nil {
+				return fmt.Errorf("Deleting mailbox entry for uid %d: %w", uid, err)
+			}
+		}
+
+		for _, entry := range update.Added {
+			entry.MessageId = NormalizeMessageId(entry.MessageId)
+			// Replace any entry from a local move (see MoveMessage)
+			_, err = eq.Exec(`
+            delete from lmdb_mailbox_join
+                where mailboxid = ? and messageid = ? and uid is null`,
+				mboxId, entry.MessageId)
+			if err != nil {
+				return fmt.Errorf("Deleting mailbox entry for %s: %w", entry.MessageId, err)
+			}
+
+			_, err = eq.Exec(`
+            insert into lmdb_mailbox_join(mailboxid, messageid, uid) values(?, ?, ?)
+                on conflict(mailboxid, uid) do update set messageid=excluded.messageid`,
+				mboxId, entry.MessageId, entry.Uid)
+			if err != nil {
+				if sqliteErr, ok := err.(sqlite3.Error); ok &&
+					sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+					log.Printf("Message %s (uid %d) not in database, not adding to mailbox",
+						entry.MessageId, entry.Uid)
+					continue
+				}
+				return fmt.Errorf("Inserting record into mailbox: %w", err)
+			}
+		}
+
+		for uid, flags := range update.Flags {
+			var messageId string
+			err = sqlx.Get(eq, &messageId, `
+            select messageid from lmdb_mailbox_join where mailboxid = ? and uid = ?`,
+				mboxId, uid)
+			if errors.Is(err, sql.ErrNoRows) {
+				// e.g., fetching the body failed
+				continue
+			} else if err != nil {
+				return fmt.Errorf("Looking up uid %d: %w", uid, err)
+			}
+			if err := setFlagsTx(eq, mboxId, messageId, flags); err != nil {
+				return err
+			}
+			if err := reapplyJournalTx(eq, mboxId, messageId); err != nil {
+				return err
+			}
+		}
+
+		_, err = eq.Exec(`
+        insert into lmdb_mailbox_sync(mailboxid, uidvalidity, lastuid, highestmodseq)
+            values(?, ?, ?, ?)
+            on conflict(mailboxid) do update
+                set uidvalidity=excluded.uidvalidity, lastuid=excluded.lastuid,
+                    highestmodseq=excluded.highestmodseq`,
+			mboxId, update.State.UidValidity, update.State.LastUid, update.State.HighestModSeq)
+		if err != nil {
+			return fmt.Errorf("Updating mailbox sync state: %w", err)
+		}
+
+		if err := pruneJournalTx(eq, mboxId); err != nil {
+			return err
+		}
+		return pruneFlagsTx(eq, mboxId)
+	})
+}
+
+// Mailboxes can also be defined by mailing list: every message whose
+// List-Id matches one of the mailbox's list ids is in the mailbox,
+// including messages added later.  This is for sources (like
+// public-inbox archives) which have no folders of their own.
+
+// parseListId returns the identifier part of a List-Id header (RFC
+// 2919), e.g. "xen-devel.lists.xenproject.org" from
+// `Xen developer discussion <xen-devel.lists.xenproject.org>`, or ""
+// if there isn't one.  List ids are case-insensitive, so it's
+// lowercased.
+func parseListId(value string) string {
+	if start := strings.LastIndexByte(value, '<'); start >= 0 {
+		if end := strings.IndexByte(value[start:], '>'); end > 0 {
+			value = value[start+1 : start+end]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// Add a message to a mailbox, if it's in the database and not in the
+// mailbox already.
+func addToMailboxTx(eq sqlx.Ext, mboxId int, messageId string) error {
+	_, err := eq.Exec(`
+        insert into lmdb_mailbox_join(mailboxid, messageid)
+            select ?, messageid from lmdb_messages
+                where messageid = ?
+                  and not exists (select 1 from lmdb_mailbox_join
+                                      where mailboxid = ? and messageid = ?)`,
+		mboxId, messageId, mboxId, messageId)
+	if err != nil {
+		return fmt.Errorf("Adding message %s to mailbox: %w", messageId, err)
+	}
+	return nil
+}
+
+// Remove a message from a mailbox, along with its flags
+func removeFromMailboxTx(eq sqlx.Ext, mboxId int, messageId string) error {
+	for _, table := range []string{"lmdb_mailbox_flags", "lmdb_mailbox_join"} {
+		_, err := eq.Exec(`delete from `+table+` where mailboxid=? and messageid=?`,
+			mboxId, messageId)
+		if err != nil {
+			return fmt.Errorf("Removing message %s from mailbox: %w", messageId, err)
+		}
+	}
+	return nil
+}
+
+// Add a newly added message to the mailboxes defined by its list id.
+func addToListMailboxesTx(eq sqlx.Ext, messageId, listId string) error {
+	if listId == "" {
+		return nil
+	}
+	_, err := eq.Exec(`
+        insert into lmdb_mailbox_join(mailboxid, messageid)
+            select mailboxid, ? from lmdb_mailbox_listids
+                where listid = ?
+                  and not exists (select 1 from lmdb_mailbox_join as j
+                                      where j.mailboxid = lmdb_mailbox_listids.mailboxid
+                                        and j.messageid = ?)`,
+		messageId, listId, messageId)
+	if err != nil {
+		return fmt.Errorf("Adding message %s to mailboxes for list %s: %w", messageId, listId, err)
+	}
+	return nil
+}
+
+// SetMailboxListId makes every message with the given List-Id a
+// member of the mailbox, creating the mailbox if necessary: both
+// messages already in the database and ones added afterwards.
+// listId may be given either bare or as a whole List-Id header.  A
+// mailbox may have several list ids.
+func (mdb *MailDB) SetMailboxListId(mailboxname, listId string) error {
+	return mdb.SetMailboxListIdContext(context.Background(), mailboxname, listId)
+}
+
+// SetMailboxListIdContext is like SetMailboxListId, but takes a context.
+func (mdb *MailDB) SetMailboxListIdContext(ctx context.Context, mailboxname, listId string) error {
+	listId = parseListId(listId)
+	if listId == "" {
+		return fmt.Errorf("Empty list id for mailbox %s", mailboxname)
+	}
+
+	if err := mdb.CreateMailboxContext(ctx, mailboxname); err != nil {
+		return err
+	}
+
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+		}
+
+		_, err = eq.Exec(`
+        insert into lmdb_mailbox_listids(mailboxid, listid) values(?, ?)
+            on conflict do nothing`, mboxId, listId)
+		if err != nil {
+			return fmt.Errorf("Adding list id %s to mailbox %s: %w", listId, mailboxname, err)
+		}
+
+		_, err = eq.Exec(`
+        insert into lmdb_mailbox_join(mailboxid, messageid)
+            select ?, messageid from lmdb_messages
+                where listid = ?
+                  and messageid not in (select messageid from lmdb_mailbox_join
+                                            where mailboxid = ?)`,
+			mboxId, listId, mboxId)
+		if err != nil {
+			return fmt.Errorf("Adding messages from list %s to mailbox %s: %w", listId, mailboxname, err)
+		}
+
+		return nil
+	})
+}
+
+// Migration helper: record the List-Id of messages added before it
+// was recorded.
+func backfillListIdTx(eq sqlx.Ext) error {
+	rows, err := eq.Queryx(`select messageid, message from lmdb_messages`)
+	if err != nil {
+		return fmt.Errorf("Getting message list: %w", err)
+	}
+	defer rows.Close()
+
+	type entry struct{ messageId, listId string }
+	var entries []entry
+
+	for rows.Next() {
+		var messageId, message string
+		if err := rows.Scan(&messageId, &message); err != nil {
+			return fmt.Errorf("Scanning message: %w", err)
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader([]byte(message)))
+		if err != nil {
+			continue
+		}
+
+		if listId := parseListId(m.Header.Get("List-Id")); listId != "" {
+			entries = append(entries, entry{messageId, listId})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, e := range entries {
+		_, err := eq.Exec(`update lmdb_messages set listid=? where messageid=?`, e.listId, e.messageId)
+		if err != nil {
+			return fmt.Errorf("Setting list id of %s: %w", e.messageId, err)
+		}
+	}
+
+	return nil
+}
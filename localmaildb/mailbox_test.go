@@ -0,0 +1,176 @@
+package localmaildb
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMailboxSync(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "mailbox-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	for i, msgid := range []string{"<a@x>", "<b@x>", "<c@x>"} {
+		if err := mdb.AddMessage(testMessage(msgid, i+1)); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+
+	checkState := func(what string, wantState MailboxSyncState, wantUids []uint32) {
+		t.Helper()
+		state, err := mdb.GetSyncState("test")
+		if err != nil {
+			t.Fatalf("%s: Getting sync state: %v", what, err)
+		}
+		if state != wantState {
+			t.Errorf("ERROR: %s: got state %+v, wanted %+v", what, state, wantState)
+		}
+		uids, err := mdb.GetMailboxUids("test")
+		if err != nil {
+			t.Fatalf("%s: Getting uids: %v", what, err)
+		}
+		if len(uids) == 0 && len(wantUids) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(uids, wantUids) {
+			t.Errorf("ERROR: %s: got uids %v, wanted %v", what, uids, wantUids)
+		}
+	}
+
+	checkState("new mailbox", MailboxSyncState{}, nil)
+
+	// Messages not in the database are skipped
+	err = mdb.ApplyMailboxUpdate("test", &MailboxUpdate{
+		State: MailboxSyncState{UidValidity: 7, LastUid: 4},
+		Reset: true,
+		Added: []MailboxEntry{{1, "<a@x>"}, {2, "<b@x>"}, {4, "<missing@x>"}},
+	})
+	if err != nil {
+		t.Fatalf("Applying initial update: %v", err)
+	}
+	checkState("initial sync", MailboxSyncState{UidValidity: 7, LastUid: 4}, []uint32{1, 2})
+
+	err = mdb.ApplyMailboxUpdate("test", &MailboxUpdate{
+		State:   MailboxSyncState{UidValidity: 7, LastUid: 5},
+		Added:   []MailboxEntry{{5, "<c@x>"}},
+		Removed: []uint32{1},
+	})
+	if err != nil {
+		t.Fatalf("Applying incremental update: %v", err)
+	}
+	checkState("incremental sync", MailboxSyncState{UidValidity: 7, LastUid: 5}, []uint32{2, 5})
+
+	roots, err := mdb.GetMessageRoots("test")
+	if err != nil {
+		t.Fatalf("Getting message roots: %v", err)
+	}
+	if len(roots) != 2 || roots[0].Envelope.MessageId != "<b@x>" || roots[1].Envelope.MessageId != "<c@x>" {
+		t.Errorf("ERROR: Unexpected roots after sync: %v", roots)
+	}
+
+	// UIDVALIDITY change
+	err = mdb.ApplyMailboxUpdate("test", &MailboxUpdate{
+		State: MailboxSyncState{UidValidity: 8, LastUid: 1},
+		Reset: true,
+		Added: []MailboxEntry{{1, "<c@x>"}},
+	})
+	if err != nil {
+		t.Fatalf("Applying reset: %v", err)
+	}
+	checkState("reset", MailboxSyncState{UidValidity: 8, LastUid: 1}, []uint32{1})
+}
+
+func TestParseListId(t *testing.T) {
+	for _, test := range []struct{ value, want string }{
+		{"Xen developer discussion <xen-devel.lists.xenproject.org>", "xen-devel.lists.xenproject.org"},
+		{"<Linux-Kernel.VGER.kernel.org>", "linux-kernel.vger.kernel.org"},
+		{"  bare.example.com ", "bare.example.com"},
+		{"", ""},
+	} {
+		if got := parseListId(test.value); got != test.want {
+			t.Errorf("ERROR: parseListId(%q): got %q, wanted %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestListIdMailbox(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "listid-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	xen := "List-Id: Xen devel <xen-devel.example.org>\r\n"
+	other := "List-Id: <other.example.org>\r\n"
+
+	// One message from before the mailbox is defined, one after
+	if err := mdb.AddMessage(testMessage("<a@x>", 1, xen)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	if err := mdb.AddMessage(testMessage("<b@x>", 2, other)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	if err := mdb.SetMailboxListId("xen", "xen-devel.example.org"); err != nil {
+		t.Fatalf("Setting list id: %v", err)
+	}
+	// Setting it again changes nothing
+	if err := mdb.SetMailboxListId("xen", "<Xen-Devel.example.org>"); err != nil {
+		t.Fatalf("Setting list id again: %v", err)
+	}
+
+	if err := mdb.AddMessage(testMessage("<c@x>", 3, "In-Reply-To: <a@x>\r\n", xen)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	var members []string
+	err = mdb.db.Select(&members, `
+        select messageid from lmdb_mailbox_join natural join lmdb_mailboxes
+            where mailboxname = 'xen' order by messageid`)
+	if err != nil {
+		t.Fatalf("Getting mailbox members: %v", err)
+	}
+	if want := []string{"<a@x>", "<c@x>"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("ERROR: Mailbox members: got %v, wanted %v", members, want)
+	}
+
+	roots, err := mdb.GetMessageRoots("xen")
+	if err != nil {
+		t.Fatalf("Getting roots: %v", err)
+	}
+	if len(roots) != 1 || roots[0].Envelope.MessageId != "<a@x>" {
+		t.Errorf("ERROR: Got %d roots, wanted just <a@x>", len(roots))
+	}
+
+	// Explicit membership through a BulkWriter doesn't duplicate
+	bw := mdb.NewBulkWriter()
+	for _, msgid := range []string{"<a@x>", "<b@x>", "<missing@x>"} {
+		if err := bw.AddToMailbox("xen", msgid); err != nil {
+			t.Fatalf("Queueing %s: %v", msgid, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("Flushing: %v", err)
+	}
+	members = nil
+	err = mdb.db.Select(&members, `
+        select messageid from lmdb_mailbox_join natural join lmdb_mailboxes
+            where mailboxname = 'xen' order by messageid`)
+	if err != nil {
+		t.Fatalf("Getting mailbox members: %v", err)
+	}
+	if want := []string{"<a@x>", "<b@x>", "<c@x>"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("ERROR: Mailbox members after AddToMailbox: got %v, wanted %v", members, want)
+	}
+}
@@ -0,0 +1,315 @@
+package localmaildb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/martyros/sqlutil/txutil"
+)
+
+// A migration takes the database schema from one version to the
+// next.  migrations[i] upgrades a database at version i to version
+// i+1; version 0 is an empty database.
+//
+// All pending migrations are run inside a single transaction, so a
+// failure at any step leaves the database at its original version.
+// Note that this means migrations can't change `pragma foreign_keys`,
+// which is a no-op inside a transaction; steps which need to rebuild
+// a table must copy the data in an order which keeps the foreign key
+// constraints satisfied.
+//
+// Never modify or reorder a migration once it's been committed:
+// always add a new one at the end.
+type migration struct {
+	desc  string
+	apply func(eq sqlx.Ext) error
+}
+
+// Helper for migrations which are only a list of SQL statements
+func execAll(stmts ...string) func(eq sqlx.Ext) error {
+	return func(eq sqlx.Ext) error {
+		for _, stmt := range stmts {
+			if _, err := eq.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var migrations = []migration{
+	// Version 1: The original schema.  Databases created before the
+	// migration code existed are all at this version, which is why
+	// everything here still has `if not exists`.
+	{"initial schema", execAll(`
+        create table if not exists lmdb_params(
+            key       text primary key,
+            value     text not null)`, `
+        create table if not exists lmdb_messages(
+            messageid text primary key,
+            subject   text not null,
+            date      date  not null,
+            message   text not null,
+            inreplyto text,
+            size      integer  not null)`, `
+        create table if not exists lmdb_addresses(
+            addressid    integer primary key,
+            personalname text,
+            mailboxname  text,
+            hostname     text,
+            unique(personalname, mailboxname, hostname))`, `
+        create table if not exists lmdb_envelopejoin(
+            messageid text not null,
+            addressid integer not null,
+            envelopepart integer not null,
+            foreign key(messageid) references lmdb_messages,
+            foreign key(addressid) references lmdb_addresses)`, `
+        create table if not exists lmdb_mailboxes(
+            mailboxid integer primary key,
+            mailboxname text)`, `
+        create table if not exists lmdb_mailbox_join(
+            mailboxid integer,
+            messageid text,
+            foreign key(mailboxid) references lmdb_mailboxes,
+            foreign key(messageid) references lmdb_messages)`)},
+
+	// Version 2: References chains for threading (see thread.go)
+	{"references", func(eq sqlx.Ext) error {
+		err := execAll(`
+        create table lmdb_references(
+            messageid text not null,
+            refid     text not null,
+            position  integer not null,
+            primary key(messageid, position),
+            foreign key(messageid) references lmdb_messages)`, `
+        create index lmdb_references_refid on lmdb_references(refid)`)(eq)
+		if err != nil {
+			return err
+		}
+		return backfillReferencesTx(eq)
+	}},
+
+	// Version 3: Queue for the full-text index (see search.go),
+	// starting with everything
+	{"full-text index queue", execAll(`
+        create table lmdb_fts_pending(
+            messageid text primary key,
+            foreign key(messageid) references lmdb_messages)`, `
+        insert into lmdb_fts_pending(messageid)
+            select messageid from lmdb_messages`)},
+
+	// Version 4: Attachment metadata (see body.go)
+	{"attachments", func(eq sqlx.Ext) error {
+		_, err := eq.Exec(`
+        create table lmdb_attachments(
+            messageid   text not null,
+            partindex   integer not null,
+            filename    text not null,
+            contenttype text not null,
+            size        integer not null,
+            primary key(messageid, partindex),
+            foreign key(messageid) references lmdb_messages)`)
+		if err != nil {
+			return err
+		}
+		return backfillAttachmentsTx(eq)
+	}},
+
+	// Version 5: Sender wasn't recorded in lmdb_envelopejoin before
+	{"sender addresses", backfillSenderTx},
+
+	// Version 6: Incremental mailbox sync (see mailbox.go)
+	{"mailbox sync state", execAll(`
+        alter table lmdb_mailbox_join add column uid integer`, `
+        create unique index lmdb_mailbox_join_uid on lmdb_mailbox_join(mailboxid, uid)`, `
+        create table lmdb_mailbox_sync(
+            mailboxid   integer primary key,
+            uidvalidity integer not null,
+            lastuid     integer not null,
+            foreign key(mailboxid) references lmdb_mailboxes)`)},
+
+	// Version 7: Per-source import progress (see source.go)
+	{"source state", execAll(`
+        create table lmdb_source_state(
+            source text not null,
+            key    text not null,
+            value  text not null,
+            primary key(source, key))`)},
+
+	// Version 8: Mailboxes defined by List-Id (see mailbox.go)
+	{"list-id mailboxes", func(eq sqlx.Ext) error {
+		err := execAll(`
+        alter table lmdb_messages add column listid text`, `
+        create index lmdb_messages_listid on lmdb_messages(listid)`, `
+        create index lmdb_mailbox_join_messageid on lmdb_mailbox_join(mailboxid, messageid)`, `
+        create table lmdb_mailbox_listids(
+            mailboxid integer not null,
+            listid    text not null,
+            primary key(mailboxid, listid),
+            foreign key(mailboxid) references lmdb_mailboxes)`)(eq)
+		if err != nil {
+			return err
+		}
+		return backfillListIdTx(eq)
+	}},
+
+	// Version 9: Per-mailbox message flags (see flags.go)
+	{"message flags", execAll(`
+        create table lmdb_mailbox_flags(
+            mailboxid integer not null,
+            messageid text not null,
+            flag      text not null,
+            primary key(mailboxid, messageid, flag),
+            foreign key(mailboxid) references lmdb_mailboxes,
+            foreign key(messageid) references lmdb_messages)`, `
+        create index lmdb_mailbox_flags_flag on lmdb_mailbox_flags(mailboxid, flag)`)},
+
+	// Version 10: Flag sync state (see mailbox.go)
+	{"mailbox modseq", execAll(`
+        alter table lmdb_mailbox_sync add column highestmodseq integer not null default 0`)},
+
+	// Version 11: Local changes to push to sources (see journal.go)
+	{"journal", execAll(`
+        create table lmdb_journal(
+            id          integer primary key,
+            mailboxid   integer not null,
+            messageid   text not null,
+            op          text not null,
+            arg         text not null,
+            uidvalidity integer not null,
+            uid         integer,
+            modseq      integer not null,
+            foreign key(mailboxid) references lmdb_mailboxes)`, `
+        create index lmdb_journal_mailbox on lmdb_journal(mailboxid, messageid)`)},
+	// Version 12: Content hashes and variants of messages sharing a
+	// Message-ID (see msgid.go)
+	{"message variants", func(eq sqlx.Ext) error {
+		err := execAll(`
+        alter table lmdb_messages add column hash text`, `
+        create table lmdb_message_variants(
+            messageid text not null,
+            hash      text not null,
+            message   blob not null,
+            size      integer not null,
+            primary key(messageid, hash),
+            foreign key(messageid) references lmdb_messages)`)(eq)
+		if err != nil {
+			return err
+		}
+		return renameEmptyMessageIdTx(eq)
+	}},
+	// Version 13: Queue of messages to remove from the full-text
+	// index once it's available again (see search.go), by rowid.  No
+	// foreign key, as the messages are gone.
+	{"full-text index deletions", execAll(`
+        create table lmdb_fts_deleted(
+            ftsrowid integer primary key)`)},
+	// Version 14: Message-IDs stored as they were given normalised,
+	// everywhere they're used (see msgid.go)
+	{"normalised message ids", normalizeMessageIdsTx},
+}
+
+// TargetDBVersion returns the schema version this version of the
+// library understands.  Opening a database will upgrade it to this
+// version.
+func TargetDBVersion() int {
+	return len(migrations)
+}
+
+func getDBVersionTx(eq sqlx.Ext) (int, error) {
+	// A brand new database won't have the params table at all
+	var n int
+	err := sqlx.Get(eq, &n, `
+        select count(*) from sqlite_master
+            where type='table' and name='lmdb_params'`)
+	if err != nil {
+		return 0, fmt.Errorf("Looking for params table: %w", err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	var value string
+	err = sqlx.Get(eq, &value, `select value from lmdb_params where key='dbversion'`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Getting dbversion param: %w", err)
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Parsing dbversion param %q: %w", value, err)
+	}
+
+	return version, nil
+}
+
+func setDBVersionTx(eq sqlx.Ext, version int) error {
+	_, err := eq.Exec(`
+        insert into lmdb_params(key, value)
+            values ('dbversion', ?)
+            on conflict(key) do update set value=excluded.value`,
+		strconv.Itoa(version))
+	if err != nil {
+		return fmt.Errorf("Setting dbversion param: %w", err)
+	}
+	return nil
+}
+
+// Bring the database up to TargetDBVersion()
+func migrateTx(eq sqlx.Ext) error {
+	version, err := getDBVersionTx(eq)
+	if err != nil {
+		return err
+	}
+
+	target := TargetDBVersion()
+
+	if version > target {
+		return ErrDBVersion.wrap(fmt.Errorf("Database version %d, library only understands up to %d",
+			version, target))
+	}
+
+	if version == target {
+		return nil
+	}
+
+	for ; version < target; version++ {
+		m := &migrations[version]
+		log.Printf("Upgrading database to version %d (%s)", version+1, m.desc)
+		if err := m.apply(eq); err != nil {
+			return fmt.Errorf("Upgrading database to version %d (%s): %w",
+				version+1, m.desc, err)
+		}
+	}
+
+	return setDBVersionTx(eq, version)
+}
+
+func (mdb *MailDB) migrate(ctx context.Context) error {
+	return mdb.txLoop(ctx, migrateTx)
+}
+
+// DBVersion returns the current schema version of the database.
+// After a successful open this will always be TargetDBVersion().
+func (mdb *MailDB) DBVersion() (int, error) {
+	var version int
+	err := txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+		var err error
+		version, err = getDBVersionTx(eq)
+		return err
+	})
+	return version, err
+}
+
+// TargetDBVersion returns the schema version this library
+// understands; see the package-level TargetDBVersion().
+func (mdb *MailDB) TargetDBVersion() int {
+	return TargetDBVersion()
+}
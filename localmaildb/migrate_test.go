@@ -0,0 +1,301 @@
+package localmaildb
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMigrate(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "migrate-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening new maildb file %s: %v", dbfile, err)
+	}
+
+	version, err := mdb.DBVersion()
+	if err != nil {
+		t.Fatalf("Getting database version: %v", err)
+	}
+	if version != TargetDBVersion() {
+		t.Errorf("ERROR: New database at version %d, wanted %d", version, TargetDBVersion())
+	}
+
+	// Re-opening shouldn't change anything
+	mdb.Close()
+	mdb, err = OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Re-opening maildb file %s: %v", dbfile, err)
+	}
+
+	// Pretend a newer library has been at it
+	if err := setDBVersionTx(mdb.db, TargetDBVersion()+1); err != nil {
+		t.Fatalf("Setting database version: %v", err)
+	}
+	mdb.Close()
+
+	_, err = OpenMailDB(dbfile)
+	if !errors.Is(err, ErrDBVersion) {
+		t.Errorf("ERROR: Opening newer database: wanted ErrDBVersion, got %v", err)
+	}
+}
+
+// Databases created before the migration code existed have all the
+// version 1 tables, and dbversion set to 1.
+func TestMigrateFromV1(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "migrate-v1-test.sqlite")
+
+	// Create a version 1 schema by hand
+	db, err := sqlx.Open("sqlite3", "file:"+dbfile+"?_fk=true&mode=rwc")
+	if err != nil {
+		t.Fatalf("Opening database %s: %v", dbfile, err)
+	}
+	if err := migrations[0].apply(db); err != nil {
+		t.Fatalf("Creating version 1 schema: %v", err)
+	}
+	if err := setDBVersionTx(db, 1); err != nil {
+		t.Fatalf("Setting database version: %v", err)
+	}
+	_, err = db.Exec(`
+        insert into lmdb_messages(messageid, subject, date, message, inreplyto, size)
+            values(?, ?, ?, ?, ?, ?)`,
+		"<b@x>", "Message <b@x>", "2024-01-02", testMessage("<b@x>", 2, "In-Reply-To: <a@x>\r\n"),
+		"<a@x>", 0)
+	if err != nil {
+		t.Fatalf("Inserting version 1 message: %v", err)
+	}
+	// Messages without a Message-ID used to be stored under ''
+	noid := testMessage("", 3)
+	_, err = db.Exec(`
+        insert into lmdb_messages(messageid, subject, date, message, inreplyto, size)
+            values(?, ?, ?, ?, ?, ?)`,
+		"", "Message", "2024-01-03", noid, "", 0)
+	if err != nil {
+		t.Fatalf("Inserting version 1 message: %v", err)
+	}
+	db.Close()
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Upgrading version 1 database: %v", err)
+	}
+	defer mdb.Close()
+
+	version, err := mdb.DBVersion()
+	if err != nil {
+		t.Fatalf("Getting database version: %v", err)
+	}
+	if version != TargetDBVersion() {
+		t.Errorf("ERROR: Upgraded database at version %d, wanted %d", version, TargetDBVersion())
+	}
+
+	// Version 2: References for existing messages filled in
+	var refid string
+	if err := mdb.db.Get(&refid, `select refid from lmdb_references where messageid='<b@x>'`); err != nil {
+		t.Errorf("ERROR: Getting backfilled references: %v", err)
+	} else if refid != "<a@x>" {
+		t.Errorf("ERROR: Backfilled reference %s, wanted <a@x>", refid)
+	}
+
+	// Version 12: The message without a Message-ID renamed to its
+	// synthetic one
+	msgid, err := RawMessageId(noid)
+	if err != nil {
+		t.Fatalf("Getting message id: %v", err)
+	}
+	for id, want := range map[string]bool{"": false, msgid: true} {
+		var n int
+		if err := mdb.db.Get(&n, `select count(*) from lmdb_messages where messageid=?`, id); err != nil {
+			t.Errorf("ERROR: Counting messages: %v", err)
+		} else if (n == 1) != want {
+			t.Errorf("ERROR: %d messages with messageid %q after upgrade", n, id)
+		}
+	}
+}
+
+// A database upgraded when message variants were the latest version
+// picks up from there
+func TestMigrateFromV12(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "migrate-v12-test.sqlite")
+
+	db, err := sqlx.Open("sqlite3", "file:"+dbfile+"?_fk=true&mode=rwc")
+	if err != nil {
+		t.Fatalf("Opening database %s: %v", dbfile, err)
+	}
+	for i := 0; i < 12; i++ {
+		if err := migrations[i].apply(db); err != nil {
+			t.Fatalf("Creating version %d schema: %v", i+1, err)
+		}
+	}
+	if err := setDBVersionTx(db, 12); err != nil {
+		t.Fatalf("Setting database version: %v", err)
+	}
+	db.Close()
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Upgrading version 12 database: %v", err)
+	}
+	defer mdb.Close()
+
+	if version, err := mdb.DBVersion(); err != nil || version != TargetDBVersion() {
+		t.Errorf("ERROR: Got version %d (%v), wanted %d", version, err, TargetDBVersion())
+	}
+	var n int
+	if err := mdb.db.Get(&n, `select count(*) from lmdb_fts_deleted`); err != nil {
+		t.Errorf("ERROR: Deleted index entry list missing after upgrade: %v", err)
+	}
+}
+
+// Message-IDs stored before they were normalised (version 14)
+func TestMigrateMessageIds(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "migrate-msgid-test.sqlite")
+
+	db, err := sqlx.Open("sqlite3", "file:"+dbfile+"?_fk=true&mode=rwc")
+	if err != nil {
+		t.Fatalf("Opening database %s: %v", dbfile, err)
+	}
+	for i := 0; i < 13; i++ {
+		if err := migrations[i].apply(db); err != nil {
+			t.Fatalf("Creating version %d schema: %v", i+1, err)
+		}
+	}
+	if err := setDBVersionTx(db, 13); err != nil {
+		t.Fatalf("Setting database version: %v", err)
+	}
+	fts, err := ftsAvailableTx(db)
+	if err != nil {
+		t.Fatalf("Checking for FTS5: %v", err)
+	}
+	if fts {
+		_, err := db.Exec(`create virtual table lmdb_fts using fts5(messageid unindexed, subject, addresses, body)`)
+		if err != nil {
+			t.Fatalf("Creating full-text index: %v", err)
+		}
+	}
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("Setting up version 13 database: %v", err)
+		}
+	}
+	addMessage := func(msgid string, message []byte, inReplyTo string) {
+		t.Helper()
+		exec(`
+        insert into lmdb_messages(messageid, subject, date, message, inreplyto, size)
+            values(?, 'Subject', '2024-01-01', ?, ?, ?)`,
+			msgid, message, inReplyTo, len(message))
+		if fts {
+			exec(`insert into lmdb_fts(messageid, subject, addresses, body) values(?, '', '', 'indexed')`, msgid)
+		}
+	}
+
+	noid := testMessage("", 1)
+	addMessage("", noid, "")
+	addMessage("e@x", testMessage("e@x", 2), "")
+	addMessage("<c@x>", testMessage("<c@x>", 3), "")
+	addMessage(" <c@x>", testMessage(" <c@x>", 4), "")
+	addMessage("<f@x>", testMessage("<f@x>", 5, "In-Reply-To: <e@\r\n x>\r\n"), "<e@ x>")
+	exec(`insert into lmdb_references(messageid, refid, position) values('<f@x>', '<e@ x>', 0)`)
+
+	exec(`insert into lmdb_mailboxes(mailboxid, mailboxname) values(1, 'test')`)
+	for uid, msgid := range []string{"", "e@x", "<c@x>", " <c@x>", "<f@x>"} {
+		exec(`insert into lmdb_mailbox_join(mailboxid, messageid, uid) values(1, ?, ?)`, msgid, uid+1)
+	}
+	exec(`insert into lmdb_mailbox_flags(mailboxid, messageid, flag) values(1, 'e@x', ?)`, FlagSeen)
+	exec(`insert into lmdb_mailbox_flags(mailboxid, messageid, flag) values(1, ' <c@x>', ?)`, FlagFlagged)
+
+	for key, value := range map[string]string{"noid": "2,S ", "e": "2,S e@x", "c": "2, <c@x>"} {
+		exec(`insert into lmdb_source_state(source, key, value) values('maildir:/mail', ?, ?)`, key, value)
+	}
+	db.Close()
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Upgrading version 13 database: %v", err)
+	}
+	defer mdb.Close()
+
+	noidMsgid, err := RawMessageId(noid)
+	if err != nil {
+		t.Fatalf("Getting message id: %v", err)
+	}
+	var ids []string
+	if err := mdb.db.Select(&ids, `select messageid from lmdb_messages order by messageid`); err != nil {
+		t.Fatalf("Getting messageids: %v", err)
+	}
+	want := []string{noidMsgid, "<c@x>", "<e@x>", "<f@x>"}
+	sort.Strings(want)
+	if strings.Join(ids, " ") != strings.Join(want, " ") {
+		t.Errorf("ERROR: Got messageids %v, wanted %v", ids, want)
+	}
+
+	// The two <c@x>s are now one message and a variant, both in the
+	// mailbox, with their flags
+	if variants, err := mdb.GetMessageVariants("<c@x>"); err != nil || len(variants) != 1 {
+		t.Errorf("ERROR: Got %d variants of <c@x> (%v), wanted 1", len(variants), err)
+	}
+	uids, err := mdb.GetMailboxUids("test")
+	if err != nil || len(uids) != 5 {
+		t.Errorf("ERROR: Got mailbox uids %v (%v), wanted 5", uids, err)
+	}
+	for msgid, want := range map[string]string{"<e@x>": FlagSeen, "<c@x>": FlagFlagged} {
+		flags, err := mdb.GetFlags("test", msgid)
+		if err != nil || strings.Join(flags, " ") != want {
+			t.Errorf("ERROR: Got flags %v (%v) for %s, wanted %s", flags, err, msgid, want)
+		}
+	}
+
+	// Threading finds the renamed parent
+	tree, err := mdb.GetTreeFromMessageId("<e@x>")
+	if err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if err := mdb.GetTree(tree); err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if got := treeString(tree); got != "<e@x>(<f@x>)" {
+		t.Errorf("ERROR: Got tree %s, wanted <e@x>(<f@x>)", got)
+	}
+	var inReplyTo string
+	if err := mdb.db.Get(&inReplyTo, `select inreplyto from lmdb_messages where messageid='<f@x>'`); err != nil || inReplyTo != "<e@x>" {
+		t.Errorf("ERROR: Got In-Reply-To %q (%v), wanted <e@x>", inReplyTo, err)
+	}
+
+	// maildirsrc's record of files: one without a Message-ID is read
+	// again
+	state, err := mdb.ListSourceState("maildir:/mail")
+	if err != nil {
+		t.Fatalf("Getting source state: %v", err)
+	}
+	wantState := map[string]string{"e": "2,S <e@x>", "c": "2, <c@x>"}
+	if len(state) != len(wantState) {
+		t.Errorf("ERROR: Got source state %v, wanted %v", state, wantState)
+	}
+	for key, value := range wantState {
+		if state[key] != value {
+			t.Errorf("ERROR: Got source state %v, wanted %v", state, wantState)
+		}
+	}
+
+	// The full-text index is rebuilt, with just the messages left
+	if mdb.SearchAvailable() {
+		var got []string
+		err := mdb.db.Select(&got, `
+        select coalesce(messageid, '')
+            from lmdb_fts left join lmdb_messages on lmdb_messages.rowid = lmdb_fts.rowid
+            order by messageid`)
+		if err != nil {
+			t.Fatalf("Getting index entries: %v", err)
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("ERROR: Got index entries %v, wanted %v", got, want)
+		}
+	}
+}
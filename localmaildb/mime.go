@@ -0,0 +1,144 @@
+package localmaildb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// Decoding of stored messages: MIME structure, transfer encodings
+// and charsets.
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown charset %s: %w", charset, err)
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Decode RFC 2047 encoded-words in a header value.  Headers in the
+// wild are frequently broken; if decoding fails, return the raw
+// value.
+func decodeHeader(s string) string {
+	if d, err := wordDecoder.DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
+
+// Convert text in the given charset to UTF-8.  Unknown charsets and
+// invalid sequences are replaced rather than failing, since a
+// slightly garbled body is more useful than none at all.
+func decodeCharset(charset string, b []byte) string {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+	default:
+		if r, err := charsetReader(charset, strings.NewReader(string(b))); err == nil {
+			if d, err := io.ReadAll(r); err == nil {
+				b = d
+			}
+		}
+	}
+	if !utf8.Valid(b) {
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return string(b)
+}
+
+// A leaf (i.e., non-multipart) MIME part of a message
+type mimePart struct {
+	Header    textproto.MIMEHeader
+	MediaType string            // Lower-case, e.g. "text/plain"
+	Params    map[string]string // Content-Type parameters
+	Body      []byte            // With Content-Transfer-Encoding removed
+}
+
+// Text returns the body of a text part converted to UTF-8
+func (p *mimePart) Text() string {
+	return decodeCharset(p.Params["charset"], p.Body)
+}
+
+func transferDecoder(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// base64.NewDecoder skips newlines, but not other whitespace or
+// trailing junk, both of which turn up in real mail.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '+' || b == '/' || b == '=' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// walkParts calls fn for each leaf part of a message (or of a
+// multipart body part), in order.  A missing or unparseable
+// Content-Type is treated as text/plain, per RFC 2045.
+func walkParts(header textproto.MIMEHeader, body io.Reader, fn func(p *mimePart) error) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// NB NextPart() would silently remove quoted-printable
+			// encoding, but not base64; handle them both ourselves.
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("Reading %s part: %w", mediaType, err)
+			}
+			if err := walkParts(p.Header, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := io.ReadAll(transferDecoder(header, body))
+	if err != nil {
+		return fmt.Errorf("Decoding %s part: %w", mediaType, err)
+	}
+
+	return fn(&mimePart{Header: header, MediaType: mediaType, Params: params, Body: b})
+}
+
+var reHtmlTag = regexp.MustCompile(`(?s)<(script|style).*?</(script|style)>|<[^>]*>`)
+
+// Very crude conversion of HTML to text, good enough for indexing
+func htmlToText(s string) string {
+	return html.UnescapeString(reHtmlTag.ReplaceAllString(s, " "))
+}
@@ -0,0 +1,96 @@
+package localmaildb
+
+import (
+	"net/textproto"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseMessageBody(t *testing.T) {
+	tests := []struct {
+		header map[string]string
+		body   string
+		want   MessageBody
+	}{
+		{nil, "Plain text\r\n", MessageBody{Text: "Plain text\r\n"}},
+		{map[string]string{
+			"Content-Type":              "text/plain; charset=iso-8859-2",
+			"Content-Transfer-Encoding": "quoted-printable",
+		}, "Pawe=B3 =3D\r\n", MessageBody{Text: "Paweł =\r\n"}},
+		{map[string]string{
+			"Content-Type":              "text/plain; charset=utf-8",
+			"Content-Transfer-Encoding": "base64",
+		}, "SGVs\r\nbG8=\r\n", MessageBody{Text: "Hello"}},
+		{map[string]string{
+			"Content-Type": `multipart/alternative; boundary="XX"`,
+		}, "--XX\r\nContent-Type: text/html\r\n\r\n<p>Hello &amp; goodbye</p>\r\n" +
+			"--XX\r\nContent-Type: text/plain\r\n\r\nHello and goodbye\r\n--XX--\r\n",
+			MessageBody{Text: "Hello and goodbye", HTML: "<p>Hello &amp; goodbye</p>"}},
+		{map[string]string{
+			"Content-Type": `multipart/mixed; boundary="XX"`,
+		}, "--XX\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+			"--XX\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nAttached\r\n" +
+			"--XX\r\nContent-Type: application/octet-stream; name=\"=?utf-8?q?=C3=BC.bin?=\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\nAAEC\r\n" +
+			"--XX\r\nContent-Type: image/png\r\nContent-Disposition: inline; filename*=utf-8''%C3%BC.png\r\n\r\n" +
+			"--XX--\r\n",
+			MessageBody{Text: "See attached", Attachments: []Attachment{
+				{Index: 1, Filename: "a.txt", ContentType: "text/plain", Size: 8},
+				{Index: 2, Filename: "ü.bin", ContentType: "application/octet-stream", Size: 3},
+				{Index: 3, Filename: "ü.png", ContentType: "image/png", Size: 0},
+			}}},
+	}
+
+	for _, test := range tests {
+		h := textproto.MIMEHeader{}
+		for k, v := range test.header {
+			h.Set(k, v)
+		}
+		got, err := parseMessageBody(h, []byte(test.body))
+		if err != nil {
+			t.Errorf("ERROR: Parsing body %q: %v", test.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("ERROR: Parsing body %q: got %+v, wanted %+v", test.body, *got, test.want)
+		}
+	}
+}
+
+func TestGetAttachments(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "attachments-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	message := testMessage("<a@x>", 1, "MIME-Version: 1.0\r\n",
+		"Content-Type: multipart/mixed; boundary=\"XX\"\r\n")
+	message = append(message, []byte("--XX\r\nContent-Type: text/plain\r\n\r\nPatch attached\r\n"+
+		"--XX\r\nContent-Type: text/x-patch; name=fix.patch\r\n\r\n--- a\r\n+++ b\r\n"+
+		"--XX--\r\n")...)
+
+	if err := mdb.AddMessage(message); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	got, err := mdb.GetAttachments("<a@x>")
+	if err != nil {
+		t.Fatalf("Getting attachments: %v", err)
+	}
+	want := []Attachment{{Index: 1, Filename: "fix.patch", ContentType: "text/x-patch", Size: 12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: Got attachments %+v, wanted %+v", got, want)
+	}
+
+	mb, err := mdb.GetMessageBody("<a@x>")
+	if err != nil {
+		t.Fatalf("Getting message body: %v", err)
+	}
+	if mb.Text != "Patch attached" {
+		t.Errorf("ERROR: Got text %q", mb.Text)
+	}
+}
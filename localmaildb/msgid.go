@@ -0,0 +1,631 @@
+package localmaildb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Message-IDs are the key messages are stored under, so they're
+// normalised the same way whichever source a message comes from; see
+// NormalizeMessageId.
+//
+// A message without a Message-ID gets a synthetic one made from a
+// hash of its content (see contentHash), so that each such message
+// is stored separately, and fetching the same one again finds it
+// already present.
+//
+// Different messages sometimes share a Message-ID: a patch re-sent
+// with changes, a broken Message-ID generator, or a mailing list copy
+// which the list has changed.  The first one added is the message;
+// the others are kept as variants (see GetMessageVariants), but play
+// no part in threading, searching or mailboxes.  Copies with the same
+// content hash as the message or one of its variants are just copies,
+// and AddMessage returns ErrMsgidPresent.  DeleteMessage deletes the
+// message and its variants; DeleteMessageCopy, for a source which no
+// longer has a message, just the one with the same content, and the
+// message itself only once it's in no mailbox.
+
+// The domain of synthetic Message-IDs
+const syntheticDomain = "localmaildb.invalid"
+
+// NormalizeMessageId puts a Message-ID (e.g., from a Message-ID
+// header or an IMAP envelope) into the form messages are stored
+// under: the first thing in angle brackets, or the whole thing in
+// angle brackets if there aren't any, without any whitespace (which
+// may have been added by header folding).  An empty or blank
+// Message-ID normalises to "".
+func NormalizeMessageId(s string) string {
+	id := reMsgId.FindString(s)
+	if id == "" {
+		id = s
+	}
+	id = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, id)
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	if id == "" {
+		return ""
+	}
+	return "<" + id + ">"
+}
+
+// A hash of what makes a message the message it is, ignoring headers
+// added in transit and line endings, so that copies from different
+// sources hash the same.
+func contentHash(h mail.Header, body []byte) string {
+	hash := sha256.New()
+	for _, field := range []string{"Date", "From", "To", "Cc", "Subject"} {
+		fmt.Fprintf(hash, "%s: %s\n", field, strings.Join(strings.Fields(h.Get(field)), " "))
+	}
+	hash.Write([]byte("\n"))
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	hash.Write(bytes.TrimRight(body, " \t\n"))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func syntheticMessageId(hash string) string {
+	return "<" + hash[:32] + "@" + syntheticDomain + ">"
+}
+
+// The Message-ID a message is stored under
+func messageIdFor(h mail.Header, hash string) string {
+	if id := NormalizeMessageId(h.Get("Message-ID")); id != "" {
+		return id
+	}
+	return syntheticMessageId(hash)
+}
+
+// The content hash of a raw message
+func rawContentHash(message []byte) (mail.Header, string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, "", ErrParseError.wrap(err)
+	}
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, "", ErrParseError.wrap(fmt.Errorf("Reading message body: %w", err))
+	}
+	return m.Header, contentHash(m.Header, body), nil
+}
+
+// The content hash of a stored message, or "" if it can't be parsed.
+// Messages added before content hashes were recorded get theirs now.
+// Returns sql.ErrNoRows (wrapped) if the message isn't present.
+func messageHashTx(eq sqlx.Ext, messageId string) (string, error) {
+	var existing struct {
+		Hash    sql.NullString
+		Message []byte
+	}
+	err := sqlx.Get(eq, &existing, `select hash, message from lmdb_messages where messageid=?`, messageId)
+	if err != nil {
+		return "", fmt.Errorf("Getting messageid %s: %w", messageId, err)
+	}
+	if existing.Hash.Valid {
+		return existing.Hash.String, nil
+	}
+
+	_, hash, err := rawContentHash(existing.Message)
+	if err != nil {
+		log.Printf("Can't hash messageid %s: %v", messageId, err)
+		return "", nil
+	}
+	_, err = eq.Exec(`update lmdb_messages set hash=? where messageid=?`, hash, messageId)
+	if err != nil {
+		return "", fmt.Errorf("Recording hash of messageid %s: %w", messageId, err)
+	}
+	return hash, nil
+}
+
+// Called when inserting pm failed because its Message-ID is taken.
+func addVariantTx(eq sqlx.Ext, pm *PreparedMessage) error {
+	hash, err := messageHashTx(eq, pm.messageId)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		// Can't tell; assume it's the same
+		return ErrMsgidPresent.wrap(fmt.Errorf("Messageid %s present, but can't be hashed", pm.messageId))
+	}
+	if hash == pm.hash {
+		return ErrMsgidPresent.wrap(fmt.Errorf("Messageid %s already present", pm.messageId))
+	}
+
+	res, err := eq.Exec(`
+        insert into lmdb_message_variants(messageid, hash, message, size)
+            values(?, ?, ?, ?)
+            on conflict do nothing`,
+		pm.messageId, pm.hash, pm.message, len(pm.message))
+	if err != nil {
+		return fmt.Errorf("Inserting variant of messageid %s: %w", pm.messageId, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMsgidPresent.wrap(fmt.Errorf("Variant of messageid %s already present", pm.messageId))
+	}
+
+	log.Printf("Messageid %s already present with different content, keeping as a variant", pm.messageId)
+	return nil
+}
+
+// GetMessageVariants returns the other messages with the same
+// Message-ID as the one stored under it, oldest first.
+func (mdb *MailDB) GetMessageVariants(messageId string) ([][]byte, error) {
+	return mdb.GetMessageVariantsContext(context.Background(), messageId)
+}
+
+// GetMessageVariantsContext is like GetMessageVariants, but takes a context.
+func (mdb *MailDB) GetMessageVariantsContext(ctx context.Context, messageId string) ([][]byte, error) {
+	var variants [][]byte
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		variants = nil
+		return sqlx.Select(eq, &variants, `
+        select message from lmdb_message_variants
+            where messageid=?
+            order by rowid`, NormalizeMessageId(messageId))
+	})
+
+	return variants, err
+}
+
+// IsMessageSizePresent reports whether the message stored under
+// msgid, or one of its variants, is size bytes long.  A source which
+// knows a message's size before fetching it can use this to skip
+// copies already present: a different size means a variant (or the
+// same message with different line endings), which has to be fetched
+// for AddMessage to tell which.
+func (mdb *MailDB) IsMessageSizePresent(msgid string, size int) (bool, error) {
+	return mdb.IsMessageSizePresentContext(context.Background(), msgid, size)
+}
+
+// IsMessageSizePresentContext is like IsMessageSizePresent, but takes a context.
+func (mdb *MailDB) IsMessageSizePresentContext(ctx context.Context, msgid string, size int) (bool, error) {
+	msgid = NormalizeMessageId(msgid)
+	var prs bool
+	err := sqlx.GetContext(ctx, mdb.db, &prs, `
+        select exists(select 1 from lmdb_messages where messageid=? and size=?)
+            or exists(select 1 from lmdb_message_variants where messageid=? and size=?)`,
+		msgid, size, msgid, size)
+	if err != nil {
+		return false, fmt.Errorf("Querying for messageid %v: %w", msgid, err)
+	}
+	return prs, nil
+}
+
+// DeleteMessageCopy records that the source whose messages are in
+// mailboxname (which may be "", if it doesn't have a mailbox) no
+// longer has message.  If one of the variants (see
+// GetMessageVariants) has the same content, just that variant is
+// deleted.  If the message stored under its Message-ID does, and has
+// variants, the oldest variant takes its place, staying in its
+// mailboxes with the same flags.  Otherwise the message is removed
+// from the mailbox, and only deleted (as by DeleteMessage) if it isn't
+// in any other: another source may still have it.  Deleting a message
+// which isn't present is not an error.
+func (mdb *MailDB) DeleteMessageCopy(mailboxname string, message []byte) error {
+	return mdb.DeleteMessageCopyContext(context.Background(), mailboxname, message)
+}
+
+// DeleteMessageCopyContext is like DeleteMessageCopy, but takes a context.
+func (mdb *MailDB) DeleteMessageCopyContext(ctx context.Context, mailboxname string, message []byte) error {
+	h, hash, err := rawContentHash(message)
+	if err != nil {
+		return err
+	}
+	messageId := messageIdFor(h, hash)
+
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxId := 0
+		if mailboxname != "" {
+			var err error
+			mboxId, err = mailboxNameToIdTx(eq, mailboxname)
+			if err != nil {
+				return fmt.Errorf("Couldn't get mailbox id for mailbox %s: %w", mailboxname, err)
+			}
+		}
+		return mdb.deleteCopyTx(eq, mboxId, messageId, hash)
+	})
+}
+
+// mboxId is 0 if the source has no mailbox
+func (mdb *MailDB) deleteCopyTx(eq sqlx.Ext, mboxId int, messageId, hash string) error {
+	res, err := eq.Exec(`delete from lmdb_message_variants where messageid=? and hash=?`, messageId, hash)
+	if err != nil {
+		return fmt.Errorf("Deleting variant of messageid %s: %w", messageId, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	existingHash, err := messageHashTx(eq, messageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if existingHash != hash {
+		return nil
+	}
+
+	var variant []byte
+	err = sqlx.Get(eq, &variant, `
+        select message from lmdb_message_variants
+            where messageid=?
+            order by rowid limit 1`, messageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mdb.deleteUnlessInMailboxTx(eq, mboxId, messageId)
+	} else if err != nil {
+		return fmt.Errorf("Getting variant of messageid %s: %w", messageId, err)
+	}
+
+	pm, err := mdb.PrepareMessage(variant)
+	if err != nil {
+		return fmt.Errorf("Preparing variant of messageid %s: %w", messageId, err)
+	}
+	return mdb.replaceMessageTx(eq, pm)
+}
+
+// Remove a message from a mailbox (if mboxId isn't 0), and delete it
+// if that leaves it in none
+func (mdb *MailDB) deleteUnlessInMailboxTx(eq sqlx.Ext, mboxId int, messageId string) error {
+	if mboxId != 0 {
+		if err := removeFromMailboxTx(eq, mboxId, messageId); err != nil {
+			return err
+		}
+	}
+
+	var n int
+	err := sqlx.Get(eq, &n, `select count(*) from lmdb_mailbox_join where messageid=?`, messageId)
+	if err != nil {
+		return fmt.Errorf("Counting mailboxes of messageid %s: %w", messageId, err)
+	}
+	if n > 0 {
+		log.Printf("Messageid %s still in other mailboxes, not deleting it", messageId)
+		return nil
+	}
+	return mdb.deleteMessageTx(eq, messageId)
+}
+
+// Replace a message with one of its variants, keeping its mailboxes
+// and flags
+func (mdb *MailDB) replaceMessageTx(eq sqlx.Ext, pm *PreparedMessage) error {
+	for _, table := range []string{
+		"lmdb_envelopejoin",
+		"lmdb_references",
+		"lmdb_attachments",
+	} {
+		_, err := eq.Exec(`delete from `+table+` where messageid=?`, pm.messageId)
+		if err != nil {
+			return fmt.Errorf("Deleting messageid %s from %s: %w", pm.messageId, table, err)
+		}
+	}
+	if err := mdb.unindexMessageTx(eq, pm.messageId); err != nil {
+		return err
+	}
+
+	_, err := eq.Exec(`
+        update lmdb_messages
+            set subject=?, date=?, message=?, inreplyto=?, size=?, listid=nullif(?, ''), hash=?
+            where messageid=?`,
+		pm.subject, pm.date, pm.message, pm.inReplyTo, len(pm.message), pm.listId, pm.hash,
+		pm.messageId)
+	if err != nil {
+		return fmt.Errorf("Replacing messageid %s: %w", pm.messageId, err)
+	}
+	_, err = eq.Exec(`delete from lmdb_message_variants where messageid=? and hash=?`, pm.messageId, pm.hash)
+	if err != nil {
+		return fmt.Errorf("Deleting variant of messageid %s: %w", pm.messageId, err)
+	}
+
+	log.Printf("Messageid %s replaced by its oldest variant", pm.messageId)
+	return mdb.addMessageDataTx(eq, pm, nil)
+}
+
+// Migration helper: give the message stored under an empty
+// Message-ID (before they were normalised) its synthetic one.
+// Foreign keys are checked at the end of the transaction, so the
+// message and everything referring to it can be changed one after
+// the other.
+func renameEmptyMessageIdTx(eq sqlx.Ext) error {
+	var message []byte
+	err := sqlx.Get(eq, &message, `select message from lmdb_messages where messageid=''`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Getting message without messageid: %w", err)
+	}
+
+	h, hash, err := rawContentHash(message)
+	if err != nil {
+		log.Printf("Can't parse message without messageid, leaving it: %v", err)
+		return nil
+	}
+	id := messageIdFor(h, hash)
+
+	if _, err := eq.Exec(`pragma defer_foreign_keys = on`); err != nil {
+		return fmt.Errorf("Deferring foreign keys: %w", err)
+	}
+
+	for _, table := range []string{
+		"lmdb_messages",
+		"lmdb_envelopejoin",
+		"lmdb_references",
+		"lmdb_attachments",
+		"lmdb_mailbox_flags",
+		"lmdb_mailbox_join",
+		"lmdb_journal",
+		"lmdb_fts_pending",
+	} {
+		_, err := eq.Exec(`update `+table+` set messageid=? where messageid=''`, id)
+		if err != nil {
+			return fmt.Errorf("Renaming message without messageid in %s: %w", table, err)
+		}
+	}
+	_, err = eq.Exec(`update lmdb_messages set hash=? where messageid=?`, hash, id)
+	if err != nil {
+		return fmt.Errorf("Recording hash of messageid %s: %w", id, err)
+	}
+
+	// The full-text index may not be available now; if it isn't, the
+	// old entry is just left behind (see unindexMessageTx).
+	_, err = eq.Exec(`insert into lmdb_fts_pending(messageid) values(?) on conflict do nothing`, id)
+	if err != nil {
+		return fmt.Errorf("Adding message to pending index list: %w", err)
+	}
+
+	log.Printf("Message without messageid is now %s", id)
+	return nil
+}
+
+// Migration helper: normalise the Message-IDs of messages added
+// before they were normalised, giving one stored under an empty
+// Message-ID its synthetic one.  Where that makes two messages' IDs
+// the same, the one being renamed becomes a variant of the other (or
+// is dropped, if it's a copy), and its mailbox entries and flags go
+// to the other.  References, In-Reply-To and the Message-IDs in
+// maildirsrc's source state are normalised to match.
+//
+// Foreign keys are checked at the end of the transaction, so a
+// message and everything referring to it can be changed one after
+// the other.
+func normalizeMessageIdsTx(eq sqlx.Ext) error {
+	if _, err := eq.Exec(`pragma defer_foreign_keys = on`); err != nil {
+		return fmt.Errorf("Deferring foreign keys: %w", err)
+	}
+
+	var ids []string
+	if err := sqlx.Select(eq, &ids, `select messageid from lmdb_messages order by rowid`); err != nil {
+		return fmt.Errorf("Getting messageids: %w", err)
+	}
+
+	renamed := map[string]string{}
+	for _, old := range ids {
+		if old != "" && NormalizeMessageId(old) == old {
+			continue
+		}
+		id, err := normalizeMessageIdTx(eq, old)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			renamed[old] = id
+		}
+	}
+	if len(renamed) > 0 {
+		log.Printf("Normalised %d messageids", len(renamed))
+	}
+
+	if err := normalizeReferencesTx(eq); err != nil {
+		return err
+	}
+	return normalizeMaildirStateTx(eq, renamed)
+}
+
+// Normalise one message's Message-ID, returning the new one, or ""
+// if it had to be left alone.
+func normalizeMessageIdTx(eq sqlx.Ext, old string) (string, error) {
+	var message []byte
+	if err := sqlx.Get(eq, &message, `select message from lmdb_messages where messageid=?`, old); err != nil {
+		return "", fmt.Errorf("Getting messageid %s: %w", old, err)
+	}
+	_, hash, hashErr := rawContentHash(message)
+
+	id := NormalizeMessageId(old)
+	if id == "" {
+		if hashErr != nil {
+			log.Printf("Can't parse message without messageid, leaving it: %v", hashErr)
+			return "", nil
+		}
+		id = syntheticMessageId(hash)
+	}
+
+	existingHash, err := messageHashTx(eq, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return id, renameMessageTx(eq, old, id, hash)
+	} else if err != nil {
+		return "", err
+	}
+
+	// Already taken: keep this one as a variant, unless it's a copy
+	if hashErr == nil && existingHash != "" && hash != existingHash {
+		_, err := eq.Exec(`
+        insert into lmdb_message_variants(messageid, hash, message, size)
+            values(?, ?, ?, ?)
+            on conflict do nothing`,
+			id, hash, message, len(message))
+		if err != nil {
+			return "", fmt.Errorf("Inserting variant of messageid %s: %w", id, err)
+		}
+	}
+	return id, mergeMessageTx(eq, old, id)
+}
+
+// Give a message a new Message-ID, which isn't taken
+func renameMessageTx(eq sqlx.Ext, old, id, hash string) error {
+	for _, table := range []string{
+		"lmdb_messages",
+		"lmdb_envelopejoin",
+		"lmdb_references",
+		"lmdb_attachments",
+		"lmdb_mailbox_flags",
+		"lmdb_mailbox_join",
+		"lmdb_journal",
+		"lmdb_fts_pending",
+	} {
+		_, err := eq.Exec(`update `+table+` set messageid=? where messageid=?`, id, old)
+		if err != nil {
+			return fmt.Errorf("Renaming messageid %s in %s: %w", old, table, err)
+		}
+	}
+	if hash != "" {
+		_, err := eq.Exec(`update lmdb_messages set hash=? where messageid=?`, hash, id)
+		if err != nil {
+			return fmt.Errorf("Recording hash of messageid %s: %w", id, err)
+		}
+	}
+
+	// The full-text index is keyed by rowid, so needs nothing doing
+	return nil
+}
+
+// Drop a message whose Message-ID normalises to one already taken,
+// after moving its mailbox entries, flags and journal entries to the
+// message with that one
+func mergeMessageTx(eq sqlx.Ext, old, id string) error {
+	// Entries without a UID (i.e., local ones) only where there isn't
+	// one already
+	_, err := eq.Exec(`
+        update lmdb_mailbox_join set messageid=?
+            where messageid=? and (uid is not null or mailboxid not in
+                (select mailboxid from lmdb_mailbox_join where messageid=?))`,
+		id, old, id)
+	if err != nil {
+		return fmt.Errorf("Moving mailbox entries of messageid %s: %w", old, err)
+	}
+	_, err = eq.Exec(`update or ignore lmdb_mailbox_flags set messageid=? where messageid=?`, id, old)
+	if err != nil {
+		return fmt.Errorf("Moving flags of messageid %s: %w", old, err)
+	}
+	_, err = eq.Exec(`update lmdb_journal set messageid=? where messageid=?`, id, old)
+	if err != nil {
+		return fmt.Errorf("Moving journal entries of messageid %s: %w", old, err)
+	}
+
+	// The full-text index may not be available now
+	if err := queueUnindexTx(eq, old); err != nil {
+		return err
+	}
+	for _, table := range []string{
+		"lmdb_envelopejoin",
+		"lmdb_references",
+		"lmdb_attachments",
+		"lmdb_mailbox_flags",
+		"lmdb_mailbox_join",
+		"lmdb_messages",
+	} {
+		_, err := eq.Exec(`delete from `+table+` where messageid=?`, old)
+		if err != nil {
+			return fmt.Errorf("Deleting messageid %s from %s: %w", old, table, err)
+		}
+	}
+	return nil
+}
+
+// Normalise References and In-Reply-To, which were only ever taken
+// from between angle brackets, so whitespace is all that can differ
+func normalizeReferencesTx(eq sqlx.Ext) error {
+	var refids []string
+	if err := sqlx.Select(eq, &refids, `select distinct refid from lmdb_references`); err != nil {
+		return fmt.Errorf("Getting references: %w", err)
+	}
+	for _, refid := range refids {
+		if id := NormalizeMessageId(refid); id != refid && id != "" {
+			_, err := eq.Exec(`update lmdb_references set refid=? where refid=?`, id, refid)
+			if err != nil {
+				return fmt.Errorf("Normalising reference %s: %w", refid, err)
+			}
+		}
+	}
+
+	var inReplyTos []string
+	err := sqlx.Select(eq, &inReplyTos, `
+        select distinct inreplyto from lmdb_messages
+            where inreplyto is not null and inreplyto != ''`)
+	if err != nil {
+		return fmt.Errorf("Getting In-Reply-To: %w", err)
+	}
+	for _, irt := range inReplyTos {
+		var id string
+		if ids := parseMsgIdList(irt); len(ids) > 0 {
+			id = ids[0]
+		}
+		if id != irt {
+			_, err := eq.Exec(`update lmdb_messages set inreplyto=? where inreplyto=?`, id, irt)
+			if err != nil {
+				return fmt.Errorf("Normalising In-Reply-To %s: %w", irt, err)
+			}
+		}
+	}
+	return nil
+}
+
+// maildirsrc records "info messageid" for each file it's seen, with
+// an empty Message-ID if the file couldn't be parsed; or, before
+// synthetic Message-IDs, hadn't got one.  Those files are forgotten,
+// so that they're read again.
+func normalizeMaildirStateTx(eq sqlx.Ext, renamed map[string]string) error {
+	var states []struct {
+		Source, Key, Value string
+	}
+	err := sqlx.Select(eq, &states, `
+        select source, key, value from lmdb_source_state
+            where source like 'maildir:%'`)
+	if err != nil {
+		return fmt.Errorf("Getting maildir source state: %w", err)
+	}
+
+	for _, state := range states {
+		info, old, ok := strings.Cut(state.Value, " ")
+		if !ok {
+			continue
+		}
+		if old == "" {
+			_, err := eq.Exec(`delete from lmdb_source_state where source=? and key=?`,
+				state.Source, state.Key)
+			if err != nil {
+				return fmt.Errorf("Deleting source state %s: %w", state.Key, err)
+			}
+			continue
+		}
+		id, ok := renamed[old]
+		if !ok {
+			id = NormalizeMessageId(old)
+		}
+		if id != old && id != "" {
+			_, err := eq.Exec(`update lmdb_source_state set value=? where source=? and key=?`,
+				info+" "+id, state.Source, state.Key)
+			if err != nil {
+				return fmt.Errorf("Updating source state %s: %w", state.Key, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package localmaildb
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeMessageId(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"<a@x>", "<a@x>"},
+		{"  <a@x>\r\n", "<a@x>"},
+		{"a@x", "<a@x>"},
+		{"<a@\r\n x>", "<a@x>"},
+		{"<a@x> (added by a list)", "<a@x>"},
+		{"<a@x> <b@x>", "<a@x>"},
+		{"", ""},
+		{" ", ""},
+		{"<>", ""},
+	} {
+		if got := NormalizeMessageId(tc.in); got != tc.want {
+			t.Errorf("ERROR: NormalizeMessageId(%q): got %q, wanted %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMessageVariants(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "msgid-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	// Messages without a Message-ID are told apart by their content,
+	// and the ID doesn't depend on line endings
+	noid1 := testMessage("", 1)
+	noid2 := testMessage("", 2)
+	ids := map[string]bool{}
+	for _, message := range [][]byte{noid1, noid2} {
+		msgid, err := RawMessageId(message)
+		if err != nil {
+			t.Fatalf("Getting message id: %v", err)
+		}
+		if !strings.HasSuffix(msgid, "@"+syntheticDomain+">") {
+			t.Errorf("ERROR: Unexpected synthetic message id %s", msgid)
+		}
+		ids[msgid] = true
+		if err := mdb.AddMessage(message); err != nil {
+			t.Fatalf("Adding message without message id: %v", err)
+		}
+		if prs, err := mdb.IsMsgIdPresent(msgid); err != nil || !prs {
+			t.Errorf("ERROR: %s not present (%v)", msgid, err)
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("ERROR: Different messages got the same synthetic message id")
+	}
+	lf, _ := RawMessageId([]byte(strings.ReplaceAll(string(noid1), "\r\n", "\n")))
+	if !ids[lf] {
+		t.Errorf("ERROR: Synthetic message id %s changed with line endings", lf)
+	}
+	if err := mdb.AddMessage(noid1); !errors.Is(err, ErrMsgidPresent) {
+		t.Errorf("ERROR: Adding message without message id again: wanted ErrMsgidPresent, got %v", err)
+	}
+
+	// Message-IDs are stored normalised, and can be looked up either
+	// way
+	first := testMessage(" <a@x> ", 1)
+	if err := mdb.AddMessage(first); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	for _, msgid := range []string{"<a@x>", "a@x"} {
+		if prs, err := mdb.IsMsgIdPresent(msgid); err != nil || !prs {
+			t.Errorf("ERROR: %s not present (%v)", msgid, err)
+		}
+	}
+
+	// A different message with the same Message-ID is a variant; the
+	// same one again isn't
+	variant := testMessage("<a@x>", 3)
+	for i, want := range []error{nil, ErrMsgidPresent} {
+		if err := mdb.AddMessage(variant); !errors.Is(err, want) {
+			t.Errorf("ERROR: Adding variant (%d): wanted %v, got %v", i, want, err)
+		}
+	}
+	copied := strings.ReplaceAll(string(first), "\r\n", "\n")
+	if err := mdb.AddMessage([]byte(copied)); !errors.Is(err, ErrMsgidPresent) {
+		t.Errorf("ERROR: Adding copy: wanted ErrMsgidPresent, got %v", err)
+	}
+	variants, err := mdb.GetMessageVariants("<a@x>")
+	if err != nil {
+		t.Fatalf("Getting variants: %v", err)
+	}
+	if len(variants) != 1 || string(variants[0]) != string(variant) {
+		t.Errorf("ERROR: Got %d variants, wanted the one added", len(variants))
+	}
+
+	// ...which doesn't show up in threads
+	if err := mdb.AddMessage(testMessage("<b@x>", 4, "In-Reply-To: <a@x>\r\n")); err != nil {
+		t.Fatalf("Adding reply: %v", err)
+	}
+	tree, err := mdb.GetTreeFromMessageId("<a@x>")
+	if err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if err := mdb.GetTree(tree); err != nil {
+		t.Fatalf("Getting thread: %v", err)
+	}
+	if got, want := treeString(tree), "<a@x>(<b@x>)"; got != want {
+		t.Errorf("ERROR: Got tree %s, wanted %s", got, want)
+	}
+
+	// Deleting the message deletes its variants
+	if err := mdb.DeleteMessage("<a@x>"); err != nil {
+		t.Fatalf("Deleting message: %v", err)
+	}
+	if variants, err := mdb.GetMessageVariants("<a@x>"); err != nil || len(variants) != 0 {
+		t.Errorf("ERROR: %d variants left after delete (%v)", len(variants), err)
+	}
+}
+
+// Everything which takes a Message-ID takes it as written in a header
+func TestMessageIdEntryPoints(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "msgid-entry-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	for _, mailbox := range []string{"test", "other"} {
+		if err := mdb.CreateMailbox(mailbox); err != nil {
+			t.Fatalf("Creating mailbox: %v", err)
+		}
+	}
+	if err := mdb.AddMessage(testMessage("<a@x>", 1)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	if err := mdb.AddMessage(testMessage("<b@x>", 2, "In-Reply-To: < a@x > (Test's message)\r\n")); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	var inReplyTo string
+	if err := mdb.db.Get(&inReplyTo, `select inreplyto from lmdb_messages where messageid='<b@x>'`); err != nil {
+		t.Fatalf("Getting In-Reply-To: %v", err)
+	} else if inReplyTo != "<a@x>" {
+		t.Errorf("ERROR: Got In-Reply-To %q, wanted <a@x>", inReplyTo)
+	}
+
+	if err := mdb.UpdateMailbox("test", []string{"a@x", " <b@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	if err := mdb.SetFlags("test", "a@x", []string{FlagSeen}); err != nil {
+		t.Fatalf("Setting flags: %v", err)
+	}
+	if err := mdb.ChangeFlags("test", "a@x", []string{FlagFlagged}, nil); err != nil {
+		t.Fatalf("Changing flags: %v", err)
+	}
+	flags, err := mdb.GetFlags("test", "<a@x>")
+	if err != nil {
+		t.Fatalf("Getting flags: %v", err)
+	}
+	if got, want := strings.Join(flags, " "), `\Flagged \Seen`; got != want {
+		t.Errorf("ERROR: Got flags %q, wanted %q", got, want)
+	}
+
+	if mb, err := mdb.GetMessageBody("a@x"); err != nil || !strings.Contains(mb.Text, "Body of <a@x>") {
+		t.Errorf("ERROR: Getting body: %v", err)
+	}
+
+	if err := mdb.MoveMessage("test", "other", "b@x"); err != nil {
+		t.Fatalf("Moving message: %v", err)
+	}
+	messages, err := mdb.GetMailboxMessages("other")
+	if err != nil {
+		t.Fatalf("Getting mailbox messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Envelope.MessageId != "<b@x>" {
+		t.Errorf("ERROR: Moved message not in destination mailbox")
+	}
+
+	if err := mdb.DeleteMessage("a@x"); err != nil {
+		t.Fatalf("Deleting message: %v", err)
+	}
+	if prs, err := mdb.IsMsgIdPresent("<a@x>"); err != nil || prs {
+		t.Errorf("ERROR: Message present after delete (%v)", err)
+	}
+}
+
+func TestDeleteMessageCopy(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "msgid-delete-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+	copies := [][]byte{testMessage("<a@x>", 1), testMessage("<a@x>", 2), testMessage("<a@x>", 3)}
+	for _, message := range copies {
+		if err := mdb.AddMessage(message); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	if err := mdb.UpdateMailbox("test", []string{"<a@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	if err := mdb.SetFlags("test", "<a@x>", []string{FlagSeen}); err != nil {
+		t.Fatalf("Setting flags: %v", err)
+	}
+
+	check := func(what string, message []byte, variants ...[]byte) {
+		t.Helper()
+		var got []byte
+		if err := mdb.db.Get(&got, `select message from lmdb_messages where messageid='<a@x>'`); err != nil {
+			t.Fatalf("%s: Getting message: %v", what, err)
+		}
+		if string(got) != string(message) {
+			t.Errorf("ERROR: %s: got message %q, wanted %q", what, got, message)
+		}
+		gotVariants, err := mdb.GetMessageVariants("<a@x>")
+		if err != nil {
+			t.Fatalf("%s: Getting variants: %v", what, err)
+		}
+		if !reflect.DeepEqual(gotVariants, variants) && len(gotVariants)+len(variants) > 0 {
+			t.Errorf("ERROR: %s: got %d variants, wanted %d", what, len(gotVariants), len(variants))
+		}
+		flags, err := mdb.GetFlags("test", "<a@x>")
+		if err != nil || len(flags) != 1 || flags[0] != FlagSeen {
+			t.Errorf("ERROR: %s: got flags %v (%v), wanted %s", what, flags, err, FlagSeen)
+		}
+	}
+	check("initial", copies[0], copies[1], copies[2])
+
+	// A variant goes on its own
+	if err := mdb.DeleteMessageCopy("test", copies[1]); err != nil {
+		t.Fatalf("Deleting variant: %v", err)
+	}
+	check("variant deleted", copies[0], copies[2])
+
+	// The message is replaced by the remaining variant; deleting it
+	// again does nothing
+	for i := 0; i < 2; i++ {
+		if err := mdb.DeleteMessageCopy("test", copies[0]); err != nil {
+			t.Fatalf("Deleting message: %v", err)
+		}
+		check("message deleted", copies[2])
+	}
+
+	// The last copy only takes the message with it once it's in no
+	// other mailbox
+	if err := mdb.CreateMailbox("other"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("other", []string{"<a@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	if err := mdb.DeleteMessageCopy("test", copies[2]); err != nil {
+		t.Fatalf("Deleting last copy: %v", err)
+	}
+	if prs, err := mdb.IsMsgIdPresent("<a@x>"); err != nil || !prs {
+		t.Errorf("ERROR: Message deleted while in another mailbox (%v)", err)
+	}
+	if messages, err := mdb.GetMailboxMessages("test"); err != nil || len(messages) != 0 {
+		t.Errorf("ERROR: Message still in mailbox after deleting it (%v)", err)
+	}
+	if err := mdb.DeleteMessageCopy("other", copies[2]); err != nil {
+		t.Fatalf("Deleting last copy: %v", err)
+	}
+	if prs, err := mdb.IsMsgIdPresent("<a@x>"); err != nil || prs {
+		t.Errorf("ERROR: Message present after deleting every copy (%v)", err)
+	}
+}
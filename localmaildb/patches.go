@@ -43,7 +43,15 @@ func appendMessage(mtp *[]*MessageTree, msg *MessageTree) {
 func TreeFilterAm(tree *MessageTree) []*MessageTree {
 	var mt []*MessageTree
 
-	switch SubjectDetectPatch(tree.Envelope.Subject) {
+	patchType := SubjectDetectPatch(tree.Envelope.Subject)
+
+	// A placeholder root (e.g., a missing cover letter) has the
+	// subject of its first reply; treat it like a cover letter.
+	if tree.Placeholder && patchType != PatchMailNone {
+		patchType = PatchMail0N
+	}
+
+	switch patchType {
 	case PatchMailNone:
 		return nil
 	case PatchMailSingleton:
@@ -56,7 +64,7 @@ func TreeFilterAm(tree *MessageTree) []*MessageTree {
 		// If the root is 0/N, skip the root, but include all replies which are M/N.
 		// If the root is M/N, include all replies which are M/N.
 		for _, reply := range tree.Replies {
-			if SubjectDetectPatch(reply.Envelope.Subject) == PatchMailMN {
+			if !reply.Placeholder && SubjectDetectPatch(reply.Envelope.Subject) == PatchMailMN {
 				appendMessage(&mt, reply)
 			}
 		}
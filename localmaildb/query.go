@@ -1,6 +1,8 @@
 package localmaildb
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"sort"
@@ -8,7 +10,6 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/jmoiron/sqlx"
-	"gitlab.com/martyros/sqlutil/txutil"
 )
 
 type MessageTree struct {
@@ -16,18 +17,43 @@ type MessageTree struct {
 	Envelope         imap.Envelope
 	Replies          []*MessageTree
 	Earliest, Latest time.Time
+
+	// Placeholder is set for messages which are referred to by
+	// other messages, but which aren't in the database.  Only
+	// Envelope.MessageId and Replies are meaningful; Subject and
+	// Date are copied from the earliest reply.
+	Placeholder bool
+
+	// Direct parent and oldest ancestor from the References chain;
+	// either may be missing from the database.  Empty if the
+	// message has no references.
+	parentId, threadRootId string
 }
 
-// "Standard" code to scan a message row
-func scanMessage(rows *sqlx.Rows) (*MessageTree, error) {
+// Columns expected by scanMessage, for a query on lmdb_messages
+// named `self`
+const messageColumns = `self.messageid, self.subject, self.date, self.message,
+    (select refid from lmdb_references
+         where messageid = self.messageid order by position desc limit 1),
+    (select refid from lmdb_references
+         where messageid = self.messageid order by position asc limit 1)`
+
+// "Standard" code to scan a message row.  Any columns after
+// messageColumns are scanned into extra.
+func scanMessage(rows *sqlx.Rows, extra ...interface{}) (*MessageTree, error) {
 	message := &MessageTree{}
 
 	var messageString string
+	var parentId, threadRootId sql.NullString
 
-	err := rows.Scan(&message.Envelope.MessageId,
+	dest := append([]interface{}{&message.Envelope.MessageId,
 		&message.Envelope.Subject,
 		&message.Envelope.Date,
-		&messageString)
+		&messageString,
+		&parentId,
+		&threadRootId}, extra...)
+
+	err := rows.Scan(dest...)
 
 	if err != nil {
 		return nil, err
@@ -35,11 +61,47 @@ func scanMessage(rows *sqlx.Rows) (*MessageTree, error) {
 
 	message.Latest = message.Envelope.Date
 	message.RawMessage = []byte(messageString)
+	message.parentId = parentId.String
+	message.threadRootId = threadRootId.String
 
 	return message, nil
 }
 
+func newPlaceholder(messageId string) *MessageTree {
+	return &MessageTree{Placeholder: true, Envelope: imap.Envelope{MessageId: messageId}}
+}
+
+func sortMessages(messages []*MessageTree) {
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Envelope.Date.Before(messages[j].Envelope.Date) })
+}
+
+// Add a (sorted) list of messages to placeholder, filling in the
+// placeholder's subject and date from the first one
+func placeholderAdopt(ph *MessageTree, messages ...*MessageTree) {
+	if len(ph.Replies) == 0 && len(messages) > 0 {
+		ph.Envelope.Subject = messages[0].Envelope.Subject
+		ph.Envelope.Date = messages[0].Envelope.Date
+		ph.Latest = messages[0].Latest
+	}
+	ph.Replies = append(ph.Replies, messages...)
+}
+
 func scanMessageList(eq sqlx.Ext, rows *sqlx.Rows) ([]*MessageTree, error) {
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := getEnvelopesTx(eq, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Like scanMessageList, but without the envelope addresses, for
+// callers which get those for several lists at once
+func scanMessages(rows *sqlx.Rows) ([]*MessageTree, error) {
 	messages := []*MessageTree{}
 
 	for rows.Next() {
@@ -54,38 +116,107 @@ func scanMessageList(eq sqlx.Ext, rows *sqlx.Rows) ([]*MessageTree, error) {
 	rows.Close()
 
 	// Sort by date order ascending
-	sort.Slice(messages, func(i, j int) bool { return messages[i].Envelope.Date.Before(messages[j].Envelope.Date) })
+	sortMessages(messages)
 
-	for i := range messages {
-		// FIXME: Do the rest of the header parts
-		message := messages[i]
-		err := sqlx.Select(eq, &message.Envelope.From, `
-		select personalname, mailboxname, hostname
-			from lmdb_messages 
-				natural join lmdb_envelopejoin
-				natural join lmdb_addresses
-			where messageid=?
-			  and envelopepart=?`, message.Envelope.MessageId, HeaderPartFrom)
+	return messages, nil
+}
+
+// Fill in the envelope addresses for a list of messages.  This is
+// done in as few queries as possible, rather than one per message.
+func getEnvelopesTx(eq sqlx.Ext, messages []*MessageTree) error {
+	byId := map[string]*MessageTree{}
+	msgids := []string{}
+	for _, message := range messages {
+		if message.Placeholder {
+			continue
+		}
+		byId[message.Envelope.MessageId] = message
+		msgids = append(msgids, message.Envelope.MessageId)
+	}
+
+	// Stay well inside sqlite's limit on the number of bound
+	// variables
+	const batchSize = 500
+
+	for len(msgids) > 0 {
+		batch := msgids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		msgids = msgids[len(batch):]
+
+		query, args, err := sqlx.In(`
+        select messageid, envelopepart, personalname, mailboxname, hostname
+            from lmdb_envelopejoin
+                natural join lmdb_addresses
+            where messageid in (?)
+            order by lmdb_envelopejoin.rowid`, batch)
+		if err != nil {
+			return fmt.Errorf("Building envelope query: %w", err)
+		}
+
+		rows, err := eq.Queryx(query, args...)
+		if err != nil {
+			return fmt.Errorf("Getting envelopes: %w", err)
+		}
+
+		for rows.Next() {
+			var messageId string
+			var part HeaderPart
+			addr := &imap.Address{}
+			err := rows.Scan(&messageId, &part, &addr.PersonalName, &addr.MailboxName, &addr.HostName)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("Scanning envelopes: %w", err)
+			}
+
+			envelope := &byId[messageId].Envelope
+			switch part {
+			case HeaderPartFrom:
+				envelope.From = append(envelope.From, addr)
+			case HeaderPartSender:
+				envelope.Sender = append(envelope.Sender, addr)
+			case HeaderPartReplyTo:
+				envelope.ReplyTo = append(envelope.ReplyTo, addr)
+			case HeaderPartTo:
+				envelope.To = append(envelope.To, addr)
+			case HeaderPartCc:
+				envelope.Cc = append(envelope.Cc, addr)
+			case HeaderPartBcc:
+				envelope.Bcc = append(envelope.Bcc, addr)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
 		if err != nil {
-			return nil, fmt.Errorf("Getting From envelope for messageid %s: %w",
-				message.Envelope.MessageId, err)
+			return fmt.Errorf("Getting envelopes: %w", err)
 		}
 	}
 
-	return messages, nil
+	return nil
 }
 
+// GetMessageRoots returns the roots of all threads containing
+// messages in the mailbox.  Roots whose References chain is entirely
+// missing from the database are grouped under a placeholder for the
+// oldest reference, whose replies will be filled in by GetTree.
 func (mdb *MailDB) GetMessageRoots(mailboxname string) ([]*MessageTree, error) {
+	return mdb.GetMessageRootsContext(context.Background(), mailboxname)
+}
+
+// GetMessageRootsContext is like GetMessageRoots, but takes a context.
+func (mdb *MailDB) GetMessageRootsContext(ctx context.Context, mailboxname string) ([]*MessageTree, error) {
 	var messages []*MessageTree
 
-	err := txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
 		mboxid, err := mailboxNameToIdTx(eq, mailboxname)
 		if err != nil {
 			return err
 		}
 
 		// Find all messages in the inbox.
-		// Find the "roots" of all these trees
+		// Find the "roots" of all these trees: the ones with no
+		// ancestors in the database.
 		// Return them.
 		rows, err := eq.Queryx(`
         WITH RECURSIVE
@@ -94,23 +225,47 @@ func (mdb *MailDB) GetMessageRoots(mailboxname string) ([]*MessageTree, error) {
                      from lmdb_mailbox_join
                      where mailboxid=?
                  union
-                 select lmdb_messages.inreplyto
-                     from lmdb_messages join ancestor using(messageid))
-        select self.messageid, self.subject, self.date, self.message
+                 select lmdb_references.refid
+                     from lmdb_references join ancestor using(messageid))
+        select `+messageColumns+`
             from lmdb_messages as self
-                left join lmdb_messages as parent
-                on self.inreplyto = parent.messageid
         where self.messageid in ancestor
-              and IFNULL(parent.messageid, TRUE)`, mboxid)
+              and not exists
+                (select 1 from lmdb_references as ref
+                     join lmdb_messages as known on known.messageid = ref.refid
+                     where ref.messageid = self.messageid)`, mboxid)
 		if err != nil {
 			return fmt.Errorf("Error getting 'root' message list: %w", err)
 		}
 
-		messages, err = scanMessageList(eq, rows)
+		roots, err := scanMessageList(eq, rows)
 		if err != nil {
 			return err
 		}
 
+		messages = nil
+		placeholders := map[string]*MessageTree{}
+		for _, root := range roots {
+			if root.threadRootId == "" {
+				messages = append(messages, root)
+				continue
+			}
+			ph := placeholders[root.threadRootId]
+			if ph == nil {
+				ph = newPlaceholder(root.threadRootId)
+				placeholders[root.threadRootId] = ph
+				messages = append(messages, ph)
+			}
+			placeholderAdopt(ph, root)
+		}
+
+		// The replies will be filled in properly by GetTree
+		for _, ph := range placeholders {
+			ph.Replies = nil
+		}
+
+		sortMessages(messages)
+
 		return nil
 	})
 
@@ -121,24 +276,89 @@ func (mdb *MailDB) GetMessageRoots(mailboxname string) ([]*MessageTree, error) {
 	return messages, nil
 }
 
+// Fill in the replies to root, recursively.  The envelope addresses
+// of the whole tree are fetched together at the end, rather than for
+// each message's replies.
 func getTreeTx(eq sqlx.Ext, root *MessageTree) error {
-	// Get all messages in-reply-to the root
-	rows, err := eq.Queryx(`
-        select messageid, subject, date, message
-            from lmdb_messages where inreplyto = $messageid`,
-		root.Envelope.MessageId)
+	messages := []*MessageTree{}
+	if err := getRepliesTx(eq, root, map[string]bool{}, &messages); err != nil {
+		return err
+	}
+	return getEnvelopesTx(eq, messages)
+}
+
+// Fill in the replies to root, recursively, adding them to messages
+func getRepliesTx(eq sqlx.Ext, root *MessageTree, seen map[string]bool, messages *[]*MessageTree) error {
+	var rows *sqlx.Rows
+	var err error
+
+	// Protect against reference loops
+	if seen[root.Envelope.MessageId] {
+		return nil
+	}
+	seen[root.Envelope.MessageId] = true
+
+	if root.Placeholder {
+		// Get all messages with no ancestors in the database whose
+		// oldest reference is the root
+		rows, err = eq.Queryx(`
+        select `+messageColumns+`
+            from lmdb_references as ref
+                join lmdb_messages as self using(messageid)
+            where ref.refid = ? and ref.position = 0
+              and not exists
+                (select 1 from lmdb_references as ref2
+                     join lmdb_messages as known on known.messageid = ref2.refid
+                     where ref2.messageid = ref.messageid)`,
+			root.Envelope.MessageId)
+	} else {
+		// Get all messages for which the root is the nearest
+		// ancestor in the database
+		rows, err = eq.Queryx(`
+        select `+messageColumns+`
+            from lmdb_references as ref
+                join lmdb_messages as self using(messageid)
+            where ref.refid = ?
+              and not exists
+                (select 1 from lmdb_references as ref2
+                     join lmdb_messages as known on known.messageid = ref2.refid
+                     where ref2.messageid = ref.messageid
+                       and ref2.position > ref.position)`,
+			root.Envelope.MessageId)
+	}
 	if err != nil {
 		return fmt.Errorf("Getting reply message list for messageid %s: %w",
 			root.Envelope.MessageId, err)
 	}
 
-	if root.Replies, err = scanMessageList(eq, rows); err != nil {
+	replies, err := scanMessages(rows)
+	if err != nil {
 		return err
 	}
+	*messages = append(*messages, replies...)
+
+	// Replies whose direct parent is missing go under a placeholder
+	// for the parent
+	root.Replies = nil
+	placeholders := map[string]*MessageTree{}
+	for _, message := range replies {
+		if message.parentId == root.Envelope.MessageId {
+			root.Replies = append(root.Replies, message)
+			continue
+		}
+		ph := placeholders[message.parentId]
+		if ph == nil {
+			ph = newPlaceholder(message.parentId)
+			placeholders[message.parentId] = ph
+			root.Replies = append(root.Replies, ph)
+		}
+		placeholderAdopt(ph, message)
+	}
+	sortMessages(root.Replies)
 
 	// And get all the messages for those
-	for _, message := range root.Replies {
-		if err := getTreeTx(eq, message); err != nil {
+	for _, message := range replies {
+		if err := getRepliesTx(eq, message, seen, messages); err != nil {
 			return err
 		}
 	}
@@ -146,40 +366,98 @@ func getTreeTx(eq sqlx.Ext, root *MessageTree) error {
 	return nil
 }
 
+// GetMailboxMessages returns all the messages in the mailbox, oldest
+// first, without their replies.
+func (mdb *MailDB) GetMailboxMessages(mailboxname string) ([]*MessageTree, error) {
+	return mdb.GetMailboxMessagesContext(context.Background(), mailboxname)
+}
+
+// GetMailboxMessagesContext is like GetMailboxMessages, but takes a context.
+func (mdb *MailDB) GetMailboxMessagesContext(ctx context.Context, mailboxname string) ([]*MessageTree, error) {
+	var messages []*MessageTree
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		mboxid, err := mailboxNameToIdTx(eq, mailboxname)
+		if err != nil {
+			return err
+		}
+
+		rows, err := eq.Queryx(`
+        select `+messageColumns+`
+            from lmdb_messages as self
+            where self.messageid in
+                (select messageid from lmdb_mailbox_join where mailboxid=?)`, mboxid)
+		if err != nil {
+			return fmt.Errorf("Getting messages in mailbox %s: %w", mailboxname, err)
+		}
+
+		messages, err = scanMessageList(eq, rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
 func (mdb *MailDB) GetTree(root *MessageTree) error {
-	return txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+	return mdb.GetTreeContext(context.Background(), root)
+}
+
+// GetTreeContext is like GetTree, but takes a context.
+func (mdb *MailDB) GetTreeContext(ctx context.Context, root *MessageTree) error {
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
 		return getTreeTx(eq, root)
 	})
 }
 
 func (mdb *MailDB) GetTreeFromMessageId(msgid string) (*MessageTree, error) {
+	return mdb.GetTreeFromMessageIdContext(context.Background(), msgid)
+}
+
+// GetTreeFromMessageIdContext is like GetTreeFromMessageId, but takes a context.
+func (mdb *MailDB) GetTreeFromMessageIdContext(ctx context.Context, msgid string) (*MessageTree, error) {
 	var message *MessageTree
+	msgid = NormalizeMessageId(msgid)
 
-	return message, txutil.TxLoopDb(mdb.db, func(eq sqlx.Ext) error {
+	return message, mdb.txLoop(ctx, func(eq sqlx.Ext) error {
 
 		rows, err := eq.Queryx(`
-        select self.messageid, self.subject, self.date, self.message
+        select `+messageColumns+`
             from lmdb_messages as self
-                left join lmdb_messages as parent
-                on self.inreplyto = parent.messageid
         where self.messageid=?`, msgid)
 		if err != nil {
 			return fmt.Errorf("Error getting message with messageid %s: %w", msgid, err)
 		}
 
-		if messages, err := scanMessageList(eq, rows); err != nil {
+		// The envelope is filled in with the rest of the tree's
+		if messages, err := scanMessages(rows); err != nil {
 			return err
+		} else if len(messages) == 0 {
+			// It may be a missing message other messages refer to
+			// (i.e., a placeholder root from GetMessageRoots)
+			var n int
+			err := sqlx.Get(eq, &n, `select count(*) from lmdb_references where refid=?`, msgid)
+			if err != nil {
+				return fmt.Errorf("Looking for references to messageid %s: %w", msgid, err)
+			}
+			if n == 0 {
+				return fmt.Errorf("Unexpected number of messages found: %d", len(messages))
+			}
+			message = newPlaceholder(msgid)
 		} else if len(messages) != 1 {
 			return fmt.Errorf("Unexpected number of messages found: %d", len(messages))
 		} else {
 			message = messages[0]
 		}
 
-		if err := getTreeTx(eq, message); err != nil {
+		messages := []*MessageTree{message}
+		if err := getRepliesTx(eq, message, map[string]bool{}, &messages); err != nil {
 			return err
 		}
 
-		return nil
+		return getEnvelopesTx(eq, messages)
 
 	})
 }
@@ -0,0 +1,141 @@
+package localmaildb
+
+import (
+	"path"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func addressStrings(addrs []*imap.Address) []string {
+	out := []string{}
+	for _, addr := range addrs {
+		out = append(out, addr.PersonalName+" <"+addr.Address()+">")
+	}
+	return out
+}
+
+func TestEnvelopes(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "envelope-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	root := []byte("From: Fred <fred@example.com>\r\n" +
+		"Sender: List <list-bounces@example.org>\r\n" +
+		"Reply-To: list@example.org\r\n" +
+		"To: Jane <jane@example.com>, Bob <bob@example.com>\r\n" +
+		"Cc: Alice <alice@example.com>\r\n" +
+		"Bcc: Eve <eve@example.com>\r\n" +
+		"Subject: Root\r\n" +
+		"Date: Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"Message-ID: <a@x>\r\n" +
+		"\r\n" +
+		"Body\r\n")
+	if err := mdb.AddMessage(root); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	if err := mdb.AddMessage(testMessage("<b@x>", 2, "In-Reply-To: <a@x>\r\n")); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	if err := mdb.AddMessage(testMessage("<c@x>", 3, "References: <a@x> <b@x>\r\n")); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+
+	mt, err := mdb.GetTreeFromMessageId("<a@x>")
+	if err != nil {
+		t.Fatalf("Getting tree: %v", err)
+	}
+
+	tests := []struct {
+		part string
+		got  []*imap.Address
+		want []string
+	}{
+		{"From", mt.Envelope.From, []string{"Fred <fred@example.com>"}},
+		{"Sender", mt.Envelope.Sender, []string{"List <list-bounces@example.org>"}},
+		{"Reply-To", mt.Envelope.ReplyTo, []string{" <list@example.org>"}},
+		{"To", mt.Envelope.To, []string{"Jane <jane@example.com>", "Bob <bob@example.com>"}},
+		{"Cc", mt.Envelope.Cc, []string{"Alice <alice@example.com>"}},
+		{"Bcc", mt.Envelope.Bcc, []string{"Eve <eve@example.com>"}},
+	}
+	for _, test := range tests {
+		got := addressStrings(test.got)
+		if len(got) != len(test.want) {
+			t.Errorf("ERROR: %s: got %v, wanted %v", test.part, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("ERROR: %s: got %v, wanted %v", test.part, got, test.want)
+				break
+			}
+		}
+	}
+
+	if len(mt.Replies) != 1 {
+		t.Fatalf("Got %d replies, wanted 1", len(mt.Replies))
+	}
+	if got := addressStrings(mt.Replies[0].Envelope.From); len(got) != 1 || got[0] != "Test <test@example.com>" {
+		t.Errorf("ERROR: Reply From: got %v", got)
+	}
+
+	// All the way down the tree, whether it's got from the root or
+	// the Message-ID
+	root2 := &MessageTree{Envelope: imap.Envelope{MessageId: "<a@x>"}}
+	if err := mdb.GetTree(root2); err != nil {
+		t.Fatalf("Getting tree: %v", err)
+	}
+	for _, tree := range []*MessageTree{mt, root2} {
+		if len(tree.Replies) != 1 || len(tree.Replies[0].Replies) != 1 {
+			t.Fatalf("Got tree %s, wanted <a@x>(<b@x>(<c@x>))", treeString(tree))
+		}
+		reply := tree.Replies[0].Replies[0]
+		if got := addressStrings(reply.Envelope.From); len(got) != 1 || got[0] != "Test <test@example.com>" {
+			t.Errorf("ERROR: Reply to reply From: got %v", got)
+		}
+	}
+}
+
+func TestGetMailboxMessages(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "mailbox-messages-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	for _, m := range []struct {
+		msgid string
+		day   int
+	}{{"<c@x>", 3}, {"<a@x>", 1}, {"<b@x>", 2}} {
+		if err := mdb.AddMessage(testMessage(m.msgid, m.day)); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("test", []string{"<c@x>", "<a@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+
+	messages, err := mdb.GetMailboxMessages("test")
+	if err != nil {
+		t.Fatalf("Getting messages: %v", err)
+	}
+	got := []string{}
+	for _, m := range messages {
+		got = append(got, m.Envelope.MessageId)
+		if len(m.RawMessage) == 0 || len(m.Envelope.From) != 1 {
+			t.Errorf("ERROR: Message %s missing body or envelope", m.Envelope.MessageId)
+		}
+	}
+	if len(got) != 2 || got[0] != "<a@x>" || got[1] != "<c@x>" {
+		t.Errorf("ERROR: Got messages %v, wanted [<a@x> <c@x>]", got)
+	}
+}
@@ -0,0 +1,351 @@
+package localmaildb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Full-text search uses SQLite's FTS5 extension, which
+// mattn/go-sqlite3 only includes when built with `-tags sqlite_fts5`.
+// So the index itself (lmdb_fts) isn't part of the versioned schema:
+// it's created on attach if the extension is available.  Messages
+// added while it isn't (or before the index existed) are queued in
+// lmdb_fts_pending, and indexed the next time the database is
+// attached with FTS5 available.
+//
+// Rows in the index have the same rowid as the message in
+// lmdb_messages, so that removing one doesn't scan the whole index.
+// Messages deleted while FTS5 isn't available are queued (by rowid)
+// in lmdb_fts_deleted, and removed from the index before anything is
+// added to it; but only if there's an index to remove them from.
+
+// Whether this build of sqlite has FTS5
+func ftsAvailableTx(eq sqlx.Ext) (bool, error) {
+	var avail bool
+	err := sqlx.Get(eq, &avail, `select sqlite_compileoption_used('ENABLE_FTS5')`)
+	return avail, err
+}
+
+// Create the full-text index if possible, drop deleted messages from
+// it, and index any pending messages.  Sets mdb.fts if the index is
+// usable.
+func (mdb *MailDB) ensureSearchIndex(ctx context.Context) error {
+	var pending []string
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		avail, err := ftsAvailableTx(eq)
+		if err != nil {
+			return fmt.Errorf("Checking for FTS5: %w", err)
+		}
+		if !avail {
+			mdb.fts = false
+			return nil
+		}
+
+		// The index used to have an unindexed messageid column
+		// instead of sharing rowids with lmdb_messages; start again
+		var oldIndex int
+		err = sqlx.Get(eq, &oldIndex, `select count(*) from pragma_table_info('lmdb_fts') where name='messageid'`)
+		if err != nil {
+			return fmt.Errorf("Checking full-text index: %w", err)
+		} else if oldIndex > 0 {
+			log.Printf("Rebuilding full-text index")
+			err := execAll(`
+        drop table lmdb_fts`, `
+        delete from lmdb_fts_deleted`, `
+        insert into lmdb_fts_pending(messageid)
+            select messageid from lmdb_messages where true
+            on conflict do nothing`)(eq)
+			if err != nil {
+				return fmt.Errorf("Dropping old full-text index: %w", err)
+			}
+		}
+
+		_, err = eq.Exec(`
+        create virtual table if not exists lmdb_fts using fts5(
+            subject,
+            addresses,
+            body)`)
+		if err != nil {
+			return fmt.Errorf("Creating full-text index: %w", err)
+		}
+
+		mdb.fts = true
+
+		// Before indexing anything, so that a message deleted and
+		// added again (perhaps with the same rowid) isn't indexed
+		// twice
+		_, err = eq.Exec(`
+        delete from lmdb_fts
+            where rowid in (select ftsrowid from lmdb_fts_deleted)`)
+		if err != nil {
+			return fmt.Errorf("Removing deleted messages from full-text index: %w", err)
+		}
+		if _, err := eq.Exec(`delete from lmdb_fts_deleted`); err != nil {
+			return fmt.Errorf("Clearing deleted index entry list: %w", err)
+		}
+
+		pending = nil
+		return sqlx.Select(eq, &pending, `select messageid from lmdb_fts_pending`)
+	})
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	log.Printf("Adding %d messages to full-text index", len(pending))
+
+	// Do this in batches so that progress is kept if interrupted
+	const batchSize = 1000
+	for i := 0; i < len(pending); i += batchSize {
+		batch := pending[i:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+
+		err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+			for _, messageId := range batch {
+				var message string
+				err := sqlx.Get(eq, &message, `select message from lmdb_messages where messageid=?`, messageId)
+				if err != nil {
+					return fmt.Errorf("Getting messageid %s: %w", messageId, err)
+				}
+
+				m, err := mail.ReadMessage(bytes.NewReader([]byte(message)))
+				if err != nil {
+					return ErrParseError.wrap(err)
+				}
+
+				// Index what we can of broken messages, rather than
+				// leaving them out entirely
+				mb, err := ParseMessageBody([]byte(message))
+				if mb == nil {
+					return err
+				}
+
+				if err := indexMessageTx(eq, messageId, newSearchEntry(m, mb)); err != nil {
+					return err
+				}
+
+				_, err = eq.Exec(`delete from lmdb_fts_pending where messageid=?`, messageId)
+				if err != nil {
+					return fmt.Errorf("Removing pending index entry: %w", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("...indexed %d of %d", i+len(batch), len(pending))
+	}
+
+	return nil
+}
+
+// The text of a message to be indexed
+type searchEntry struct {
+	subject, addresses, body string
+}
+
+func newSearchEntry(m *mail.Message, mb *MessageBody) *searchEntry {
+	addresses := []string{}
+	for _, fieldName := range headerPartFieldName {
+		if fieldName == "" {
+			continue
+		}
+		if list, err := addressList(m.Header, fieldName); err == nil {
+			for _, addr := range list {
+				addresses = append(addresses, addr.String())
+			}
+		}
+	}
+
+	body := mb.Text
+	if body == "" {
+		body = htmlToText(mb.HTML)
+	}
+
+	return &searchEntry{
+		subject:   decodeHeader(m.Header.Get("Subject")),
+		addresses: strings.Join(addresses, ", "),
+		body:      body,
+	}
+}
+
+// Add a message to the full-text index, or to the pending list if
+// the index isn't available (in which case entry may be nil).
+func (mdb *MailDB) indexMessageTx(eq sqlx.Ext, messageId string, entry *searchEntry) error {
+	if !mdb.fts {
+		_, err := eq.Exec(`insert into lmdb_fts_pending(messageid) values(?) on conflict do nothing`,
+			messageId)
+		if err != nil {
+			return fmt.Errorf("Adding message to pending index list: %w", err)
+		}
+		return nil
+	}
+	return indexMessageTx(eq, messageId, entry)
+}
+
+func indexMessageTx(eq sqlx.Ext, messageId string, entry *searchEntry) error {
+	_, err := eq.Exec(`
+        insert into lmdb_fts(rowid, subject, addresses, body)
+            select rowid, ?, ?, ? from lmdb_messages where messageid=?`,
+		entry.subject, entry.addresses, entry.body, messageId)
+	if err != nil {
+		return fmt.Errorf("Adding messageid %s to full-text index: %w", messageId, err)
+	}
+
+	return nil
+}
+
+// Remove a message from the full-text index and the pending list.
+// If the index isn't available, the message is queued to be removed
+// from it when it is; see queueUnindexTx.  Must be called before the
+// message is deleted from lmdb_messages.
+func (mdb *MailDB) unindexMessageTx(eq sqlx.Ext, messageId string) error {
+	if !mdb.fts {
+		return queueUnindexTx(eq, messageId)
+	}
+	_, err := eq.Exec(`delete from lmdb_fts_pending where messageid=?`, messageId)
+	if err != nil {
+		return fmt.Errorf("Removing messageid %s from pending index list: %w", messageId, err)
+	}
+	_, err = eq.Exec(`
+        delete from lmdb_fts
+            where rowid=(select rowid from lmdb_messages where messageid=?)`, messageId)
+	if err != nil {
+		return fmt.Errorf("Removing messageid %s from full-text index: %w", messageId, err)
+	}
+	return nil
+}
+
+// Remove a message from the pending list, or if it was indexed, queue
+// it to be removed from the full-text index when the database is next
+// attached with FTS5 available (see ensureSearchIndex).  Nothing is
+// queued if the index hasn't been created: there's nothing to remove
+// it from.  Must be called before the message is deleted from
+// lmdb_messages.
+func queueUnindexTx(eq sqlx.Ext, messageId string) error {
+	res, err := eq.Exec(`delete from lmdb_fts_pending where messageid=?`, messageId)
+	if err != nil {
+		return fmt.Errorf("Removing messageid %s from pending index list: %w", messageId, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	var index int
+	err = sqlx.Get(eq, &index, `select count(*) from sqlite_master where name='lmdb_fts'`)
+	if err != nil {
+		return fmt.Errorf("Looking for full-text index: %w", err)
+	} else if index == 0 {
+		return nil
+	}
+
+	_, err = eq.Exec(`
+        insert into lmdb_fts_deleted(ftsrowid)
+            select rowid from lmdb_messages where messageid=?
+            on conflict do nothing`, messageId)
+	if err != nil {
+		return fmt.Errorf("Adding messageid %s to deleted index entry list: %w", messageId, err)
+	}
+	return nil
+}
+
+type SearchOptions struct {
+	MailboxName string // Only search messages in this mailbox, if set
+	Limit       int    // Maximum results to return; defaults to 50
+	Offset      int    // Number of results to skip, for paging
+}
+
+type SearchResult struct {
+	Message *MessageTree // Replies are not filled in
+	Snippet string       // Matching text, with matches in [brackets]
+	Rank    float64      // bm25() score; lower is better
+}
+
+// SearchAvailable reports whether Search can be used; see the
+// comment at the top of search.go.
+func (mdb *MailDB) SearchAvailable() bool {
+	return mdb.fts
+}
+
+// Search returns messages matching query, most relevant first.
+// query uses the FTS5 query syntax
+// (https://www.sqlite.org/fts5.html#full_text_query_syntax); the
+// columns which can be searched specifically are `subject`,
+// `addresses` and `body`, e.g. `subject:xen AND body:"page fault"`.
+// opts may be nil.
+func (mdb *MailDB) Search(query string, opts *SearchOptions) ([]SearchResult, error) {
+	return mdb.SearchContext(context.Background(), query, opts)
+}
+
+// SearchContext is like Search, but takes a context.
+func (mdb *MailDB) SearchContext(ctx context.Context, query string, opts *SearchOptions) ([]SearchResult, error) {
+	if !mdb.fts {
+		return nil, ErrNoSearch.wrap(fmt.Errorf("SQLite built without FTS5 (build with -tags sqlite_fts5)"))
+	}
+
+	if opts == nil {
+		opts = &SearchOptions{}
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	var results []SearchResult
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		rows, err := eq.Queryx(`
+        select `+messageColumns+`,
+                snippet(lmdb_fts, -1, '[', ']', '...', 16),
+                lmdb_fts.rank
+            from lmdb_fts
+                join lmdb_messages as self on self.rowid = lmdb_fts.rowid
+            where lmdb_fts match ?
+              and (? = '' or self.messageid in
+                    (select messageid from lmdb_mailbox_join natural join lmdb_mailboxes
+                         where lmdb_mailboxes.mailboxname = ?))
+            order by lmdb_fts.rank
+            limit ? offset ?`,
+			query, opts.MailboxName, opts.MailboxName, limit, opts.Offset)
+		if err != nil {
+			return fmt.Errorf("Searching for %q: %w", query, err)
+		}
+		defer rows.Close()
+
+		results = nil
+		messages := []*MessageTree{}
+		for rows.Next() {
+			var result SearchResult
+			result.Message, err = scanMessage(rows, &result.Snippet, &result.Rank)
+			if err != nil {
+				return fmt.Errorf("Scanning search results: %w", err)
+			}
+			results = append(results, result)
+			messages = append(messages, result.Message)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("Searching for %q: %w", query, err)
+		}
+		rows.Close()
+
+		return getEnvelopesTx(eq, messages)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
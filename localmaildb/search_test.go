@@ -0,0 +1,171 @@
+package localmaildb
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "search-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	if !mdb.SearchAvailable() {
+		if _, err := mdb.Search("anything", nil); !errors.Is(err, ErrNoSearch) {
+			t.Errorf("ERROR: Search without FTS5: wanted ErrNoSearch, got %v", err)
+		}
+		t.Skip("SQLite built without FTS5; run tests with -tags sqlite_fts5")
+	}
+
+	messages := [][]byte{
+		testMessage("<a@x>", 1),
+		testMessage("<b@x>", 2, "Content-Type: text/plain; charset=utf-8\r\n",
+			"Content-Transfer-Encoding: quoted-printable\r\n"),
+		[]byte("From: Fred <fred@example.com>\r\n" +
+			"Subject: =?utf-8?q?Page_fault_in_=C3=BCnicode?=\r\n" +
+			"Date: Mon, 3 Jan 2024 10:00:00 +0000\r\n" +
+			"Message-ID: <c@x>\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"VGhlIGh5cGVydmlzb3IgY3Jhc2hlZA==\r\n"),
+	}
+
+	for _, message := range messages {
+		if err := mdb.AddMessage(message); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"hypervisor", []string{"<c@x>"}},
+		{"subject:ünicode", []string{"<c@x>"}},
+		{"addresses:fred", []string{"<c@x>"}},
+		{"body", []string{"<a@x>", "<b@x>"}},
+		{"nothing", []string{}},
+	}
+
+	for _, test := range tests {
+		results, err := mdb.Search(test.query, nil)
+		if err != nil {
+			t.Errorf("ERROR: Searching for %s: %v", test.query, err)
+			continue
+		}
+		if len(results) != len(test.want) {
+			t.Errorf("ERROR: Searching for %s: got %d results, wanted %d",
+				test.query, len(results), len(test.want))
+			continue
+		}
+		found := map[string]bool{}
+		for _, result := range results {
+			found[result.Message.Envelope.MessageId] = true
+		}
+		for _, msgid := range test.want {
+			if !found[msgid] {
+				t.Errorf("ERROR: Searching for %s: %s not found", test.query, msgid)
+			}
+		}
+	}
+
+	results, err := mdb.Search("crashed", &SearchOptions{})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Searching for snippet: %v %v", results, err)
+	}
+	if want := "The hypervisor [crashed]"; results[0].Snippet != want {
+		t.Errorf("ERROR: Got snippet %q, wanted %q", results[0].Snippet, want)
+	}
+	if len(results[0].Message.Envelope.From) != 1 {
+		t.Errorf("ERROR: Envelope not filled in for search result")
+	}
+
+	// Mailbox restriction
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("test", []string{"<a@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+	results, err = mdb.Search("body", &SearchOptions{MailboxName: "test"})
+	if err != nil {
+		t.Fatalf("Searching mailbox: %v", err)
+	}
+	if len(results) != 1 || results[0].Message.Envelope.MessageId != "<a@x>" {
+		t.Errorf("ERROR: Searching mailbox: got %d results", len(results))
+	}
+}
+
+// Messages deleted while FTS5 isn't available are removed from the
+// index once it is again
+func TestSearchDeleteWithoutIndex(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "search-delete-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	if !mdb.SearchAvailable() {
+		mdb.Close()
+		t.Skip("SQLite built without FTS5; run tests with -tags sqlite_fts5")
+	}
+
+	for _, msgid := range []string{"<a@x>", "<b@x>"} {
+		if err := mdb.AddMessage(testMessage(msgid, 1)); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+
+	// As if opened by a build without FTS5: <a@x> is deleted, and
+	// <b@x> deleted and added again
+	mdb.fts = false
+	for _, msgid := range []string{"<a@x>", "<b@x>"} {
+		if err := mdb.DeleteMessage(msgid); err != nil {
+			t.Fatalf("Deleting message: %v", err)
+		}
+	}
+	if err := mdb.AddMessage(testMessage("<b@x>", 1)); err != nil {
+		t.Fatalf("Adding message: %v", err)
+	}
+	mdb.Close()
+
+	mdb, err = OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Re-opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	var indexed []string
+	err = mdb.db.Select(&indexed, `
+        select coalesce(messageid, '')
+            from lmdb_fts left join lmdb_messages on lmdb_messages.rowid = lmdb_fts.rowid`)
+	if err != nil {
+		t.Fatalf("Getting index entries: %v", err)
+	}
+	if len(indexed) != 1 || indexed[0] != "<b@x>" {
+		t.Errorf("ERROR: Got index entries for %q, wanted just <b@x>", indexed)
+	}
+	results, err := mdb.Search("body", nil)
+	if err != nil || len(results) != 1 {
+		t.Errorf("ERROR: Searching after re-indexing: got %d results (%v), wanted 1", len(results), err)
+	}
+
+	// Without an index, there's nothing to queue
+	if _, err := mdb.db.Exec(`drop table lmdb_fts`); err != nil {
+		t.Fatalf("Dropping index: %v", err)
+	}
+	mdb.fts = false
+	if err := mdb.DeleteMessage("<b@x>"); err != nil {
+		t.Fatalf("Deleting message: %v", err)
+	}
+	var n int
+	if err := mdb.db.Get(&n, `select count(*) from lmdb_fts_deleted`); err != nil || n != 0 {
+		t.Errorf("ERROR: %d deleted index entries queued without an index (%v)", n, err)
+	}
+}
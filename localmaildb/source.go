@@ -0,0 +1,106 @@
+package localmaildb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Sources which don't have a mailbox to keep in sync (e.g.,
+// public-inbox archives) can record how far they've got here, as
+// opaque key / value pairs.  source identifies the source (e.g., the
+// path to the archive), and key the thing within it (e.g., a git
+// repository).  Setting a value of "" removes the key.
+
+// GetSourceState returns the value last recorded by SetSourceState,
+// or "" if there is none.
+func (mdb *MailDB) GetSourceState(source, key string) (string, error) {
+	return mdb.GetSourceStateContext(context.Background(), source, key)
+}
+
+// GetSourceStateContext is like GetSourceState, but takes a context.
+func (mdb *MailDB) GetSourceStateContext(ctx context.Context, source, key string) (string, error) {
+	var value string
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		err := sqlx.Get(eq, &value, `
+        select value from lmdb_source_state where source=? and key=?`, source, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			value = ""
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Getting state %s for source %s: %w", key, source, err)
+	}
+
+	return value, nil
+}
+
+func (mdb *MailDB) SetSourceState(source, key, value string) error {
+	return mdb.SetSourceStateContext(context.Background(), source, key, value)
+}
+
+// SetSourceStateContext is like SetSourceState, but takes a context.
+func (mdb *MailDB) SetSourceStateContext(ctx context.Context, source, key, value string) error {
+	return mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		return setSourceStateTx(eq, source, key, value)
+	})
+}
+
+// ListSourceState returns all the keys and values recorded for
+// source.
+func (mdb *MailDB) ListSourceState(source string) (map[string]string, error) {
+	return mdb.ListSourceStateContext(context.Background(), source)
+}
+
+// ListSourceStateContext is like ListSourceState, but takes a context.
+func (mdb *MailDB) ListSourceStateContext(ctx context.Context, source string) (map[string]string, error) {
+	var state map[string]string
+
+	err := mdb.txLoop(ctx, func(eq sqlx.Ext) error {
+		rows, err := eq.Queryx(`select key, value from lmdb_source_state where source=?`, source)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		state = map[string]string{}
+		for rows.Next() {
+			var key, value string
+			if err := rows.Scan(&key, &value); err != nil {
+				return err
+			}
+			state[key] = value
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Getting state for source %s: %w", source, err)
+	}
+
+	return state, nil
+}
+
+func setSourceStateTx(eq sqlx.Ext, source, key, value string) error {
+	if value == "" {
+		_, err := eq.Exec(`delete from lmdb_source_state where source=? and key=?`, source, key)
+		if err != nil {
+			return fmt.Errorf("Removing state %s for source %s: %w", key, source, err)
+		}
+		return nil
+	}
+
+	_, err := eq.Exec(`
+        insert into lmdb_source_state(source, key, value) values(?, ?, ?)
+            on conflict(source, key) do update set value=excluded.value`,
+		source, key, value)
+	if err != nil {
+		return fmt.Errorf("Setting state %s for source %s: %w", key, source, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package localmaildb
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSourceState(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "source-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	check := func(source, key, want string) {
+		t.Helper()
+		got, err := mdb.GetSourceState(source, key)
+		if err != nil {
+			t.Fatalf("Getting state: %v", err)
+		}
+		if got != want {
+			t.Errorf("ERROR: State %s/%s: got %q, wanted %q", source, key, got, want)
+		}
+	}
+
+	check("a", "0", "")
+
+	for _, s := range []struct{ source, key, value string }{
+		{"a", "0", "first"},
+		{"a", "1", "other"},
+		{"b", "0", "another"},
+		{"a", "0", "second"},
+	} {
+		if err := mdb.SetSourceState(s.source, s.key, s.value); err != nil {
+			t.Fatalf("Setting state: %v", err)
+		}
+	}
+
+	check("a", "0", "second")
+	check("a", "1", "other")
+	check("b", "0", "another")
+
+	// Setting "" removes the key
+	if err := mdb.SetSourceState("a", "1", ""); err != nil {
+		t.Fatalf("Removing state: %v", err)
+	}
+
+	all, err := mdb.ListSourceState("a")
+	if err != nil {
+		t.Fatalf("Listing state: %v", err)
+	}
+	if want := map[string]string{"0": "second"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("ERROR: State for a: got %v, wanted %v", all, want)
+	}
+}
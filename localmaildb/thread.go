@@ -0,0 +1,110 @@
+package localmaildb
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"regexp"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Threading follows the basic idea of JWZ's algorithm
+// (https://www.jwz.org/doc/threading.html): the References header
+// lists the ancestors of a message, oldest first, and In-Reply-To
+// (if it isn't already the last one) is treated as one more
+// reference on the end.  This chain is stored in lmdb_references,
+// with position 0 being the oldest ancestor and the highest position
+// being the direct parent.
+//
+// When building a tree, each message is attached to the nearest
+// ancestor in its chain which is actually in the database.  If its
+// direct parent is missing, a placeholder node is created for the
+// direct parent in between.  Messages none of whose ancestors are
+// present are grouped under a placeholder for the oldest reference
+// in their chain.
+
+var reMsgId = regexp.MustCompile(`<[^<>]+>`)
+
+// Extract the list of message ids from a References or In-Reply-To
+// header.  These are frequently mangled by mail clients, so be
+// generous and just look for things in angle brackets.
+func parseMsgIdList(s string) []string {
+	ids := reMsgId.FindAllString(s, -1)
+	for i := range ids {
+		ids[i] = NormalizeMessageId(ids[i])
+	}
+	return ids
+}
+
+// Get the reference chain for a message, oldest ancestor first.
+// Duplicates and references to the message itself are dropped.
+func parseReferences(h mail.Header, messageId string) []string {
+	refs := parseMsgIdList(h.Get("References"))
+
+	// Clients which don't do References usually at least do
+	// In-Reply-To; some do both but only put the parent in
+	// In-Reply-To.
+	if irt := parseMsgIdList(h.Get("In-Reply-To")); len(irt) > 0 {
+		parent := irt[0]
+		if len(refs) == 0 || refs[len(refs)-1] != parent {
+			refs = append(refs, parent)
+		}
+	}
+
+	seen := map[string]bool{messageId: true}
+	out := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		out = append(out, ref)
+	}
+
+	return out
+}
+
+func addReferencesTx(eq sqlx.Ext, messageId string, refs []string) error {
+	for i, ref := range refs {
+		_, err := eq.Exec(`
+            insert into lmdb_references(messageid, refid, position)
+                values(?, ?, ?)`,
+			messageId, ref, i)
+		if err != nil {
+			return fmt.Errorf("Inserting reference %s for messageid %s: %w",
+				ref, messageId, err)
+		}
+	}
+	return nil
+}
+
+// Migration helper: fill in lmdb_references for messages added
+// before it existed.
+func backfillReferencesTx(eq sqlx.Ext) error {
+	rows, err := eq.Queryx(`select messageid, message from lmdb_messages`)
+	if err != nil {
+		return fmt.Errorf("Getting message list: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId, message string
+		if err := rows.Scan(&messageId, &message); err != nil {
+			return fmt.Errorf("Scanning message: %w", err)
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader([]byte(message)))
+		if err != nil {
+			// AddMessage would have rejected this, so it can't
+			// really happen; but there's nothing to thread anyway.
+			continue
+		}
+
+		if err := addReferencesTx(eq, messageId, parseReferences(m.Header, messageId)); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
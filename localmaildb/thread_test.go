@@ -0,0 +1,194 @@
+package localmaildb
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReferences(t *testing.T) {
+	tests := []struct {
+		references, inReplyTo string
+		want                  []string
+	}{
+		{"", "", []string{}},
+		{"<a@x>", "", []string{"<a@x>"}},
+		{"", "<a@x>", []string{"<a@x>"}},
+		{"<a@x> <b@x>", "<b@x>", []string{"<a@x>", "<b@x>"}},
+		{"<a@x>\r\n <b@x>", "<c@x>", []string{"<a@x>", "<b@x>", "<c@x>"}},
+		{"<a@x> <b@x> <a@x> <self@x>", "", []string{"<a@x>", "<b@x>"}},
+		{"", "<a@x> (Fred's message of Tuesday)", []string{"<a@x>"}},
+	}
+
+	for _, test := range tests {
+		h := mail.Header{}
+		if test.references != "" {
+			h["References"] = []string{test.references}
+		}
+		if test.inReplyTo != "" {
+			h["In-Reply-To"] = []string{test.inReplyTo}
+		}
+		got := parseReferences(h, "<self@x>")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: References %q In-Reply-To %q: got %v, wanted %v",
+				test.references, test.inReplyTo, got, test.want)
+		}
+	}
+}
+
+// Make a minimal message
+func testMessage(msgid string, day int, headers ...string) []byte {
+	return []byte(fmt.Sprintf("From: Test <test@example.com>\r\n"+
+		"Subject: Message %s\r\n"+
+		"Date: Mon, %d Jan 2024 10:00:00 +0000\r\n"+
+		"Message-ID: %s\r\n"+
+		"%s\r\n"+
+		"Body of %s\r\n",
+		msgid, day, msgid, strings.Join(headers, ""), msgid))
+}
+
+// Describe a tree as a string, for easy comparison
+func treeString(mt *MessageTree) string {
+	s := mt.Envelope.MessageId
+	if mt.Placeholder {
+		s = "?" + s
+	}
+	if len(mt.Replies) > 0 {
+		replies := []string{}
+		for _, reply := range mt.Replies {
+			replies = append(replies, treeString(reply))
+		}
+		s += "(" + strings.Join(replies, " ") + ")"
+	}
+	return s
+}
+
+func TestThreading(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "thread-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	messages := [][]byte{
+		testMessage("<a@x>", 1),
+		// References but no In-Reply-To
+		testMessage("<b@x>", 2, "References: <a@x>\r\n"),
+		// Direct parent <x@x> missing, but <a@x> present
+		testMessage("<c@x>", 3, "References: <a@x> <x@x>\r\n", "In-Reply-To: <x@x>\r\n"),
+		// In-Reply-To only
+		testMessage("<d@x>", 4, "In-Reply-To: <c@x>\r\n"),
+		// No ancestors present at all
+		testMessage("<e@x>", 5, "In-Reply-To: <y@x>\r\n"),
+		testMessage("<f@x>", 6, "References: <y@x> <z@x>\r\n"),
+	}
+
+	msgids := []string{}
+	for _, message := range messages {
+		if err := mdb.AddMessage(message); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+		m, _ := mail.ReadMessage(strings.NewReader(string(message)))
+		msgids = append(msgids, m.Header.Get("Message-ID"))
+	}
+
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+	if err := mdb.UpdateMailbox("test", msgids); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+
+	roots, err := mdb.GetMessageRoots("test")
+	if err != nil {
+		t.Fatalf("Getting message roots: %v", err)
+	}
+
+	got := []string{}
+	for _, root := range roots {
+		if err := mdb.GetTree(root); err != nil {
+			t.Fatalf("Getting tree for %s: %v", root.Envelope.MessageId, err)
+		}
+		got = append(got, treeString(root))
+	}
+
+	want := []string{
+		"<a@x>(<b@x> ?<x@x>(<c@x>(<d@x>)))",
+		"?<y@x>(<e@x> ?<z@x>(<f@x>))",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: Got threads %v, wanted %v", got, want)
+	}
+
+	// Placeholders can be looked up directly
+	mt, err := mdb.GetTreeFromMessageId("<y@x>")
+	if err != nil {
+		t.Fatalf("Getting tree for placeholder: %v", err)
+	}
+	if s := treeString(mt); s != want[1] {
+		t.Errorf("ERROR: Got placeholder tree %s, wanted %s", s, want[1])
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "delete-test.sqlite")
+
+	mdb, err := OpenMailDB(dbfile)
+	if err != nil {
+		t.Fatalf("Opening maildb file %s: %v", dbfile, err)
+	}
+	defer mdb.Close()
+
+	if err := mdb.CreateMailbox("test"); err != nil {
+		t.Fatalf("Creating mailbox: %v", err)
+	}
+
+	messages := [][]byte{
+		testMessage("<a@x>", 1),
+		testMessage("<b@x>", 2, "References: <a@x>\r\n"),
+		testMessage("<c@x>", 3, "References: <a@x> <b@x>\r\n"),
+	}
+	for _, message := range messages {
+		if err := mdb.AddMessage(message); err != nil {
+			t.Fatalf("Adding message: %v", err)
+		}
+	}
+	if err := mdb.UpdateMailbox("test", []string{"<a@x>", "<b@x>", "<c@x>"}); err != nil {
+		t.Fatalf("Updating mailbox: %v", err)
+	}
+
+	msgid, err := RawMessageId(messages[1])
+	if err != nil || msgid != "<b@x>" {
+		t.Fatalf("Getting message id: got %q, %v", msgid, err)
+	}
+
+	// Twice, as deleting a missing message isn't an error
+	for i := 0; i < 2; i++ {
+		if err := mdb.DeleteMessage(msgid); err != nil {
+			t.Fatalf("Deleting message: %v", err)
+		}
+	}
+
+	if prs, err := mdb.IsMsgIdPresent(msgid); err != nil || prs {
+		t.Errorf("ERROR: Message present after delete: %v %v", prs, err)
+	}
+
+	roots, err := mdb.GetMessageRoots("test")
+	if err != nil {
+		t.Fatalf("Getting message roots: %v", err)
+	}
+	if len(roots) != 1 {
+		t.Fatalf("Unexpected number of roots: %d", len(roots))
+	}
+	if err := mdb.GetTree(roots[0]); err != nil {
+		t.Fatalf("Getting tree: %v", err)
+	}
+	if got, want := treeString(roots[0]), "<a@x>(?<b@x>(<c@x>))"; got != want {
+		t.Errorf("ERROR: Got tree %s, wanted %s", got, want)
+	}
+}
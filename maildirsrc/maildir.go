@@ -0,0 +1,335 @@
+package maildirsrc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+type MaildirInfo struct {
+	Path string // Path to the top-level Maildir
+
+	// Prepended to the names of the mailboxes messages are put in;
+	// see MaildirSrc.
+	MailboxPrefix string
+}
+
+// Each folder of a Maildir becomes a mailbox: the top-level folder is
+// INBOX, and the others are named after their directories, with `/`
+// as the separator.  Both the Maildir++ layout (`.Lists.xen-devel`,
+// as written by offlineimap and Dovecot) and nested directories
+// (`Lists/xen-devel`, as written by mbsync) are understood.
+//
+// The flags in the names of messages' files (see
+// https://cr.yp.to/proto/maildir.html) are recorded as the messages'
+// flags in their mailboxes.
+//
+// The files seen are recorded in the database's source state, by
+// unique name (the part before the flags), so Fetch only reads new
+// files; files which have gone are removed from their mailbox.
+type MaildirSrc struct {
+	path   string
+	prefix string
+	source string // Name for the database's source state; see lmdb.GetSourceState
+}
+
+func (src *MaildirSrc) Close() {
+}
+
+func Connect(info MaildirInfo) (*MaildirSrc, error) {
+	abspath, err := filepath.Abs(info.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Getting absolute path of %s: %w", info.Path, err)
+	}
+
+	if fi, err := os.Stat(abspath); err != nil {
+		return nil, fmt.Errorf("Opening maildir: %w", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("Opening maildir: %s isn't a directory", info.Path)
+	}
+
+	return &MaildirSrc{
+		path:   abspath,
+		prefix: info.MailboxPrefix,
+		source: "maildir:" + abspath,
+	}, nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+type folder struct {
+	mailbox string
+	path    string
+}
+
+func (src *MaildirSrc) folders() ([]folder, error) {
+	folders := []folder{}
+
+	err := filepath.WalkDir(src.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			return fs.SkipDir
+		}
+		if !isMaildir(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src.path, p)
+		if err != nil {
+			return err
+		}
+
+		var name string
+		switch {
+		case rel == ".":
+			name = "INBOX"
+		case !strings.ContainsRune(rel, filepath.Separator) && strings.HasPrefix(rel, "."):
+			// Maildir++
+			name = strings.ReplaceAll(rel[1:], ".", "/")
+		default:
+			name = filepath.ToSlash(rel)
+		}
+
+		folders = append(folders, folder{mailbox: src.prefix + name, path: p})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Looking for folders in %s: %w", src.path, err)
+	}
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("No maildir folders found in %s", src.path)
+	}
+
+	return folders, nil
+}
+
+// A message file.  Its name is `unique` or `unique:info`.
+type file struct {
+	folder *folder
+	path   string
+	unique string
+	info   string
+}
+
+// Source state key for a file
+func (f *file) key() string {
+	return f.folder.mailbox + "/" + f.unique
+}
+
+// Source state for a file: its info (so that changes to its flags
+// can be spotted), and its Message-ID, or "" if it couldn't be parsed
+func stateValue(info, messageId string) string {
+	return info + " " + messageId
+}
+
+func parseStateValue(value string) (info, messageId string) {
+	info, messageId, _ = strings.Cut(value, " ")
+	return
+}
+
+func (fo *folder) files() ([]file, error) {
+	files := []file{}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(fo.path, sub))
+		if err != nil {
+			return nil, fmt.Errorf("Reading folder %s: %w", fo.mailbox, err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			unique, info, _ := strings.Cut(e.Name(), ":")
+			files = append(files, file{
+				folder: fo,
+				path:   filepath.Join(fo.path, sub, e.Name()),
+				unique: unique,
+				info:   info,
+			})
+		}
+	}
+	return files, nil
+}
+
+var flagLetters = map[rune]string{
+	'D': lmdb.FlagDraft,
+	'F': lmdb.FlagFlagged,
+	'R': lmdb.FlagAnswered,
+	'S': lmdb.FlagSeen,
+	'T': lmdb.FlagDeleted,
+}
+
+// The flags in a file's info.  Only the "2," form carries flags;
+// lower-case letters are Dovecot keywords, whose names are kept
+// elsewhere, so they're ignored.
+func parseFlags(info string) []string {
+	if !strings.HasPrefix(info, "2,") {
+		return nil
+	}
+	flags := []string{}
+	for _, l := range info[2:] {
+		if flag, ok := flagLetters[l]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+func (src *MaildirSrc) Fetch(mdb *lmdb.MailDB) error {
+	return src.FetchContext(context.Background(), mdb)
+}
+
+// FetchContext is like Fetch, but stops (returning ctx.Err()) if ctx
+// is cancelled.  Everything written before that is kept.
+func (src *MaildirSrc) FetchContext(ctx context.Context, mdb *lmdb.MailDB) error {
+	folders, err := src.folders()
+	if err != nil {
+		return err
+	}
+
+	seen, err := mdb.ListSourceStateContext(ctx, src.source)
+	if err != nil {
+		return err
+	}
+
+	// Find what's changed before writing anything, so that removals
+	// can be done first: a message moved from one file to another
+	// shouldn't end up removed.
+	files := []file{}
+	for i := range folders {
+		if err := mdb.CreateMailboxContext(ctx, folders[i].mailbox); err != nil {
+			return fmt.Errorf("Creating mailbox %s: %w", folders[i].mailbox, err)
+		}
+		ff, err := folders[i].files()
+		if err != nil {
+			return err
+		}
+		files = append(files, ff...)
+	}
+
+	// Messages still in each mailbox, as far as we know yet
+	present := map[string]bool{}
+	for _, f := range files {
+		if value, ok := seen[f.key()]; ok {
+			_, messageId := parseStateValue(value)
+			present[f.folder.mailbox+"\x00"+messageId] = true
+		}
+	}
+	gone := map[string]bool{}
+	for key := range seen {
+		gone[key] = true
+	}
+	for _, f := range files {
+		delete(gone, f.key())
+	}
+
+	bw := mdb.NewBulkWriter()
+	removed, unparseable := 0, 0
+
+	for key := range gone {
+		_, messageId := parseStateValue(seen[key])
+		mailbox := key[:strings.LastIndexByte(key, '/')]
+		if messageId != "" && !present[mailbox+"\x00"+messageId] {
+			if err := bw.RemoveFromMailboxContext(ctx, mailbox, messageId); err != nil {
+				return err
+			}
+			removed++
+		}
+		if err := bw.SetSourceStateContext(ctx, src.source, key, ""); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Fetching messages...")
+
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		mailbox := f.folder.mailbox
+
+		if value, ok := seen[f.key()]; ok {
+			info, messageId := parseStateValue(value)
+			if info == f.info {
+				continue
+			}
+			if messageId != "" {
+				if err := bw.SetFlagsContext(ctx, mailbox, messageId, parseFlags(f.info)); err != nil {
+					return err
+				}
+			}
+			if err := bw.SetSourceStateContext(ctx, src.source, f.key(), stateValue(f.info, messageId)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		message, err := os.ReadFile(f.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Moved while we were looking (e.g., from new to cur);
+			// we'll get it next time
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Reading message: %w", err)
+		}
+
+		pm, err := mdb.PrepareMessage(message)
+		if err != nil {
+			log.Printf("Can't parse %s, skipping: %v", f.path, err)
+			unparseable++
+			if err := bw.SetSourceStateContext(ctx, src.source, f.key(), stateValue(f.info, "")); err != nil {
+				return err
+			}
+			continue
+		}
+
+		messageId := pm.MessageId()
+		if err := bw.AddContext(ctx, pm); err != nil {
+			return err
+		}
+		if err := bw.AddToMailboxContext(ctx, mailbox, messageId); err != nil {
+			return err
+		}
+		if err := bw.SetFlagsContext(ctx, mailbox, messageId, parseFlags(f.info)); err != nil {
+			return err
+		}
+		if err := bw.SetSourceStateContext(ctx, src.source, f.key(), stateValue(f.info, messageId)); err != nil {
+			return err
+		}
+
+		if (i+1)%lmdb.DefaultBulkBatchSize == 0 {
+			log.Printf("...%d of %d files", i+1, len(files))
+		}
+	}
+
+	if err := bw.FlushContext(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("Added %d messages (%d already present, %d unparseable), %d removed from mailboxes",
+		bw.Added, bw.Present, unparseable, removed)
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package maildirsrc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Make a Maildir folder (cur, new and tmp) under dir
+func makeFolder(t *testing.T, dir string) {
+	t.Helper()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatalf("Making maildir folder: %v", err)
+		}
+	}
+}
+
+// Write a minimal message to a file, relative to the Maildir
+func writeMessage(t *testing.T, root, name, msgid string) {
+	t.Helper()
+	message := fmt.Sprintf("From: Test <test@example.com>\r\n"+
+		"Subject: Message %s\r\n"+
+		"Date: Mon, 1 Jan 2024 10:00:00 +0000\r\n"+
+		"Message-ID: %s\r\n"+
+		"\r\n"+
+		"Body of %s\r\n", msgid, msgid, msgid)
+	if err := os.WriteFile(filepath.Join(root, name), []byte(message), 0o644); err != nil {
+		t.Fatalf("Writing message: %v", err)
+	}
+}
+
+func rename(t *testing.T, root, from, to string) {
+	t.Helper()
+	if err := os.Rename(filepath.Join(root, from), filepath.Join(root, to)); err != nil {
+		t.Fatalf("Renaming message: %v", err)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for _, tc := range []struct {
+		info string
+		want []string
+	}{
+		{"", nil},
+		{"2,", []string{}},
+		{"2,S", []string{lmdb.FlagSeen}},
+		{"2,FRS", []string{lmdb.FlagAnswered, lmdb.FlagFlagged, lmdb.FlagSeen}},
+		{"2,DT", []string{lmdb.FlagDeleted, lmdb.FlagDraft}},
+		// Dovecot keywords, and letters which aren't flags
+		{"2,Sab", []string{lmdb.FlagSeen}},
+		{"2,PX", []string{}},
+		// Only the "2," form has flags
+		{"1,S", nil},
+		{"S", nil},
+	} {
+		if got := parseFlags(tc.info); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ERROR: parseFlags(%q): got %v, wanted %v", tc.info, got, tc.want)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	root := t.TempDir()
+	makeFolder(t, root)
+	makeFolder(t, filepath.Join(root, ".Lists.xen-devel"))
+	makeFolder(t, filepath.Join(root, "Archive", "2024"))
+	// Not a folder itself, but has one inside
+	if err := os.MkdirAll(filepath.Join(root, "Archive"), 0o755); err != nil {
+		t.Fatalf("Making directory: %v", err)
+	}
+
+	src, err := Connect(MaildirInfo{Path: root, MailboxPrefix: "home/"})
+	if err != nil {
+		t.Fatalf("Connecting: %v", err)
+	}
+	folders, err := src.folders()
+	if err != nil {
+		t.Fatalf("Finding folders: %v", err)
+	}
+	got := []string{}
+	for _, f := range folders {
+		got = append(got, f.mailbox)
+	}
+	sort.Strings(got)
+	want := []string{"home/Archive/2024", "home/INBOX", "home/Lists/xen-devel"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: got folders %v, wanted %v", got, want)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	root := t.TempDir()
+	makeFolder(t, root)
+	makeFolder(t, filepath.Join(root, ".Lists"))
+
+	mdb, err := lmdb.OpenMailDB(filepath.Join(t.TempDir(), "maildir-test.sqlite"))
+	if err != nil {
+		t.Fatalf("Opening maildb: %v", err)
+	}
+	defer mdb.Close()
+
+	src, err := Connect(MaildirInfo{Path: root})
+	if err != nil {
+		t.Fatalf("Connecting: %v", err)
+	}
+	fetch := func(what string) {
+		t.Helper()
+		if err := src.Fetch(mdb); err != nil {
+			t.Fatalf("%s: Fetch: %v", what, err)
+		}
+	}
+	checkMailbox := func(what, mailbox string, want ...string) {
+		t.Helper()
+		// The test messages aren't related, so each is its own thread
+		messages, err := mdb.GetMessageRoots(mailbox)
+		if err != nil {
+			t.Fatalf("%s: Getting messages for %s: %v", what, mailbox, err)
+		}
+		got := []string{}
+		for _, m := range messages {
+			got = append(got, m.Envelope.MessageId)
+		}
+		sort.Strings(got)
+		want = append([]string{}, want...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ERROR: %s: %s has %v, wanted %v", what, mailbox, got, want)
+		}
+	}
+	checkFlags := func(what, mailbox, msgid, want string) {
+		t.Helper()
+		flags, err := mdb.GetFlags(mailbox, msgid)
+		if err != nil {
+			t.Fatalf("%s: Getting flags: %v", what, err)
+		}
+		if got := strings.Join(flags, " "); got != want {
+			t.Errorf("ERROR: %s: %s in %s has flags %q, wanted %q", what, msgid, mailbox, got, want)
+		}
+	}
+
+	writeMessage(t, root, "new/1.host", "<a@x>")
+	writeMessage(t, root, "cur/2.host:2,S", "<b@x>")
+	writeMessage(t, root, ".Lists/cur/3.host:2,FS", "<c@x>")
+	fetch("initial")
+	checkMailbox("initial", "INBOX", "<a@x>", "<b@x>")
+	checkMailbox("initial", "Lists", "<c@x>")
+	checkFlags("initial", "INBOX", "<a@x>", "")
+	checkFlags("initial", "INBOX", "<b@x>", `\Seen`)
+	checkFlags("initial", "Lists", "<c@x>", `\Flagged \Seen`)
+
+	// A client reads <a@x>, moving it from new to cur, and flags
+	// <b@x>; nothing is removed, and the flags are picked up from
+	// the names
+	rename(t, root, "new/1.host", "cur/1.host:2,S")
+	rename(t, root, "cur/2.host:2,S", "cur/2.host:2,FS")
+	fetch("renamed")
+	checkMailbox("renamed", "INBOX", "<a@x>", "<b@x>")
+	checkFlags("renamed", "INBOX", "<a@x>", `\Seen`)
+	checkFlags("renamed", "INBOX", "<b@x>", `\Flagged \Seen`)
+
+	// Another copy of <a@x> under a new name, and the old one gone,
+	// leaves it in the mailbox
+	writeMessage(t, root, "cur/4.host:2,S", "<a@x>")
+	if err := os.Remove(filepath.Join(root, "cur/1.host:2,S")); err != nil {
+		t.Fatalf("Removing message: %v", err)
+	}
+	fetch("replaced")
+	checkMailbox("replaced", "INBOX", "<a@x>", "<b@x>")
+
+	// Removing one of two copies already seen leaves the message in
+	// the mailbox
+	writeMessage(t, root, "cur/5.host:2,", "<b@x>")
+	fetch("second copy")
+	if err := os.Remove(filepath.Join(root, "cur/2.host:2,FS")); err != nil {
+		t.Fatalf("Removing message: %v", err)
+	}
+	fetch("one copy removed")
+	checkMailbox("one copy removed", "INBOX", "<a@x>", "<b@x>")
+
+	// A removed file is dropped from its mailbox, but the message
+	// stays in the database
+	if err := os.Remove(filepath.Join(root, ".Lists/cur/3.host:2,FS")); err != nil {
+		t.Fatalf("Removing message: %v", err)
+	}
+	fetch("removed")
+	checkMailbox("removed", "Lists")
+	checkMailbox("removed", "INBOX", "<a@x>", "<b@x>")
+	if prs, err := mdb.IsMsgIdPresent("<c@x>"); err != nil || !prs {
+		t.Errorf("ERROR: <c@x> not in database after removal (%v)", err)
+	}
+}
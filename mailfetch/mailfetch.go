@@ -1,77 +1,113 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
 
 	"github.com/spf13/viper"
 
-	"github.com/emersion/go-mbox"
-
-	imapsrc "github.com/gwd/localmaildb/imapsource"
 	lmdb "github.com/gwd/localmaildb/localmaildb"
+	mboxsrc "github.com/gwd/localmaildb/mboxsrc"
+	"github.com/gwd/localmaildb/source"
 )
 
 func TreePrint(message *lmdb.MessageTree, indent string) {
-	log.Printf("%s %v %s", indent, message.Envelope.Date, message.Envelope.Subject)
+	if message.Placeholder {
+		log.Printf("%s [missing message %s]", indent, message.Envelope.MessageId)
+	} else {
+		log.Printf("%s %v %s", indent, message.Envelope.Date, message.Envelope.Subject)
+	}
 	for _, reply := range message.Replies {
 		TreePrint(reply, indent+"*")
 	}
 
 }
 
-func main() {
-	mailbox := imapsrc.MailboxInfo{}
-
-	viper.SetConfigName(".taskmail")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		log.Fatalf("Fatal error config file: %s \n", err)
-	}
-
-	if !viper.IsSet("mailboxname") {
-		log.Fatal("No mailbox name")
+// All the messages in a tree, oldest first
+func treeMessages(mt *lmdb.MessageTree) []*lmdb.MessageTree {
+	messages := []*lmdb.MessageTree{}
+	var walk func(mt *lmdb.MessageTree)
+	walk = func(mt *lmdb.MessageTree) {
+		if !mt.Placeholder {
+			messages = append(messages, mt)
+		}
+		for _, reply := range mt.Replies {
+			walk(reply)
+		}
 	}
-	mailbox.MailboxName = viper.GetString("mailboxname")
+	walk(mt)
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Envelope.Date.Before(messages[j].Envelope.Date)
+	})
+	return messages
+}
 
-	if viper.IsSet("port") {
-		mailbox.Port = viper.GetInt("port")
+// The messages to export: `mailbox NAME`, `thread MESSAGEID` or
+// `search QUERY...`
+func exportMessages(mdb *lmdb.MailDB, args []string) ([]*lmdb.MessageTree, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Wanted mailbox NAME, thread MESSAGEID or search QUERY")
 	}
 
-	if !viper.IsSet("imapserver") {
-		log.Fatal("No imapserver configured")
+	switch args[0] {
+	case "mailbox":
+		return mdb.GetMailboxMessages(args[1])
+	case "thread":
+		mt, err := mdb.GetTreeFromMessageId(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return treeMessages(mt), nil
+	case "search":
+		query := strings.Join(args[1:], " ")
+		messages := []*lmdb.MessageTree{}
+		opts := &lmdb.SearchOptions{Limit: 500}
+		for {
+			results, err := mdb.Search(query, opts)
+			if err != nil {
+				return nil, err
+			}
+			for _, result := range results {
+				messages = append(messages, result.Message)
+			}
+			if len(results) < opts.Limit {
+				return messages, nil
+			}
+			opts.Offset += len(results)
+		}
 	}
-	mailbox.Hostname = viper.GetString("imapserver")
 
-	if !viper.IsSet("username") {
-		log.Fatal("No username configured")
-	}
-	mailbox.Username = viper.GetString("username")
+	return nil, fmt.Errorf("Unknown export type %s (wanted mailbox, thread or search)", args[0])
+}
 
-	if !viper.IsSet("password") {
-		log.Fatal("No password configured")
+func main() {
+	viper.SetConfigName(".taskmail")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig() // Find and read the config file
+	if err != nil {             // Handle errors reading the config file
+		log.Fatalf("Fatal error config file: %s \n", err)
 	}
-	mailbox.Password = viper.GetString("password")
 
-	var src imapsrc.ImapSource
-	if src, err = imapsrc.Setup(&mailbox); err != nil {
-		log.Fatalf("Error setting up imap source: %v", err)
+	dbname := "maildb.sqlite"
+	if viper.IsSet("database") {
+		dbname = viper.GetString("database")
 	}
 
 	log.Println("Opening database")
-	mdb, err := lmdb.OpenMailDB("maildb.sqlite")
+	mdb, err := lmdb.OpenMailDB(dbname)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer mdb.Close()
 
-	// FIXME: Eventually we want this done explicitly as part of an 'init' or 'create' step.
-	if err := mdb.CreateMailbox(mailbox.MailboxName); err != nil {
-		log.Fatalf("Error creating mailbox: %v", err)
-	}
-
 	cmd := "fetch"
 	if len(os.Args) >= 2 {
 		cmd = os.Args[1]
@@ -79,23 +115,116 @@ func main() {
 
 	switch cmd {
 	case "fetch":
-		log.Println("Opening imap connection")
-		if err = src.ImapConnect(); err != nil {
-			log.Fatalf("Connecting to the IMAP server: %v", err)
+		sources, err := selectSources(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		if err = src.Fetch(mdb); err != nil {
-			log.Fatalf("Fetching mail: %v", err)
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		failed := 0
+		for _, sc := range sources {
+			src, err := source.New(sc.typ, sc.name, sc.config)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Fetching from %s", sc.name)
+			err = src.FetchContext(ctx, mdb)
+			src.Close()
+			if ctx.Err() != nil {
+				log.Printf("Interrupted")
+				break
+			} else if err != nil {
+				log.Printf("Fetching from %s: %v", sc.name, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			mdb.Close()
+			log.Fatalf("%d of %d sources failed", failed, len(sources))
+		}
+	case "watch":
+		sources, err := selectSources(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		watchers := map[string]source.Watcher{}
+		for _, sc := range sources {
+			src, err := source.New(sc.typ, sc.name, sc.config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer src.Close()
+
+			if w, ok := src.(source.Watcher); ok {
+				watchers[sc.name] = w
+			} else if len(os.Args) > 2 {
+				log.Fatalf("Source %s (type %s) can't be watched", sc.name, sc.typ)
+			}
+		}
+		if len(watchers) == 0 {
+			log.Fatalf("No sources which can be watched")
+		}
+
+		log.Println("Watching for new mail (CTRL-C to stop)")
+
+		// Stop everything if one fails
+		ctx, stop := context.WithCancel(ctx)
+		errs := make(chan error, len(watchers))
+		for name, w := range watchers {
+			go func(name string, w source.Watcher) {
+				err := w.Watch(ctx, mdb)
+				if err != nil && !errors.Is(err, context.Canceled) {
+					err = fmt.Errorf("Watching %s: %w", name, err)
+				}
+				errs <- err
+				stop()
+			}(name, w)
+		}
+		var watchErr error
+		for range watchers {
+			if err := <-errs; err != nil && !errors.Is(err, context.Canceled) && watchErr == nil {
+				watchErr = err
+			}
+		}
+		stop()
+		if watchErr != nil {
+			log.Fatal(watchErr)
 		}
 	case "list-threads":
+		// Defaults to the mailbox of a single-account config
+		mailboxName := viper.GetString("mailboxname")
+		if len(os.Args) >= 3 {
+			mailboxName = os.Args[2]
+		}
+		if mailboxName == "" {
+			log.Fatalf("Usage: %s MAILBOX", cmd)
+		}
+
 		log.Println("Getting message roots")
-		messages, err := mdb.GetMessageRoots(mailbox.MailboxName)
+		messages, err := mdb.GetMessageRoots(mailboxName)
 		if err != nil {
 			log.Fatalf("Getting message roots: %v", err)
 		}
 
+		unread, err := mdb.GetUnreadThreads(mailboxName)
+		if err != nil {
+			log.Fatalf("Getting unread threads: %v", err)
+		}
+
+		// Threads with unread messages are marked with N, as in mutt
 		for _, message := range messages {
-			log.Printf("%v | %v | %v", message.Envelope.MessageId, message.Envelope.Date, message.Envelope.Subject)
+			mark := " "
+			if unread[message.Envelope.MessageId] {
+				mark = "N"
+			}
+			log.Printf("%s %v | %v | %v", mark, message.Envelope.MessageId, message.Envelope.Date, message.Envelope.Subject)
 		}
 	case "list-thread":
 		if len(os.Args) < 3 {
@@ -110,6 +239,23 @@ func main() {
 		}
 
 		TreePrint(tgtMessage, "")
+	case "search":
+		if len(os.Args) < 3 {
+			log.Fatalf("Not enough arguments to %s", cmd)
+		}
+		query := strings.Join(os.Args[2:], " ")
+
+		log.Printf("Searching for %s", query)
+		results, err := mdb.Search(query, nil)
+		if err != nil {
+			log.Fatalf("Searching: %v", err)
+		}
+
+		for _, result := range results {
+			message := result.Message
+			log.Printf("%v | %v | %v", message.Envelope.MessageId, message.Envelope.Date, message.Envelope.Subject)
+			log.Printf("    %s", strings.Join(strings.Fields(result.Snippet), " "))
+		}
 	case "export-am":
 		if len(os.Args) < 3 {
 			log.Fatalf("Not enough arguments to %s", cmd)
@@ -124,7 +270,8 @@ func main() {
 
 		{
 			mt := lmdb.TreeFilterAm(tgtMessage)
-			mbw := mbox.NewWriter(os.Stdout)
+			// git am only understands mboxo by default
+			mbw := mboxsrc.NewWriter(os.Stdout, mboxsrc.FormatMboxo)
 
 			if len(mt) < 1 {
 				log.Fatalf("No messages in thread after TreeFilterAm!")
@@ -132,15 +279,130 @@ func main() {
 
 			for _, msg := range mt {
 				log.Printf("Adding message %s", msg.Envelope.Subject)
-				mbfrom := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
-				if w, err := mbw.CreateMessage(mbfrom, msg.Envelope.Date); err != nil {
-					log.Fatalf("Creating message in mbox: %v", err)
-				} else if _, err := w.Write(msg.RawMessage); err != nil {
+				if err := mbw.WriteMessageTree(msg); err != nil {
 					log.Fatalf("Writing message to mbox: %v", err)
 				}
 			}
+			if err := mbw.Flush(); err != nil {
+				log.Fatalf("Writing mbox: %v", err)
+			}
 		}
+	case "export":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		format := fs.String("format", "mboxrd", "mbox format: mboxrd, mboxo or mboxcl2")
+		output := fs.String("o", "", "File to write to (default: standard output)")
+		fs.Parse(os.Args[2:])
 
+		mboxFormat, err := mboxsrc.ParseFormat(*format)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		messages, err := exportMessages(mdb, fs.Args())
+		if err != nil {
+			log.Fatalf("Getting messages to export: %v", err)
+		}
+
+		var out io.Writer = os.Stdout
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				log.Fatalf("Creating output file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		mbw := mboxsrc.NewWriter(out, mboxFormat)
+		for _, msg := range messages {
+			if err := mbw.WriteMessageTree(msg); err != nil {
+				log.Fatalf("Writing message to mbox: %v", err)
+			}
+		}
+		if err := mbw.Flush(); err != nil {
+			log.Fatalf("Writing mbox: %v", err)
+		}
+		log.Printf("Exported %d messages", len(messages))
+	case "import-mbox":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		format := fs.String("format", "mboxrd", "mbox format: mboxrd, mboxo or mboxcl2")
+		mboxName := fs.String("mailbox", "", "Mailbox to put the messages in")
+		fs.Parse(os.Args[2:])
+
+		if fs.NArg() != 1 {
+			log.Fatalf("Usage: %s [-format FORMAT] [-mailbox NAME] FILE", cmd)
+		}
+
+		mboxFormat, err := mboxsrc.ParseFormat(*format)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		msrc, err := mboxsrc.Connect(mboxsrc.MboxInfo{
+			Path:        fs.Arg(0),
+			Format:      mboxFormat,
+			MailboxName: *mboxName,
+		})
+		if err != nil {
+			log.Fatalf("Opening mbox: %v", err)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		err = msrc.FetchContext(ctx, mdb)
+		if errors.Is(err, context.Canceled) {
+			log.Printf("Interrupted")
+		} else if err != nil {
+			log.Fatalf("Importing mbox: %v", err)
+		}
+	case "flag":
+		// Changes are made on the server by the next fetch
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		thread := fs.Bool("thread", false, "Change the whole thread")
+		fs.Parse(os.Args[2:])
+
+		if fs.NArg() < 3 {
+			log.Fatalf("Usage: %s [-thread] MAILBOX MESSAGEID +FLAG|-FLAG...", cmd)
+		}
+		mailboxName, messageId := fs.Arg(0), fs.Arg(1)
+
+		var add, remove []string
+		for _, arg := range fs.Args()[2:] {
+			switch {
+			case strings.HasPrefix(arg, "+"):
+				add = append(add, arg[1:])
+			case strings.HasPrefix(arg, "-"):
+				remove = append(remove, arg[1:])
+			default:
+				log.Fatalf("Wanted +FLAG or -FLAG, got %s", arg)
+			}
+		}
+
+		messageIds := []string{messageId}
+		if *thread {
+			mt, err := mdb.GetTreeFromMessageId(messageId)
+			if err != nil {
+				log.Fatalf("Getting thread: %v", err)
+			}
+			messageIds = nil
+			for _, m := range treeMessages(mt) {
+				messageIds = append(messageIds, m.Envelope.MessageId)
+			}
+		}
+
+		for _, id := range messageIds {
+			if err := mdb.ChangeFlags(mailboxName, id, add, remove); err != nil {
+				log.Fatalf("Changing flags of %s: %v", id, err)
+			}
+		}
+	case "move":
+		if len(os.Args) != 5 {
+			log.Fatalf("Usage: %s FROM TO MESSAGEID", cmd)
+		}
+		if err := mdb.MoveMessage(os.Args[2], os.Args[3], os.Args[4]); err != nil {
+			log.Fatalf("Moving message: %v", err)
+		}
 	default:
 		log.Fatalf("Unknown command %s", cmd)
 	}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Secrets needn't be kept in the config file, which may be shared.
+// Instead of `password`, a source can have one of:
+//
+//	password_command: pass show mail/work
+//	password_env: WORK_IMAP_PASSWORD
+//	password_netrc: ~/.netrc
+//
+// The command is run with sh, and the first line of what it prints
+// is the password.  The netrc file is searched for the IMAP server
+// and username (falling back to `default`).  OAuth tokens work the
+// same way with `token`, `token_command` and `token_env`; the command
+// is run for every connection, so it can refresh the token.
+
+// A way of getting a secret, or nil if none is configured
+func secretGetter(config *viper.Viper, key, host, user string) (func() (string, error), error) {
+	var getters []func() (string, error)
+
+	if config.IsSet(key) {
+		secret := config.GetString(key)
+		getters = append(getters, func() (string, error) { return secret, nil })
+	}
+	if config.IsSet(key + "_command") {
+		command := config.GetString(key + "_command")
+		getters = append(getters, func() (string, error) { return runSecretCommand(command) })
+	}
+	if config.IsSet(key + "_env") {
+		name := config.GetString(key + "_env")
+		getters = append(getters, func() (string, error) {
+			secret, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("Environment variable %s not set", name)
+			}
+			return secret, nil
+		})
+	}
+	if config.IsSet(key + "_netrc") {
+		path := config.GetString(key + "_netrc")
+		getters = append(getters, func() (string, error) { return netrcPassword(path, host, user) })
+	}
+
+	switch len(getters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return getters[0], nil
+	}
+	return nil, fmt.Errorf("Only one of %s, %s_command, %s_env and %s_netrc may be set", key, key, key, key)
+}
+
+func runSecretCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	// e.g., for gpg to ask for a passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Running %q: %w", command, err)
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	secret := strings.TrimSuffix(string(line), "\r")
+	if secret == "" {
+		return "", fmt.Errorf("Running %q: no output", command)
+	}
+	return secret, nil
+}
+
+// The password for user on host in a netrc file, as used by ftp and
+// curl.  macdef definitions are skipped.
+func netrcPassword(path, host, user string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Opening netrc file: %w", err)
+	}
+	defer f.Close()
+
+	type entry struct {
+		machine, login, password string
+		isDefault                bool
+	}
+	var entries []*entry
+	var cur *entry
+
+	scanner := bufio.NewScanner(f)
+	inMacro := false
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if inMacro {
+			// A macro runs up to the next empty line
+			inMacro = len(fields) > 0
+			continue
+		}
+		for i := 0; i < len(fields); i++ {
+			arg := ""
+			if i+1 < len(fields) {
+				arg = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				cur = &entry{machine: arg}
+				entries = append(entries, cur)
+				i++
+			case "default":
+				cur = &entry{isDefault: true}
+				entries = append(entries, cur)
+			case "login":
+				if cur != nil {
+					cur.login = arg
+				}
+				i++
+			case "password":
+				if cur != nil {
+					cur.password = arg
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Reading netrc file: %w", err)
+	}
+
+	for _, isDefault := range []bool{false, true} {
+		for _, e := range entries {
+			if e.isDefault != isDefault || (!isDefault && e.machine != host) {
+				continue
+			}
+			if e.login != "" && e.login != user {
+				continue
+			}
+			if e.password != "" {
+				return e.password, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No password for %s on %s in %s", user, host, path)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/viper"
+
+	imapsrc "github.com/gwd/localmaildb/imapsource"
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+	mdsrc "github.com/gwd/localmaildb/maildirsrc"
+	mboxsrc "github.com/gwd/localmaildb/mboxsrc"
+	pisrc "github.com/gwd/localmaildb/pubinboxsrc"
+	"github.com/gwd/localmaildb/source"
+)
+
+// The config file lists sources by name under `sources`, each with a
+// `type` and that type's settings:
+//
+//	database: maildb.sqlite
+//	sources:
+//	  work:
+//	    type: imap
+//	    imapserver: imap.example.com
+//	    username: me
+//	    password_command: pass show mail/work
+//	    folders: ["*"]
+//	    exclude: [Trash, Junk]
+//	    prefix: work/
+//	  local:
+//	    type: imap
+//	    imapserver: localhost
+//	    port: 1143
+//	    security: plain
+//	    username: me
+//	    password: secret
+//	    prefix: local/
+//	  xen-devel:
+//	    type: public-inbox
+//	    path: /srv/lore/xen-devel
+//	    mailbox: xen-devel
+//	    listid: xen-devel.lists.xenproject.org
+//	  old:
+//	    type: maildir
+//	    path: /home/me/Maildir
+//	    prefix: old/
+//
+// A config file without `sources` describes a single IMAP account,
+// named "default", with its settings at the top level.
+
+var (
+	_ source.Source  = (*pisrc.PublicInboxSrc)(nil)
+	_ source.Source  = (*mdsrc.MaildirSrc)(nil)
+	_ source.Source  = (*mboxsrc.MboxSrc)(nil)
+	_ source.Source  = (*imapAccount)(nil)
+	_ source.Watcher = (*imapAccount)(nil)
+)
+
+func init() {
+	source.Register("imap", newImapAccount)
+	source.Register("public-inbox", newPublicInbox)
+	source.Register("maildir", newMaildir)
+	source.Register("mbox", newMbox)
+}
+
+type sourceConfig struct {
+	name, typ string
+	config    *viper.Viper
+}
+
+// The sources in the config file, sorted by name
+func configSources() ([]sourceConfig, error) {
+	if !viper.IsSet("sources") {
+		return []sourceConfig{{name: "default", typ: "imap", config: viper.GetViper()}}, nil
+	}
+
+	sources := []sourceConfig{}
+	for name := range viper.GetStringMap("sources") {
+		config := viper.Sub("sources." + name)
+		if config == nil {
+			return nil, fmt.Errorf("Source %s: settings should be a map", name)
+		}
+		typ := config.GetString("type")
+		if typ == "" {
+			return nil, fmt.Errorf("Source %s: no type", name)
+		}
+		sources = append(sources, sourceConfig{name: name, typ: typ, config: config})
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+
+	return sources, nil
+}
+
+// The sources named, or all of them if names is empty
+func selectSources(names []string) ([]sourceConfig, error) {
+	sources, err := configSources()
+	if err != nil || len(names) == 0 {
+		return sources, err
+	}
+
+	byName := map[string]sourceConfig{}
+	for _, sc := range sources {
+		byName[sc.name] = sc
+	}
+
+	selected := []sourceConfig{}
+	for _, name := range names {
+		sc, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("No source named %s in config", name)
+		}
+		selected = append(selected, sc)
+	}
+	return selected, nil
+}
+
+// An IMAP account, all of whose folders are synced over one
+// connection
+type imapAccount struct {
+	name string
+	src  *imapsrc.ImapSource
+}
+
+func newImapAccount(name string, config *viper.Viper) (source.Source, error) {
+	info := imapsrc.MailboxInfo{}
+
+	if !config.IsSet("imapserver") {
+		return nil, fmt.Errorf("No imapserver configured")
+	}
+	info.Hostname = config.GetString("imapserver")
+
+	if !config.IsSet("username") {
+		return nil, fmt.Errorf("No username configured")
+	}
+	info.Username = config.GetString("username")
+
+	// login (the default), plain, xoauth2 or oauthbearer
+	auth, err := imapsrc.ParseAuthMethod(config.GetString("auth"))
+	if err != nil {
+		return nil, err
+	}
+	info.Auth = auth
+
+	// See secrets.go
+	if auth.UsesToken() {
+		getToken, err := secretGetter(config, "token", info.Hostname, info.Username)
+		if err != nil {
+			return nil, err
+		} else if getToken == nil {
+			return nil, fmt.Errorf("No token configured")
+		}
+		info.TokenSource = imapsrc.TokenSourceFunc(getToken)
+	} else {
+		getPassword, err := secretGetter(config, "password", info.Hostname, info.Username)
+		if err != nil {
+			return nil, err
+		} else if getPassword == nil {
+			return nil, fmt.Errorf("No password configured")
+		}
+		if info.Password, err = getPassword(); err != nil {
+			return nil, fmt.Errorf("Getting password: %w", err)
+		}
+	}
+
+	if config.IsSet("port") {
+		info.Port = config.GetInt("port")
+	}
+
+	// tls (the default), starttls, or plain (for local servers only)
+	security, err := imapsrc.ParseSecurity(config.GetString("security"))
+	if err != nil {
+		return nil, err
+	}
+	info.Security = security
+	info.CAFile = config.GetString("cafile")
+	info.CertFile = config.GetString("certfile")
+	info.KeyFile = config.GetString("keyfile")
+	info.InsecureSkipVerify = config.GetBool("insecureskipverify")
+
+	info.Reconnects = config.GetInt("reconnects")
+	if config.IsSet("reconnectdelay") {
+		info.ReconnectDelay = config.GetDuration("reconnectdelay")
+	}
+
+	switch strategy := config.GetString("strategy"); strategy {
+	case "", "all":
+		info.UpdateStrategy = imapsrc.StrategyAll
+	case "recent":
+		info.UpdateStrategy = imapsrc.StrategyRecent
+	default:
+		return nil, fmt.Errorf("Unknown update strategy %s (wanted all or recent)", strategy)
+	}
+
+	if config.IsSet("updatewindow") {
+		// e.g. "720h"
+		info.UpdateWindow = config.GetDuration("updatewindow")
+	}
+
+	if config.IsSet("pollinterval") {
+		info.PollInterval = config.GetDuration("pollinterval")
+	}
+
+	// Folder patterns, e.g. ["*"] or ["INBOX", "Lists/*"]; without
+	// them, just mailboxname (or INBOX)
+	info.Folders = config.GetStringSlice("folders")
+	info.ExcludeFolders = config.GetStringSlice("exclude")
+	info.MailboxPrefix = config.GetString("prefix")
+	info.MailboxName = config.GetString("mailboxname")
+
+	// Bodies are fetched batchsize messages, or batchbytes bytes, at
+	// a time; the first sync of a folder can use several connections
+	info.BodyBatchSize = config.GetInt("batchsize")
+	info.BodyBatchBytes = config.GetInt64("batchbytes")
+	info.Connections = config.GetInt("connections")
+
+	src, err := imapsrc.Setup(&info)
+	if err != nil {
+		return nil, fmt.Errorf("Setting up imap source: %w", err)
+	}
+
+	return &imapAccount{name: name, src: &src}, nil
+}
+
+func (acct *imapAccount) Close() {
+	acct.src.Close()
+}
+
+func (acct *imapAccount) FetchContext(ctx context.Context, mdb *lmdb.MailDB) error {
+	log.Printf("Opening imap connection for %s", acct.name)
+	if err := acct.src.ImapConnect(); err != nil {
+		return fmt.Errorf("Connecting to the IMAP server: %w", err)
+	}
+
+	result, err := acct.src.FetchContext(ctx, mdb)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if result != nil {
+		fmt.Printf("%s: %d fetched, %d already present, %d removed\n",
+			acct.name, result.Fetched, result.Skipped, result.Removed)
+		if result.Fetched > 0 {
+			fmt.Printf("%s: %s\n", acct.name, result.Throughput())
+		}
+	}
+	return err
+}
+
+func (acct *imapAccount) Watch(ctx context.Context, mdb *lmdb.MailDB) error {
+	return acct.src.Watch(ctx, mdb)
+}
+
+func newPublicInbox(name string, config *viper.Viper) (source.Source, error) {
+	if !config.IsSet("path") {
+		return nil, fmt.Errorf("No path configured")
+	}
+
+	src, err := pisrc.Connect(pisrc.PublicInboxInfo{
+		Path:        config.GetString("path"),
+		MailboxName: config.GetString("mailbox"),
+		ListId:      config.GetString("listid"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	src.Parallel = config.GetInt("parallel")
+
+	return src, nil
+}
+
+func newMaildir(name string, config *viper.Viper) (source.Source, error) {
+	if !config.IsSet("path") {
+		return nil, fmt.Errorf("No path configured")
+	}
+
+	return mdsrc.Connect(mdsrc.MaildirInfo{
+		Path:          config.GetString("path"),
+		MailboxPrefix: config.GetString("prefix"),
+	})
+}
+
+func newMbox(name string, config *viper.Viper) (source.Source, error) {
+	if !config.IsSet("path") {
+		return nil, fmt.Errorf("No path configured")
+	}
+
+	format := mboxsrc.FormatMboxrd
+	if config.IsSet("format") {
+		var err error
+		if format, err = mboxsrc.ParseFormat(config.GetString("format")); err != nil {
+			return nil, err
+		}
+	}
+
+	return mboxsrc.Connect(mboxsrc.MboxInfo{
+		Path:        config.GetString("path"),
+		Format:      format,
+		MailboxName: config.GetString("mailbox"),
+	})
+}
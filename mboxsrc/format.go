@@ -0,0 +1,379 @@
+package mboxsrc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// There are several variants of mbox (see
+// https://www.loc.gov/preservation/digital/formats/fdd/fdd000383.shtml),
+// which differ in how they stop lines in messages starting with
+// "From " from being taken as the start of the next message:
+//
+//   - mboxo puts a '>' in front of them; but doesn't do anything to
+//     lines which already start with ">From ", so they can't be told
+//     apart when reading.
+//   - mboxrd puts a '>' in front of lines matching /^>*From /, which
+//     can be undone exactly.
+//   - mboxcl2 doesn't change the message, but adds a Content-Length
+//     header giving the length of the body.
+//
+// In all of them, each message starts with a "From_" line, giving the
+// envelope sender and the date, and ends with a blank line.
+type Format int
+
+const (
+	FormatMboxrd = Format(iota)
+	FormatMboxo
+	FormatMboxcl2
+)
+
+var formatNames = []string{
+	FormatMboxrd:  "mboxrd",
+	FormatMboxo:   "mboxo",
+	FormatMboxcl2: "mboxcl2",
+}
+
+func (f Format) String() string {
+	if int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the Format named name: "mboxrd", "mboxo" or
+// "mboxcl2".  "mbox" means mboxo.
+func ParseFormat(name string) (Format, error) {
+	if name == "mbox" {
+		return FormatMboxo, nil
+	}
+	for f, n := range formatNames {
+		if n == name {
+			return Format(f), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown mbox format %s (wanted mboxrd, mboxo or mboxcl2)", name)
+}
+
+var fromLine = []byte("From ")
+
+func isBlank(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// Whether line needs a '>' added when writing, or has one to remove
+// when reading.  For mboxrd, lines which are to have one removed
+// start with '>' already.
+func (f Format) quoted(line []byte, reading bool) bool {
+	switch f {
+	case FormatMboxo:
+		if reading {
+			return bytes.HasPrefix(line, []byte(">From "))
+		}
+		return bytes.HasPrefix(line, fromLine)
+	case FormatMboxrd:
+		rest := bytes.TrimLeft(line, ">")
+		if reading && len(rest) == len(line) {
+			return false
+		}
+		return bytes.HasPrefix(rest, fromLine)
+	}
+	return false
+}
+
+// Big enough for most messages, so that mboxcl2 Content-Lengths can
+// be checked
+const readBufferSize = 1 << 20
+
+// Reader splits an mbox into messages.
+type Reader struct {
+	r       *bufio.Reader
+	format  Format
+	next    []byte // The From_ line of the next message, once read
+	started bool
+}
+
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, readBufferSize), format: format}
+}
+
+// A line, including its ending; io.EOF at the end
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
+
+// Next returns the next message, with any quoting undone, and io.EOF
+// when there are no more.
+func (r *Reader) Next() ([]byte, error) {
+	if !r.started {
+		r.started = true
+		for {
+			line, err := r.readLine()
+			if err == io.EOF {
+				return nil, io.EOF
+			} else if err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(line, fromLine) {
+				r.next = line
+				break
+			}
+			if !isBlank(line) {
+				return nil, fmt.Errorf("Not an mbox: doesn't start with a From line")
+			}
+		}
+	}
+	if r.next == nil {
+		return nil, io.EOF
+	}
+	r.next = nil
+
+	message := &bytes.Buffer{}
+
+	// A From line only starts a new message after a blank line (or
+	// the end of a message whose length we know); so an unquoted
+	// From line in a body is kept.
+	afterBlank := false
+	// Where the body starts, if the header has already been read
+	bodyStart := 0
+
+	if r.format == FormatMboxcl2 {
+		done, err := r.readCounted(message)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return message.Bytes(), nil
+		}
+		// No usable Content-Length; look for the next From line as
+		// for the other formats.  The blank line ending the header
+		// counts, so that an empty body followed straight away by a
+		// From line isn't taken as part of this message.
+		afterBlank = true
+		bodyStart = message.Len()
+	}
+
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if afterBlank && bytes.HasPrefix(line, fromLine) {
+			r.next = line
+			break
+		}
+		if r.format.quoted(line, true) {
+			line = line[1:]
+		}
+		message.Write(line)
+		afterBlank = isBlank(line)
+	}
+
+	// The blank line before the next From line (or the end) is the
+	// mbox's, not the message's; unless it's the one ending the header
+	b := message.Bytes()
+	if afterBlank && len(b) > bodyStart {
+		b = b[:len(b)-len(lastLine(b))]
+	}
+
+	return b, nil
+}
+
+// The last line of b, including its ending
+func lastLine(b []byte) []byte {
+	i := bytes.LastIndexByte(bytes.TrimSuffix(b, []byte("\n")), '\n')
+	return b[i+1:]
+}
+
+// Read an mboxcl2 message's header, and its body if the header has a
+// Content-Length which is believable: the body is followed by a blank
+// line and a From line, or the end of the file.  If not, returns
+// false, having read the header and nothing more.
+func (r *Reader) readCounted(message *bytes.Buffer) (bool, error) {
+	length := -1
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		message.Write(line)
+		if isBlank(line) {
+			break
+		}
+		if name, value, ok := bytes.Cut(line, []byte(":")); ok &&
+			bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length")) {
+			if n, err := strconv.Atoi(string(bytes.TrimSpace(value))); err == nil && n >= 0 {
+				length = n
+			}
+		}
+	}
+
+	if length < 0 {
+		return false, nil
+	}
+
+	// If the body fits in the buffer, check that the length is right
+	// before believing it
+	if n := length + len("\r\n") + len(fromLine); n <= r.r.Size() {
+		after, err := r.r.Peek(n)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if len(after) < length {
+			return false, nil
+		}
+		rest := after[length:]
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			rest = rest[2:]
+		} else if bytes.HasPrefix(rest, []byte("\n")) {
+			rest = rest[1:]
+		} else if len(rest) > 0 {
+			return false, nil
+		}
+		if len(rest) > 0 && !bytes.HasPrefix(rest, fromLine) {
+			return false, nil
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return false, err
+	}
+	message.Write(body)
+
+	// Skip the blank line, and remember the next From line
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if bytes.HasPrefix(line, fromLine) {
+			r.next = line
+			return true, nil
+		}
+	}
+}
+
+// Writer writes messages to an mbox.
+type Writer struct {
+	w      *bufio.Writer
+	format Format
+}
+
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: bufio.NewWriter(w), format: format}
+}
+
+// WriteMessage adds a message to the mbox.  from is the envelope
+// sender for the From_ line; if empty, MAILER-DAEMON is used.  Line
+// endings are converted to "\n".
+func (w *Writer) WriteMessage(from string, date time.Time, message []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	if len(message) > 0 && message[len(message)-1] != '\n' {
+		message = append(message, '\n')
+	}
+
+	if w.format == FormatMboxcl2 {
+		message = setContentLength(message)
+	}
+
+	if _, err := fmt.Fprintf(w.w, "From %s %s\n", from, date.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+
+	for len(message) > 0 {
+		line := message
+		if i := bytes.IndexByte(message, '\n'); i >= 0 {
+			line = message[:i+1]
+		}
+		message = message[len(line):]
+
+		if w.format.quoted(line, false) {
+			if err := w.w.WriteByte('>'); err != nil {
+				return err
+			}
+		}
+		if _, err := w.w.Write(line); err != nil {
+			return err
+		}
+	}
+
+	return w.w.WriteByte('\n')
+}
+
+// Flush writes any buffered data.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Replace any Content-Length headers in message with the length of
+// its body.  message must end with "\n", and have "\n" line endings.
+func setContentLength(message []byte) []byte {
+	header, body, ok := bytes.Cut(message, []byte("\n\n"))
+	if !ok {
+		// All header
+		header, body = bytes.TrimSuffix(message, []byte("\n")), nil
+	}
+
+	out := &bytes.Buffer{}
+	skipping := false
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		// Continuation lines belong to the previous header
+		if len(line) == 0 || line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length"))
+		}
+		if !skipping {
+			out.Write(line)
+			out.WriteByte('\n')
+		}
+	}
+	fmt.Fprintf(out, "Content-Length: %d\n\n", len(body))
+	out.Write(body)
+
+	return out.Bytes()
+}
+
+// WriteMessageTree adds a message from the database to the mbox
+// (without its replies), with its Sender (or failing that its From)
+// as the envelope sender.  Placeholders are skipped.
+func (w *Writer) WriteMessageTree(mt *lmdb.MessageTree) error {
+	if mt.Placeholder {
+		return nil
+	}
+
+	from := ""
+	for _, addrs := range [][]*imap.Address{mt.Envelope.Sender, mt.Envelope.From} {
+		if len(addrs) > 0 && addrs[0].MailboxName != "" {
+			from = addrs[0].Address()
+			break
+		}
+	}
+
+	return w.WriteMessage(from, mt.Envelope.Date, mt.RawMessage)
+}
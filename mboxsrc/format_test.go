@@ -0,0 +1,131 @@
+package mboxsrc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessages = []string{
+	"From: a@example.com\nSubject: one\n\nFrom the start\n>From quoted\n>>From more quoted\n",
+	"From: b@example.com\nSubject: two\n\nbody\n\nFrom after a blank line\n",
+	"From: c@example.com\nSubject: three\nContent-Length: 9999\n\nno newline at end",
+	"From: d@example.com\r\nSubject: four\r\n\r\nCRLF\r\n\r\n",
+}
+
+// What each message should come back as
+var wantMessages = []string{
+	testMessages[0],
+	testMessages[1],
+	"From: c@example.com\nSubject: three\nContent-Length: 9999\n\nno newline at end\n",
+	"From: d@example.com\nSubject: four\n\nCRLF\n\n",
+}
+
+func TestRoundTrip(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, format := range []Format{FormatMboxrd, FormatMboxcl2} {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, format)
+		for _, m := range testMessages {
+			if err := w.WriteMessage("sender@example.com", date, []byte(m)); err != nil {
+				t.Fatalf("%v: Writing message: %v", format, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%v: Flushing: %v", format, err)
+		}
+
+		if !strings.HasPrefix(buf.String(), "From sender@example.com Mon Jan  1 10:00:00 2024\n") {
+			t.Errorf("ERROR: %v: bad From line: %q", format, strings.SplitN(buf.String(), "\n", 2)[0])
+		}
+
+		r := NewReader(buf, format)
+		for i, want := range wantMessages {
+			got, err := r.Next()
+			if err != nil {
+				t.Fatalf("%v: Reading message %d: %v", format, i, err)
+			}
+			if format == FormatMboxcl2 {
+				want = strings.Replace(want, "Content-Length: 9999\n", "", 1)
+				got = stripContentLength(got)
+			}
+			if string(got) != want {
+				t.Errorf("ERROR: %v: message %d: got %q, wanted %q", format, i, got, want)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("ERROR: %v: wanted EOF after last message, got %v", format, err)
+		}
+	}
+}
+
+func stripContentLength(m []byte) []byte {
+	lines := bytes.SplitAfter(m, []byte("\n"))
+	out := []byte{}
+	for _, l := range lines {
+		if !bytes.HasPrefix(l, []byte("Content-Length:")) {
+			out = append(out, l...)
+		}
+	}
+	return out
+}
+
+func TestQuoting(t *testing.T) {
+	message := "Subject: x\n\nFrom a\n>From b\n>>From c\nFromage\n"
+
+	for _, test := range []struct {
+		format Format
+		want   string
+	}{
+		{FormatMboxo, "Subject: x\n\n>From a\n>From b\n>>From c\nFromage\n"},
+		{FormatMboxrd, "Subject: x\n\n>From a\n>>From b\n>>>From c\nFromage\n"},
+		{FormatMboxcl2, "Subject: x\nContent-Length: 32\n\nFrom a\n>From b\n>>From c\nFromage\n"},
+	} {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, test.format)
+		if err := w.WriteMessage("", time.Time{}, []byte(message)); err != nil {
+			t.Fatalf("%v: Writing message: %v", test.format, err)
+		}
+		w.Flush()
+
+		_, got, _ := strings.Cut(buf.String(), "\n")
+		if got != test.want+"\n" {
+			t.Errorf("ERROR: %v: got %q, wanted %q", test.format, got, test.want+"\n")
+		}
+	}
+}
+
+// A Content-Length which is wrong is ignored
+func TestBadContentLength(t *testing.T) {
+	mbox := "From x Mon Jan  1 10:00:00 2024\n" +
+		"Subject: one\nContent-Length: 3\n\nlonger than three\n\n" +
+		"From x Mon Jan  1 10:00:00 2024\n" +
+		"Subject: two\nContent-Length: 1000\n\nshort\n\n" +
+		"From x Mon Jan  1 10:00:00 2024\n" +
+		"Subject: empty\nContent-Length: 5\n\n" +
+		"From x Mon Jan  1 10:00:00 2024\n" +
+		"Subject: three\n\nno length\n"
+
+	r := NewReader(strings.NewReader(mbox), FormatMboxcl2)
+	for i, want := range []string{
+		"Subject: one\nContent-Length: 3\n\nlonger than three\n",
+		"Subject: two\nContent-Length: 1000\n\nshort\n",
+		// An empty body, without a blank line before the next From
+		"Subject: empty\nContent-Length: 5\n\n",
+		"Subject: three\n\nno length\n",
+	} {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Reading message %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Errorf("ERROR: message %d: got %q, wanted %q", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("ERROR: wanted EOF after last message, got %v", err)
+	}
+}
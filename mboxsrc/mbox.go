@@ -0,0 +1,115 @@
+package mboxsrc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+type MboxInfo struct {
+	Path   string // Path to the mbox file
+	Format Format
+
+	// Mailbox to put the messages in, if set.  It's created if it
+	// doesn't exist.
+	MailboxName string
+}
+
+// An mbox has no way of telling what's been imported before; so each
+// Fetch reads the whole file, and messages already in the database
+// are skipped.
+type MboxSrc struct {
+	path    string
+	format  Format
+	mailbox string
+}
+
+func (src *MboxSrc) Close() {
+}
+
+func Connect(info MboxInfo) (*MboxSrc, error) {
+	if fi, err := os.Stat(info.Path); err != nil {
+		return nil, fmt.Errorf("Opening mbox: %w", err)
+	} else if fi.IsDir() {
+		return nil, fmt.Errorf("Opening mbox: %s is a directory", info.Path)
+	}
+
+	return &MboxSrc{
+		path:    info.Path,
+		format:  info.Format,
+		mailbox: info.MailboxName,
+	}, nil
+}
+
+func (src *MboxSrc) Fetch(mdb *lmdb.MailDB) error {
+	return src.FetchContext(context.Background(), mdb)
+}
+
+// FetchContext is like Fetch, but stops (returning ctx.Err()) if ctx
+// is cancelled.  Everything written before that is kept.
+func (src *MboxSrc) FetchContext(ctx context.Context, mdb *lmdb.MailDB) error {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return fmt.Errorf("Opening mbox: %w", err)
+	}
+	defer f.Close()
+
+	if src.mailbox != "" {
+		if err := mdb.CreateMailboxContext(ctx, src.mailbox); err != nil {
+			return fmt.Errorf("Creating mailbox %s: %w", src.mailbox, err)
+		}
+	}
+
+	log.Printf("Reading %s as %v", src.path, src.format)
+
+	r := NewReader(f, src.format)
+	bw := mdb.NewBulkWriter()
+	count, unparseable := 0, 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		message, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Reading %s: %w", src.path, err)
+		}
+		count++
+
+		pm, err := mdb.PrepareMessage(message)
+		if err != nil {
+			log.Printf("Can't parse message %d, skipping: %v", count, err)
+			unparseable++
+			continue
+		}
+
+		if err := bw.AddContext(ctx, pm); err != nil {
+			return err
+		}
+		if src.mailbox != "" {
+			if err := bw.AddToMailboxContext(ctx, src.mailbox, pm.MessageId()); err != nil {
+				return err
+			}
+		}
+
+		if count%lmdb.DefaultBulkBatchSize == 0 {
+			log.Printf("...read %d messages", count)
+		}
+	}
+
+	if err := bw.FlushContext(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("Added %d messages (%d already present, %d unparseable)",
+		bw.Added, bw.Present, unparseable)
+
+	return nil
+}
@@ -1,26 +1,64 @@
 package pubinboxsrc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
 
 	lmdb "github.com/gwd/localmaildb/localmaildb"
 )
 
 type PublicInboxInfo struct {
 	Path string // Path to "top-level" public-inbox for this list / address
+
+	// Mailbox to put the archive's messages in, if set.  It's
+	// created if it doesn't exist.
+	MailboxName string
+
+	// If set, MailboxName is instead defined as all messages with
+	// this List-Id, wherever they came from; see
+	// lmdb.SetMailboxListId.  Useful for lore mirrors, whose
+	// archives sometimes include other lists' messages.
+	ListId string
 }
 
+// Both the current (v2) and the original (v1) public-inbox layouts
+// are understood; see https://public-inbox.org/public-inbox-v2-format.html
+//
+// A v2 archive has a directory, `git`, of "epoch" repositories.  Each
+// commit adds a single message, as the file `m`, or removes one, in
+// which case the removed message is in the file `d`.
+//
+// A v1 archive is a single repository, with one file per message,
+// named after a hash of its Message-ID.  Commits add or remove files.
 type PublicInboxSrc struct {
-	gitpath string // Path to directory of git repos.
+	gitpath string // Path to directory of git repos (v2), or the repo (v1)
+	v1      bool
+	source  string // Name for the database's source state; see lmdb.GetSourceState
+	mailbox string
+	listId  string
+
+	// How many epochs to read at once; defaults to GOMAXPROCS
+	Parallel int
+
+	// If set, called each time a batch of changes has been written
+	Progress func(Progress)
 }
 
 func (src *PublicInboxSrc) Close() {
@@ -29,128 +67,534 @@ func (src *PublicInboxSrc) Close() {
 // For now just check to make sure the path exists and has the
 // expected structure
 func Connect(info PublicInboxInfo) (*PublicInboxSrc, error) {
-	src := &PublicInboxSrc{gitpath: path.Clean(path.Join(info.Path, "git"))}
-
-	_, err := os.ReadDir(src.gitpath)
+	abspath, err := filepath.Abs(info.Path)
 	if err != nil {
-		return nil, fmt.Errorf("Reading public-inbox path: %w", err)
+		return nil, fmt.Errorf("Getting absolute path of %s: %w", info.Path, err)
+	}
+
+	if info.ListId != "" && info.MailboxName == "" {
+		return nil, fmt.Errorf("List id %s given without a mailbox name", info.ListId)
+	}
+
+	src := &PublicInboxSrc{
+		source:  "public-inbox:" + abspath,
+		mailbox: info.MailboxName,
+		listId:  info.ListId,
+	}
+
+	if fi, err := os.Stat(path.Join(abspath, "git")); err == nil && fi.IsDir() {
+		src.gitpath = path.Clean(path.Join(abspath, "git"))
+	} else if _, err := git.PlainOpen(abspath); err == nil {
+		src.gitpath = abspath
+		src.v1 = true
+	} else {
+		return nil, fmt.Errorf("Reading public-inbox path: %s has no git directory, and isn't a git repository",
+			info.Path)
 	}
 
 	return src, nil
 }
 
-// For now we don't do any cloning or fetching; just start at he head
-// and work backwards until we find a messageid we've seen before
-func (src *PublicInboxSrc) Fetch(mdb *lmdb.MailDB) error {
+// An epoch is one of the git repositories making up a v2 archive,
+// named `N` or `N.git`.  Later epochs have later mail.  A v1 archive
+// is treated as a single epoch.
+type epoch struct {
+	name string
+	num  int
+	path string
+}
+
+func (src *PublicInboxSrc) epochs() ([]epoch, error) {
+	if src.v1 {
+		return []epoch{{name: "v1", path: src.gitpath}}, nil
+	}
+
 	entries, err := os.ReadDir(src.gitpath)
 	if err != nil {
-		return fmt.Errorf("Reading gitdir %s: %w", src.gitpath, err)
+		return nil, fmt.Errorf("Reading gitdir %s: %w", src.gitpath, err)
 	}
 
-	lastMsg := time.Now()
-	count := 0
-	skipped := 0
-	log.Printf("Fetching messages...")
-
-	// Entries are already sorted; work backwards
-	for i := len(entries) - 1; i >= 0; i-- {
-		e := entries[i]
+	epochs := []epoch{}
+	for _, e := range entries {
 		if !e.IsDir() {
-			//log.Printf("%s not a directory, skipping", e.Name())
 			continue
 		}
+		// all.git just has references to all the epochs' objects
+		if e.Name() == "all.git" {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".git"))
+		if err != nil {
+			log.Printf("%s doesn't look like an epoch, skipping", e.Name())
+			continue
+		}
+		epochs = append(epochs, epoch{name: e.Name(), num: num,
+			path: path.Join(src.gitpath, e.Name())})
+	}
+
+	// NB ReadDir sorts by name, which would put 10 before 2
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i].num < epochs[j].num })
+
+	return epochs, nil
+}
 
-		rpath := path.Join(src.gitpath, e.Name())
+// The commits reachable from head but not from last, oldest first.
+// If last isn't found (e.g., because history has been rewritten), all
+// of them are returned.
+func newCommits(repo *git.Repository, head, last plumbing.Hash) ([]plumbing.Hash, error) {
+	iter, err := repo.Log(&git.LogOptions{From: head, Order: git.LogOrderBSF})
+	if err != nil {
+		return nil, fmt.Errorf("Getting log iterator: %w", err)
+	}
+
+	found := false
+	hashes := []plumbing.Hash{}
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == last {
+			found = true
+			return storer.ErrStop
+		}
+		hashes = append(hashes, c.Hash)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Walking history: %w", err)
+	}
+
+	if !last.IsZero() && !found {
+		log.Printf("Last imported commit %v not found; history rewritten?  Re-scanning everything", last)
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+
+	return hashes, nil
+}
+
+// Progress is passed to PublicInboxSrc.Progress as an import goes
+// along.
+type Progress struct {
+	Epoch          string    // The epoch being written
+	Commits, Total int       // Commits from Epoch written so far, out of Total
+	Date           time.Time // Of the last commit written
+
+	// Totals for the whole import.  Skipped messages were either
+	// already present, or couldn't be parsed.
+	Added, Skipped, Deleted int
+}
 
-		repo, err := git.PlainOpen(rpath)
+// Write changes, and record progress, every this many commits, so
+// that an interrupted import doesn't have to start again from the
+// beginning.
+const checkpointInterval = 1000
+
+// What a single commit does, worked out by an epochReader
+type commitItem struct {
+	hash        plumbing.Hash
+	date        time.Time
+	added       []*lmdb.PreparedMessage
+	removed     []*lmdb.PreparedMessage
+	unparseable int // Added messages which couldn't be parsed
+}
+
+// Reads the new commits of an epoch in the background
+type epochReader struct {
+	epoch
+	items chan *commitItem // Closed when done
+
+	// Valid once the first item has been received, or items closed
+	head  *plumbing.Hash // nil if the epoch has no commits
+	total int
+
+	err error // Valid once items has been closed
+}
+
+// Source state key recording which mailbox the messages imported so
+// far have been put in
+const mailboxStateKey = "mailbox"
+
+// If rescan is set, the whole of the epoch is read, regardless of
+// what's been imported already.
+func (src *PublicInboxSrc) goReadEpoch(ctx context.Context, mdb *lmdb.MailDB, r *epochReader, rescan bool) {
+	defer close(r.items)
+
+	r.err = func() error {
+		repo, err := git.PlainOpen(r.path)
 		if err != nil {
 			// FIXME: Continue if we can tell it's just not a valid git repo?
-			return fmt.Errorf("Opening git repo at %s: %w", rpath, err)
+			return fmt.Errorf("Opening git repo at %s: %w", r.path, err)
 		}
 
-		starthash, err := repo.ResolveRevision("master")
+		r.head, err = epochHead(repo)
 		if err != nil {
-			return fmt.Errorf("Getting master revision: %w", err)
+			return fmt.Errorf("Getting head revision of %s: %w", r.path, err)
+		}
+		if r.head == nil {
+			log.Printf("Directory %s has no commits yet, skipping", r.path)
+			return nil
 		}
 
-		log.Printf("Processing directory %s, starting from revision %v", rpath, *starthash)
-
-		iter, err := repo.Log(&git.LogOptions{From: *starthash, Order: git.LogOrderBSF})
+		lastString, err := mdb.GetSourceStateContext(ctx, src.source, r.name)
 		if err != nil {
-			return fmt.Errorf("Getting log iterator: %w", err)
+			return err
+		}
+		last := plumbing.NewHash(lastString)
+		if rescan {
+			last = plumbing.ZeroHash
 		}
 
-		// There's a single mail file in the repo called 'm'
-		filename := "m"
+		if last == *r.head {
+			log.Printf("Directory %s up to date at revision %v", r.path, last)
+			return nil
+		}
 
-		repoCount := 0
+		log.Printf("Processing directory %s, from revision %v to %v", r.path, last, *r.head)
 
-		err = iter.ForEach(func(c *object.Commit) error {
-			if time.Since(lastMsg) > time.Second*3 {
-				lastMsg = time.Now()
-				log.Printf("...added %d mails total, %d from this repo (%d skipped).  Current date %v", count, repoCount, skipped, c.Author.When)
-			}
+		hashes, err := newCommits(repo, *r.head, last)
+		if err != nil {
+			return fmt.Errorf("Finding new commits in %s: %w", r.path, err)
+		}
+		r.total = len(hashes)
 
-			// Get the tree for this commit
-			tree, err := c.Tree()
+		for _, hash := range hashes {
+			c, err := repo.CommitObject(hash)
 			if err != nil {
-				return fmt.Errorf("Getting commit tree for revision %v: %w", c.Hash, err)
+				return fmt.Errorf("Getting commit %v: %w", hash, err)
 			}
 
-			// Find the file in the tree
-			file, err := tree.File(filename)
+			added, removed, err := commitChanges(c, src.v1)
 			if err != nil {
-				return fmt.Errorf("Finding file %s in tree: %w", filename, err)
+				return err
 			}
 
-			reader, err := file.Reader()
-			if err != nil {
-				return fmt.Errorf("Getting file reader for %s: %w", filename, err)
+			item := &commitItem{hash: hash, date: c.Author.When}
+
+			for _, rawmail := range added {
+				pm, err := mdb.PrepareMessage(rawmail)
+				if err != nil {
+					item.unparseable++
+					continue
+				}
+				item.added = append(item.added, pm)
 			}
-			defer reader.Close()
 
-			// Read the mail
-			rawmail, err := io.ReadAll(reader)
-			if err != nil {
-				return fmt.Errorf("Reading file %s: %w", filename, err)
+			for _, rawmail := range removed {
+				// If we can't parse it, we can't have added it
+				if pm, err := mdb.PrepareMessage(rawmail); err == nil {
+					item.removed = append(item.removed, pm)
+				}
 			}
 
-			// Try to add it to the maildb
-			err = mdb.AddMessage(rawmail)
-			switch {
-			case err == nil:
-				count++
-				repoCount++
-				return nil
-			case errors.Is(err, lmdb.ErrMsgidPresent):
-				// Unfortunately, the publix-inbox archive for
-				// xen-devel has duplicate mails for 2019 April 4 -
-				// June 4, so we can't use MsgidPresent to detect
-				// where we've gotten to at all.  We'll have to use
-				// the git head when updating.
-				skipped++
-				return nil
-			case errors.Is(err, lmdb.ErrParseError):
-				skipped++
-				return nil
-			default:
-				fmt.Println(string(rawmail))
-				return fmt.Errorf("Adding message to database: %w", err)
+			select {
+			case r.items <- item:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-		})
+		}
 
+		return nil
+	}()
+}
+
+// Each epoch's history is walked from the last commit imported
+// (recorded in the database's source state) to its head, oldest
+// first.  So running Fetch again only imports new mail, and it
+// doesn't matter that the archive has duplicate Message-IDs.
+//
+// Up to Parallel epochs are read at once; but changes are written
+// strictly in order, so that (for instance) a message removed in a
+// later epoch stays removed.
+//
+// If the mailbox isn't the one messages were put in last time, the
+// whole archive is read again, to fill it in.
+func (src *PublicInboxSrc) Fetch(mdb *lmdb.MailDB) error {
+	return src.FetchContext(context.Background(), mdb)
+}
+
+// FetchContext is like Fetch, but stops (returning ctx.Err()) if ctx
+// is cancelled.  Everything written before that is kept.
+func (src *PublicInboxSrc) FetchContext(ctx context.Context, mdb *lmdb.MailDB) error {
+	epochs, err := src.epochs()
+	if err != nil {
+		return err
+	}
+
+	rescan := false
+	if src.mailbox != "" {
+		if err := mdb.CreateMailboxContext(ctx, src.mailbox); err != nil {
+			return fmt.Errorf("Creating mailbox %s: %w", src.mailbox, err)
+		}
+	}
+	if src.listId != "" {
+		if err := mdb.SetMailboxListIdContext(ctx, src.mailbox, src.listId); err != nil {
+			return err
+		}
+	} else {
+		rescan, err = src.needsRescan(ctx, mdb, epochs)
 		if err != nil {
-			switch {
-			case errors.Is(err, lmdb.ErrMsgidPresent):
-				// We've found a message we've inserted before; break.
-				break
-			default:
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	parallel := src.Parallel
+	if parallel <= 0 {
+		parallel = runtime.GOMAXPROCS(0)
+	}
+
+	// Start readers in epoch order, no more than parallel at a time
+	var wg sync.WaitGroup
+	readers := make(chan *epochReader, len(epochs))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(readers)
+
+		slots := make(chan struct{}, parallel)
+		for _, e := range epochs {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			r := &epochReader{epoch: e, items: make(chan *commitItem, checkpointInterval)}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				src.goReadEpoch(ctx, mdb, r, rescan)
+			}()
+			readers <- r
+		}
+	}()
+
+	// Make sure the readers have gone before returning
+	defer wg.Wait()
+	defer cancel()
+
+	log.Printf("Fetching messages...")
+
+	bw := mdb.NewBulkWriter()
+	bw.BatchSize = 0 // Flushed every checkpointInterval commits
+	progress := Progress{}
+	unparseable := 0
+
+	flush := func() error {
+		if err := bw.FlushContext(ctx); err != nil {
+			return err
+		}
+		progress.Added = bw.Added
+		progress.Skipped = bw.Present + unparseable
+		progress.Deleted = bw.Deleted
+		if src.Progress != nil {
+			src.Progress(progress)
+		}
+		return nil
+	}
+
+	for r := range readers {
+		progress.Epoch = r.name
+		progress.Commits = 0
+		progress.Total = 0
+
+		for item := range r.items {
+			progress.Total = r.total
+
+			// Only the copy removed; other messages with the same
+			// Message-ID may still be in the inbox, and other
+			// sources may have the message
+			for _, pm := range item.removed {
+				if err := bw.DeleteCopyContext(ctx, src.mailbox, pm); err != nil {
+					return err
+				}
+			}
+			for _, pm := range item.added {
+				if err := bw.AddContext(ctx, pm); err != nil {
+					return err
+				}
+				// Messages already present go in the mailbox too
+				if src.mailbox != "" && src.listId == "" {
+					if err := bw.AddToMailboxContext(ctx, src.mailbox, pm.MessageId()); err != nil {
+						return err
+					}
+				}
+			}
+			unparseable += item.unparseable
+
+			err := bw.SetSourceStateContext(ctx, src.source, r.name, item.hash.String())
+			if err != nil {
+				return err
+			}
+
+			progress.Commits++
+			progress.Date = item.date
+			if progress.Commits%checkpointInterval == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+
+		if progress.Commits > 0 {
+			err := bw.SetSourceStateContext(ctx, src.source, r.name, r.head.String())
+			if err != nil {
 				return err
 			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// If ctx was cancelled, the readers may have stopped early
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Only now is everything in the mailbox
+	if src.listId == "" {
+		if err := bw.SetSourceStateContext(ctx, src.source, mailboxStateKey, src.mailbox); err != nil {
+			return err
+		}
+		if err := bw.FlushContext(ctx); err != nil {
+			return err
 		}
 	}
 
-	log.Printf("Added %d messages (%d skipped)", count, skipped)
+	log.Printf("Added %d messages (%d skipped), deleted %d",
+		progress.Added, progress.Skipped, progress.Deleted)
 
 	return nil
 }
+
+// Whether epochs have been imported before into a different mailbox
+// (or none), so that the messages already imported need to be put in
+// this one.
+func (src *PublicInboxSrc) needsRescan(ctx context.Context, mdb *lmdb.MailDB, epochs []epoch) (bool, error) {
+	recorded, err := mdb.GetSourceStateContext(ctx, src.source, mailboxStateKey)
+	if err != nil {
+		return false, err
+	}
+	if src.mailbox == "" || recorded == src.mailbox {
+		return false, nil
+	}
+
+	for _, e := range epochs {
+		last, err := mdb.GetSourceStateContext(ctx, src.source, e.name)
+		if err != nil {
+			return false, err
+		}
+		if last != "" {
+			log.Printf("Previously imported into mailbox %q, not %q; re-reading archive",
+				recorded, src.mailbox)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// The commit to import up to.  public-inbox uses master, but mirrors
+// don't always have it, in which case use HEAD.  Returns nil if the
+// repository is empty.
+func epochHead(repo *git.Repository) (*plumbing.Hash, error) {
+	if ref, err := repo.Reference(plumbing.NewBranchReferenceName("master"), true); err == nil {
+		h := ref.Hash()
+		return &h, nil
+	}
+
+	ref, err := repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	h := ref.Hash()
+	return &h, nil
+}
+
+func readFile(f *object.File) ([]byte, error) {
+	reader, err := f.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("Getting file reader for %s: %w", f.Name, err)
+	}
+	defer reader.Close()
+
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Reading file %s: %w", f.Name, err)
+	}
+	return b, nil
+}
+
+// The messages added and removed by a commit
+func commitChanges(c *object.Commit, v1 bool) (added, removed [][]byte, err error) {
+	// Get the tree for this commit
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Getting commit tree for revision %v: %w", c.Hash, err)
+	}
+
+	if !v1 {
+		// There's a single file in the tree: `m` for a new message,
+		// or `d` for a deleted one
+		if file, err := tree.File("m"); err == nil {
+			m, err := readFile(file)
+			return [][]byte{m}, nil, err
+		}
+		if file, err := tree.File("d"); err == nil {
+			d, err := readFile(file)
+			return nil, [][]byte{d}, err
+		}
+		log.Printf("Commit %v has neither m nor d, ignoring", c.Hash)
+		return nil, nil, nil
+	}
+
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Getting parent of revision %v: %w", c.Hash, err)
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Getting commit tree for revision %v: %w", parent.Hash, err)
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Getting changes in revision %v: %w", c.Hash, err)
+	}
+
+	for _, change := range changes {
+		from, to, err := change.Files()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Getting changes in revision %v: %w", c.Hash, err)
+		}
+		// A modified message is treated as removing the old
+		// version and adding the new one
+		if from != nil {
+			d, err := readFile(from)
+			if err != nil {
+				return nil, nil, err
+			}
+			removed = append(removed, d)
+		}
+		if to != nil {
+			m, err := readFile(to)
+			if err != nil {
+				return nil, nil, err
+			}
+			added = append(added, m)
+		}
+	}
+
+	return added, removed, nil
+}
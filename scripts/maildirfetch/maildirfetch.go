@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+	mdsrc "github.com/gwd/localmaildb/maildirsrc"
+)
+
+var (
+	mdbname = flag.String("mdb", "", "MailDB file")
+	mdpath  = flag.String("maildir", "", "Maildir path")
+	prefix  = flag.String("prefix", "", "Prefix for mailbox names")
+)
+
+func main() {
+	flag.Parse()
+
+	if *mdbname == "" {
+		log.Fatalf("Please specify a maildb file with -mdb")
+	}
+	if *mdpath == "" {
+		log.Fatalf("Please specify a maildir path with -maildir")
+	}
+
+	// CTRL-C stops the import, keeping whatever has been added so far
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	mdb, err := lmdb.OpenMailDBContext(ctx, *mdbname)
+	if err != nil {
+		log.Fatalf("Opening maildb file %s: %v", *mdbname, err)
+	}
+
+	src, err := mdsrc.Connect(mdsrc.MaildirInfo{Path: *mdpath, MailboxPrefix: *prefix})
+	if err != nil {
+		log.Fatalf("Opening maildir: %v", err)
+	}
+
+	err = src.FetchContext(ctx, mdb)
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted")
+	} else if err != nil {
+		log.Fatalf("Fetching messages: %v", err)
+	}
+}
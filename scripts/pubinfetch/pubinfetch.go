@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 
 	lmdb "github.com/gwd/localmaildb/localmaildb"
 	pisrc "github.com/gwd/localmaildb/pubinboxsrc"
 )
 
 var (
-	mdbname = flag.String("mdb", "", "MailDB file")
-	pipath  = flag.String("pipath", "", "Public Inbox path")
+	mdbname  = flag.String("mdb", "", "MailDB file")
+	pipath   = flag.String("pipath", "", "Public Inbox path")
+	parallel = flag.Int("parallel", 0, "Number of epochs to read at once (default: number of CPUs)")
+	mailbox  = flag.String("mailbox", "", "Mailbox to put messages in")
+	listid   = flag.String("listid", "", "Define -mailbox as all messages with this List-Id")
 )
 
 func main() {
@@ -23,20 +30,36 @@ func main() {
 		log.Fatalf("Please specify a public inbox path with -pipath")
 	}
 
+	// CTRL-C stops the import, keeping whatever has been added so far
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
 	// Attach a maildb
-	mdb, err := lmdb.OpenMailDB(*mdbname)
+	mdb, err := lmdb.OpenMailDBContext(ctx, *mdbname)
 	if err != nil {
 		log.Fatalf("Opening temporary maildb file %s: %v", *mdbname, err)
 	}
 
-	src, err := pisrc.Connect(pisrc.PublicInboxInfo{Path: *pipath})
+	src, err := pisrc.Connect(pisrc.PublicInboxInfo{
+		Path:        *pipath,
+		MailboxName: *mailbox,
+		ListId:      *listid,
+	})
 	if err != nil {
 		log.Fatalf("Opening PublicInbox: %v", err)
 	}
 
+	src.Parallel = *parallel
+	src.Progress = func(p pisrc.Progress) {
+		log.Printf("...epoch %s: %d/%d commits (%v); %d added, %d skipped, %d deleted in total",
+			p.Epoch, p.Commits, p.Total, p.Date.Format("2006-01-02"), p.Added, p.Skipped, p.Deleted)
+	}
+
 	log.Printf("Fetching mail")
-	err = src.Fetch(mdb)
-	if err != nil {
+	err = src.FetchContext(ctx, mdb)
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted")
+	} else if err != nil {
 		log.Fatalf("Fetching messages: %v", err)
 	}
 }
@@ -0,0 +1,81 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+// Source is somewhere mail is fetched from into a MailDB: an IMAP
+// account, a public-inbox archive, a Maildir and so on.
+type Source interface {
+	// FetchContext adds new mail to mdb, and brings the membership of
+	// the source's mailboxes up to date.  If ctx is cancelled it
+	// stops, returning ctx.Err(); what was written before that is
+	// kept.
+	FetchContext(ctx context.Context, mdb *lmdb.MailDB) error
+	Close()
+}
+
+// Watcher is implemented by sources which can wait for new mail to
+// arrive.  Watch keeps mdb in sync with the source until ctx is
+// cancelled (in which case it returns ctx.Err()) or an error occurs.
+type Watcher interface {
+	Watch(ctx context.Context, mdb *lmdb.MailDB) error
+}
+
+// Factory makes a source from its section of the configuration.  name
+// is the name the source was given there.
+type Factory func(name string, config *viper.Viper) (Source, error)
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]Factory{}
+)
+
+// Register makes a type of source available to New.  It panics if
+// the type is registered twice.
+func Register(typ string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[typ]; ok {
+		panic("source: Register called twice for type " + typ)
+	}
+	registry[typ] = factory
+}
+
+// Types returns the registered types of source, sorted.
+func Types() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	types := []string{}
+	for typ := range registry {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New makes a source of the given type.
+func New(typ, name string, config *viper.Viper) (Source, error) {
+	registryLock.Lock()
+	factory := registry[typ]
+	registryLock.Unlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("Source %s: unknown type %q (wanted one of %v)", name, typ, Types())
+	}
+
+	src, err := factory(name, config)
+	if err != nil {
+		return nil, fmt.Errorf("Source %s: %w", name, err)
+	}
+	return src, nil
+}
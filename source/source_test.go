@@ -0,0 +1,56 @@
+package source
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	lmdb "github.com/gwd/localmaildb/localmaildb"
+)
+
+type testSource struct {
+	name, path string
+}
+
+func (s *testSource) FetchContext(ctx context.Context, mdb *lmdb.MailDB) error { return nil }
+func (s *testSource) Close()                                                   {}
+
+func TestRegistry(t *testing.T) {
+	// The registry is global, so take the type out again for the next
+	// run (e.g., with -count)
+	t.Cleanup(func() {
+		registryLock.Lock()
+		defer registryLock.Unlock()
+		delete(registry, "test")
+	})
+	Register("test", func(name string, config *viper.Viper) (Source, error) {
+		return &testSource{name: name, path: config.GetString("path")}, nil
+	})
+
+	config := viper.New()
+	config.Set("path", "/somewhere")
+
+	src, err := New("test", "mine", config)
+	if err != nil {
+		t.Fatalf("Making source: %v", err)
+	}
+	if ts, ok := src.(*testSource); !ok || ts.name != "mine" || ts.path != "/somewhere" {
+		t.Errorf("ERROR: Got source %+v", src)
+	}
+
+	_, err = New("nonexistent", "other", config)
+	if err == nil || !strings.Contains(err.Error(), "unknown type") {
+		t.Errorf("ERROR: Making source of unknown type: got error %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("ERROR: Registering a type twice didn't panic")
+			}
+		}()
+		Register("test", nil)
+	}()
+}